@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,24 +8,31 @@ import (
 	"os/signal"
 
 	"github.com/detectivekaktus/JGame/internal/config"
-	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/media"
 	"github.com/detectivekaktus/JGame/internal/router"
+	"github.com/detectivekaktus/JGame/internal/validation"
+	"github.com/detectivekaktus/JGame/internal/websocket"
 )
 
 func main() {
+	config.Load()
+	validation.LoadSchemas()
+	media.Load()
+
 	r := router.NewRouter()
 
+	// The rooms left over by a previous run are cleaned up even if it
+	// didn't shut down gracefully.
+	websocket.ReconcileRooms()
+	websocket.StartReaper()
+	websocket.StartScheduler()
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
-		fmt.Println("Caught SIGINT signal. Cleaning up database before exiting...")
-
-		conn := database.GetConnection()
-		database.Execute(conn, "DELETE FROM rooms.player")
-		database.Execute(conn, "DELETE FROM rooms.room")
-		conn.Close(context.Background())
-
+		fmt.Println("Caught SIGINT signal. Closing rooms before exiting...")
+		websocket.CloseAllRooms()
 		os.Exit(0)
 	}()
 	
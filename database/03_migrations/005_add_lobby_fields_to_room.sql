@@ -0,0 +1,3 @@
+ALTER TABLE rooms.room
+ADD COLUMN min_users INT NOT NULL DEFAULT 1,
+ADD COLUMN auto_start INT NOT NULL DEFAULT 0;
@@ -0,0 +1,15 @@
+ALTER TABLE rooms.room
+ADD COLUMN settings JSONB NOT NULL DEFAULT '{}',
+ADD COLUMN state VARCHAR(16) NOT NULL DEFAULT 'lobby';
+
+UPDATE rooms.room SET settings = jsonb_build_object(
+  'max_players', max_users,
+  'min_players', min_users,
+  'auto_start', auto_start,
+  'visibility', 'public'
+);
+
+ALTER TABLE rooms.room
+DROP COLUMN max_users,
+DROP COLUMN min_users,
+DROP COLUMN auto_start;
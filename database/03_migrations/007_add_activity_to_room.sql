@@ -0,0 +1,3 @@
+ALTER TABLE rooms.room
+ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+ADD COLUMN last_activity TIMESTAMPTZ NOT NULL DEFAULT NOW();
@@ -0,0 +1,7 @@
+CREATE TABLE rooms.matchmaking_pack(
+  pack_id INT PRIMARY KEY,
+  category VARCHAR(32) NOT NULL,
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE
+);
+
+CREATE INDEX matchmaking_pack_category_idx ON rooms.matchmaking_pack(category);
@@ -0,0 +1,13 @@
+ALTER TABLE rooms.room
+ADD COLUMN scheduled_at TIMESTAMPTZ,
+ADD COLUMN start_on_schedule BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE rooms.rsvp(
+  room_id INT NOT NULL,
+  user_id INT NOT NULL,
+  reminded BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (room_id, user_id),
+  FOREIGN KEY (room_id) REFERENCES rooms.room(room_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
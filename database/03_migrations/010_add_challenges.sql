@@ -0,0 +1,30 @@
+CREATE TABLE rooms.challenge(
+  challenge_id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL,
+  pack_id INT NOT NULL,
+  settings JSONB NOT NULL DEFAULT '{}'::jsonb,
+  deadline TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE,
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE
+);
+
+CREATE TABLE rooms.challenge_invite(
+  challenge_id INT NOT NULL,
+  user_id INT NOT NULL,
+  PRIMARY KEY (challenge_id, user_id),
+  FOREIGN KEY (challenge_id) REFERENCES rooms.challenge(challenge_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+CREATE TABLE rooms.challenge_result(
+  challenge_id INT NOT NULL,
+  user_id INT NOT NULL,
+  score INT NOT NULL DEFAULT 0,
+  correct INT NOT NULL DEFAULT 0,
+  started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  finished_at TIMESTAMPTZ,
+  PRIMARY KEY (challenge_id, user_id),
+  FOREIGN KEY (challenge_id) REFERENCES rooms.challenge(challenge_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
@@ -0,0 +1,19 @@
+CREATE TABLE users.practice_stats(
+  user_id INT PRIMARY KEY,
+  sessions_played INT NOT NULL DEFAULT 0,
+  questions_answered INT NOT NULL DEFAULT 0,
+  correct_answers INT NOT NULL DEFAULT 0,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+-- The questions are identified by their title, since packs don't give ids
+-- to their questions and the order of them can change.
+CREATE TABLE users.practice_mistake(
+  user_id INT NOT NULL,
+  pack_id INT NOT NULL,
+  question TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, pack_id, question),
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE,
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE
+);
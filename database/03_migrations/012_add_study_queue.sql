@@ -0,0 +1,24 @@
+CREATE TABLE users.study_subscription(
+  user_id INT NOT NULL,
+  pack_id INT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, pack_id),
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE,
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE
+);
+
+-- Like the practice mistakes, the questions are identified by their title.
+CREATE TABLE users.study_card(
+  user_id INT NOT NULL,
+  pack_id INT NOT NULL,
+  question TEXT NOT NULL,
+  repetitions INT NOT NULL DEFAULT 0,
+  interval_days INT NOT NULL DEFAULT 0,
+  ease REAL NOT NULL DEFAULT 2.5,
+  due_at TIMESTAMPTZ NOT NULL,
+  reviewed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, pack_id, question),
+  FOREIGN KEY (user_id, pack_id) REFERENCES users.study_subscription(user_id, pack_id) ON DELETE CASCADE
+);
+
+CREATE INDEX study_card_due_idx ON users.study_card(user_id, due_at);
@@ -0,0 +1,54 @@
+CREATE TABLE rooms.tournament(
+  tournament_id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL,
+  name VARCHAR(32) NOT NULL,
+  pack_id INT NOT NULL,
+  settings JSONB NOT NULL DEFAULT '{}'::jsonb,
+  room_size INT NOT NULL,
+  advance INT NOT NULL,
+  state VARCHAR(16) NOT NULL DEFAULT 'registration',
+  current_round INT NOT NULL DEFAULT 0,
+  winner_id INT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE,
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE,
+  FOREIGN KEY (winner_id) REFERENCES users."user"(user_id) ON DELETE SET NULL
+);
+
+CREATE TABLE rooms.tournament_player(
+  tournament_id INT NOT NULL,
+  user_id INT NOT NULL,
+  registered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (tournament_id, user_id),
+  FOREIGN KEY (tournament_id) REFERENCES rooms.tournament(tournament_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+-- The rooms are closed once played, so room_id is kept without a foreign
+-- key to remember which room a match was played in. The ids of the closed
+-- rooms are reused, so only the playing match of a room belongs to it. The
+-- matches of a single player (byes) have no room.
+CREATE TABLE rooms.tournament_match(
+  tournament_id INT NOT NULL,
+  round INT NOT NULL,
+  slot INT NOT NULL,
+  room_id INT,
+  state VARCHAR(16) NOT NULL DEFAULT 'playing',
+  PRIMARY KEY (tournament_id, round, slot),
+  FOREIGN KEY (tournament_id) REFERENCES rooms.tournament(tournament_id) ON DELETE CASCADE
+);
+
+CREATE INDEX tournament_match_room_idx ON rooms.tournament_match(room_id);
+
+CREATE TABLE rooms.tournament_entry(
+  tournament_id INT NOT NULL,
+  round INT NOT NULL,
+  slot INT NOT NULL,
+  user_id INT NOT NULL,
+  score INT,
+  rank INT,
+  advanced BOOLEAN NOT NULL DEFAULT FALSE,
+  PRIMARY KEY (tournament_id, round, user_id),
+  FOREIGN KEY (tournament_id, round, slot) REFERENCES rooms.tournament_match(tournament_id, round, slot) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
@@ -0,0 +1,52 @@
+ALTER TABLE users."user"
+ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE users.season(
+  season_id SERIAL PRIMARY KEY,
+  name VARCHAR(32) NOT NULL,
+  starts_at TIMESTAMPTZ NOT NULL,
+  ends_at TIMESTAMPTZ NOT NULL,
+  archived BOOLEAN NOT NULL DEFAULT FALSE,
+  CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX season_period_idx ON users.season(starts_at, ends_at);
+
+CREATE TABLE users.season_stats(
+  season_id INT NOT NULL,
+  user_id INT NOT NULL,
+  matches_played INT NOT NULL DEFAULT 0,
+  matches_won INT NOT NULL DEFAULT 0,
+  rating INT NOT NULL,
+  PRIMARY KEY (season_id, user_id),
+  FOREIGN KEY (season_id) REFERENCES users.season(season_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX season_stats_rating_idx ON users.season_stats(season_id, rating DESC);
+
+CREATE TABLE users.season_standing(
+  season_id INT NOT NULL,
+  user_id INT NOT NULL,
+  rank INT NOT NULL,
+  matches_played INT NOT NULL,
+  matches_won INT NOT NULL,
+  rating INT NOT NULL,
+  PRIMARY KEY (season_id, user_id),
+  FOREIGN KEY (season_id) REFERENCES users.season(season_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX season_standing_rank_idx ON users.season_standing(season_id, rank);
+
+CREATE TABLE users.achievement(
+  achievement_id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL,
+  kind VARCHAR(32) NOT NULL,
+  season_id INT,
+  title TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (user_id, kind, season_id),
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE,
+  FOREIGN KEY (season_id) REFERENCES users.season(season_id) ON DELETE CASCADE
+);
@@ -0,0 +1,12 @@
+CREATE TABLE users.media(
+  media_id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL,
+  storage_key VARCHAR(64) NOT NULL UNIQUE,
+  thumbnail_key VARCHAR(64) UNIQUE,
+  content_type VARCHAR(64) NOT NULL,
+  size BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX media_user_idx ON users.media(user_id);
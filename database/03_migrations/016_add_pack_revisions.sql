@@ -0,0 +1,35 @@
+CREATE TABLE packs.revision(
+  revision_id SERIAL PRIMARY KEY,
+  pack_id INT NOT NULL,
+  number INT NOT NULL,
+  user_id INT,
+  name VARCHAR(32),
+  body JSONB NOT NULL,
+  note VARCHAR(256) NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (pack_id, number),
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE SET NULL
+);
+
+-- The packs that already exist start with their current body.
+INSERT INTO packs.revision (pack_id, number, user_id, name, body, note)
+SELECT pack_id, 1, user_id, COALESCE(name, ''), body, 'Initial revision' FROM packs.pack;
+
+ALTER TABLE rooms.room
+ADD COLUMN revision_id INT REFERENCES packs.revision(revision_id) ON DELETE SET NULL;
+
+ALTER TABLE rooms.challenge
+ADD COLUMN revision_id INT REFERENCES packs.revision(revision_id) ON DELETE SET NULL;
+
+ALTER TABLE rooms.tournament
+ADD COLUMN revision_id INT REFERENCES packs.revision(revision_id) ON DELETE SET NULL;
+
+UPDATE rooms.room r SET revision_id = v.revision_id
+FROM packs.revision v WHERE v.pack_id = r.pack_id;
+
+UPDATE rooms.challenge c SET revision_id = v.revision_id
+FROM packs.revision v WHERE v.pack_id = c.pack_id;
+
+UPDATE rooms.tournament t SET revision_id = v.revision_id
+FROM packs.revision v WHERE v.pack_id = t.pack_id;
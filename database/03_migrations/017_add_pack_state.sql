@@ -0,0 +1,14 @@
+-- The packs that already exist were visible to everyone, so they stay
+-- published. The new packs start as drafts.
+ALTER TABLE packs.pack
+ADD COLUMN state VARCHAR(16) NOT NULL DEFAULT 'published';
+
+ALTER TABLE packs.pack
+ALTER COLUMN state SET DEFAULT 'draft';
+
+ALTER TABLE packs.pack
+ADD COLUMN published_at TIMESTAMPTZ;
+
+UPDATE packs.pack SET published_at = NOW();
+
+CREATE INDEX pack_state_idx ON packs.pack(state);
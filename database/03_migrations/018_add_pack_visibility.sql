@@ -0,0 +1,41 @@
+-- The packs that already exist were visible to everyone, so they stay
+-- public.
+ALTER TABLE packs.pack
+ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public';
+
+CREATE INDEX pack_visibility_idx ON packs.pack(visibility);
+
+CREATE TABLE users."group"(
+  group_id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL,
+  name VARCHAR(32) NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+CREATE TABLE users.group_member(
+  group_id INT NOT NULL,
+  user_id INT NOT NULL,
+  added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (group_id, user_id),
+  FOREIGN KEY (group_id) REFERENCES users."group"(group_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX group_member_user_idx ON users.group_member(user_id);
+
+-- Every entry grants the access to either a user or a group.
+CREATE TABLE packs.access(
+  access_id SERIAL PRIMARY KEY,
+  pack_id INT NOT NULL,
+  user_id INT,
+  group_id INT,
+  role VARCHAR(16) NOT NULL DEFAULT 'viewer',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CHECK ((user_id IS NULL) <> (group_id IS NULL)),
+  UNIQUE (pack_id, user_id),
+  UNIQUE (pack_id, group_id),
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE,
+  FOREIGN KEY (group_id) REFERENCES users."group"(group_id) ON DELETE CASCADE
+);
@@ -0,0 +1,34 @@
+-- The number of the latest revision, checked by the saves to not overwrite
+-- the changes of the other authors.
+ALTER TABLE packs.pack
+ADD COLUMN revision INT NOT NULL DEFAULT 1;
+
+UPDATE packs.pack p SET revision = v.number
+FROM (SELECT pack_id, MAX(number) AS number FROM packs.revision GROUP BY pack_id) v
+WHERE v.pack_id = p.pack_id;
+
+-- The co-authors, the creator of the pack is packs.pack.user_id.
+CREATE TABLE packs.author(
+  pack_id INT NOT NULL,
+  user_id INT NOT NULL,
+  role VARCHAR(16) NOT NULL DEFAULT 'editor',
+  added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (pack_id, user_id),
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX author_user_idx ON packs.author(user_id);
+
+CREATE TABLE packs.author_invite(
+  invite_id SERIAL PRIMARY KEY,
+  pack_id INT NOT NULL,
+  user_id INT NOT NULL,
+  role VARCHAR(16) NOT NULL DEFAULT 'editor',
+  invited_by INT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (pack_id, user_id),
+  FOREIGN KEY (pack_id) REFERENCES packs.pack(pack_id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users."user"(user_id) ON DELETE CASCADE,
+  FOREIGN KEY (invited_by) REFERENCES users."user"(user_id) ON DELETE SET NULL
+);
@@ -0,0 +1,4 @@
+ALTER TABLE packs.pack
+ADD COLUMN forked_from INT REFERENCES packs.pack(pack_id) ON DELETE SET NULL;
+
+CREATE INDEX pack_forked_from_idx ON packs.pack(forked_from);
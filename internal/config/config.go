@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,9 +16,73 @@ type Config struct {
 	SslCertPath string
 	SslKeyPath  string
 	LocalIp     string
+
+	// The upper limit for max_players in room settings.
+	MaxRoomUsers int
+
+	// Rooms are closed after they had no activity for RoomIdleTimeout,
+	// had no connected users for RoomEmptyTimeout, or finished the game
+	// RoomFinishedTimeout ago. The reaper checks them every RoomReapInterval.
+	RoomIdleTimeout     time.Duration
+	RoomEmptyTimeout    time.Duration
+	RoomFinishedTimeout time.Duration
+	RoomReapInterval    time.Duration
+
+	// The rooms of the tournament matches wait TournamentMatchTimeout for
+	// the seeded players, who are only told about them, before they are
+	// closed and the match is abandoned.
+	TournamentMatchTimeout time.Duration
+
+	// Number of players the matchmaking queue puts in one room and how
+	// long a player waits in the queue before giving up.
+	MatchmakingPlayers int
+	MatchmakingTimeout time.Duration
+
+	// How long before a scheduled room opens the RSVP'd users are reminded
+	// and how long after it opened the game starts for the rooms that start
+	// on schedule.
+	ScheduleReminderLead time.Duration
+	ScheduleStartDelay   time.Duration
+
+	// Where the uploaded media is stored: `local` keeps the files in
+	// MediaDir, `s3` in the S3Bucket of any S3-compatible service. The
+	// media is served by this server under MediaBaseUrl. Every user can
+	// store up to MediaQuota bytes.
+	MediaStorage string
+	MediaDir     string
+	MediaBaseUrl string
+	MediaQuota   int64
+	S3Endpoint   string
+	S3Region     string
+	S3Bucket     string
+	S3AccessKey  string
+	S3SecretKey  string
+}
+
+// Reads the duration from the `name` environment variable. Returns `fallback`
+// if the variable is not set.
+func loadDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		fmt.Fprintf(os.Stderr, "%s must be a positive duration like `10m` or `30s`.\n", name)
+		os.Exit(1)
+	}
+	return d
 }
 
-var AppConfig = load()
+// The config of the server, nil until Load is called.
+var AppConfig *Config
+
+// Loads the config from `.env` and the environment. Must be called before
+// anything else starts, exits if the config is broken.
+func Load() {
+	AppConfig = load()
+}
 
 func load() *Config {
 	err := godotenv.Load()
@@ -49,12 +116,86 @@ func load() *Config {
 		fmt.Fprintf(os.Stderr, "No local IP specified. The server will not respond to requests that don't come from localhost.\n")
 	}
 
+	maxRoomUsers := 2 << 3
+	if v := os.Getenv("MAX_ROOM_USERS"); v != "" {
+		maxRoomUsers, err = strconv.Atoi(v)
+		if err != nil || maxRoomUsers < 1 {
+			fmt.Fprintf(os.Stderr, "MAX_ROOM_USERS must be a positive integer.\n")
+			os.Exit(1)
+		}
+	}
+
+	matchmakingPlayers := 4
+	if v := os.Getenv("MATCHMAKING_PLAYERS"); v != "" {
+		matchmakingPlayers, err = strconv.Atoi(v)
+		if err != nil || matchmakingPlayers < 2 || matchmakingPlayers > maxRoomUsers {
+			fmt.Fprintf(os.Stderr, "MATCHMAKING_PLAYERS must be between 2 and MAX_ROOM_USERS.\n")
+			os.Exit(1)
+		}
+	}
+
+	mediaStorage := os.Getenv("MEDIA_STORAGE")
+	if mediaStorage == "" {
+		mediaStorage = "local"
+	}
+	if mediaStorage != "local" && mediaStorage != "s3" {
+		fmt.Fprintf(os.Stderr, "MEDIA_STORAGE must be either `local` or `s3`.\n")
+		os.Exit(1)
+	}
+	if mediaStorage == "s3" && (os.Getenv("S3_ENDPOINT") == "" || os.Getenv("S3_BUCKET") == "") {
+		fmt.Fprintf(os.Stderr, "S3_ENDPOINT and S3_BUCKET must be set to store the media in S3.\n")
+		os.Exit(1)
+	}
+
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = "./media"
+	}
+
+	mediaBaseUrl := strings.TrimSuffix(os.Getenv("MEDIA_BASE_URL"), "/")
+	if mediaBaseUrl == "" {
+		mediaBaseUrl = "https://localhost:8080"
+	}
+
+	mediaQuotaMb := 100
+	if v := os.Getenv("MEDIA_QUOTA_MB"); v != "" {
+		mediaQuotaMb, err = strconv.Atoi(v)
+		if err != nil || mediaQuotaMb < 1 {
+			fmt.Fprintf(os.Stderr, "MEDIA_QUOTA_MB must be a positive integer.\n")
+			os.Exit(1)
+		}
+	}
+
+	s3Region := os.Getenv("S3_REGION")
+	if s3Region == "" {
+		s3Region = "us-east-1"
+	}
+
 	c := &Config{
 		DevMode: mode == "dev",
 		DbUrl: dbUrl,
 		SslCertPath: sslCertificatePath,
 		SslKeyPath: sslKeyPath,
 		LocalIp: localIp,
+		MaxRoomUsers: maxRoomUsers,
+		RoomIdleTimeout: loadDuration("ROOM_IDLE_TIMEOUT", 30 * time.Minute),
+		RoomEmptyTimeout: loadDuration("ROOM_EMPTY_TIMEOUT", 5 * time.Minute),
+		RoomFinishedTimeout: loadDuration("ROOM_FINISHED_TIMEOUT", 10 * time.Minute),
+		RoomReapInterval: loadDuration("ROOM_REAP_INTERVAL", time.Minute),
+		TournamentMatchTimeout: loadDuration("TOURNAMENT_MATCH_TIMEOUT", time.Hour),
+		MatchmakingPlayers: matchmakingPlayers,
+		MatchmakingTimeout: loadDuration("MATCHMAKING_TIMEOUT", 2 * time.Minute),
+		ScheduleReminderLead: loadDuration("SCHEDULE_REMINDER_LEAD", 15 * time.Minute),
+		ScheduleStartDelay: loadDuration("SCHEDULE_START_DELAY", 2 * time.Minute),
+		MediaStorage: mediaStorage,
+		MediaDir: mediaDir,
+		MediaBaseUrl: mediaBaseUrl,
+		MediaQuota: int64(mediaQuotaMb) << 20,
+		S3Endpoint: strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		S3Region: s3Region,
+		S3Bucket: os.Getenv("S3_BUCKET"),
+		S3AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey: os.Getenv("S3_SECRET_KEY"),
 	}
 	return c
 }
@@ -78,3 +78,20 @@ func Execute(conn *pgx.Conn, stmnt string, args ...any) (pgconn.CommandTag, erro
 	}
 	return retVal, err
 }
+
+// Runs `f` in a transaction on the connection, every statement `f` runs on
+// the connection is part of it. The transaction is committed if `f` returns
+// nil and rolled back otherwise.
+func Transaction(conn *pgx.Conn, f func() error) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+
+	err = f()
+	if err != nil {
+		tx.Rollback(context.Background())
+		return err
+	}
+	return tx.Commit(context.Background())
+}
@@ -0,0 +1,345 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The visibility of a pack decides who can see and play it once it's
+// published:
+//   - private packs are seen by their author alone,
+//   - unlisted packs by everyone who knows their id, but they're not
+//     browsable,
+//   - public packs by everyone,
+//   - shared packs by the users and the members of the groups listed in
+//     packs.access. The editors can also change the pack and see its
+//     drafts.
+// The authors of the pack, its creator and the co-authors (see author.go),
+// see and edit the pack whatever its visibility. Only its owners publish,
+// archive, delete the pack and change who can access it.
+// packs.access(
+//   access_id  serial primary int,
+//   pack_id    int (from packs.pack),
+//   user_id    int (from users.user, or null for a group),
+//   group_id   int (from users.group, or null for a user),
+//   role       varchar(16),
+//   created_at timestamptz
+// )
+
+// The packs use the visibility levels of the rooms and one more.
+const VISIBILITY_SHARED = "shared"
+
+const (
+	ROLE_VIEWER = "viewer"
+	ROLE_EDITOR = "editor"
+	// Only for the authors, the creator of the pack has it.
+	ROLE_OWNER  = "owner"
+)
+
+type PackAccess struct {
+	Id        int       `json:"id"`
+	PackId    int       `json:"pack_id"`
+	UserId    *int      `json:"user_id,omitempty"`
+	GroupId   *int      `json:"group_id,omitempty"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PackVisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
+func isVisibility(visibility string) bool {
+	switch visibility {
+	case VISIBILITY_PRIVATE, VISIBILITY_UNLISTED, VISIBILITY_PUBLIC, VISIBILITY_SHARED:
+		return true
+	}
+	return false
+}
+
+// SQL condition of the packs the user given by the parameter `param` can
+// see, for the queries selecting from packs.pack aliased as `pack`. The
+// rules are the same as packRole's.
+func viewablePackSql(pack string, param string) string {
+	return fmt.Sprintf("(%[1]s.user_id = %[2]s OR EXISTS (SELECT * FROM packs.author au WHERE au.pack_id = %[1]s.pack_id AND au.user_id = %[2]s) OR (%[1]s.state <> 'draft' AND %[1]s.visibility IN ('public', 'unlisted')) OR (%[1]s.visibility = 'shared' AND EXISTS (SELECT * FROM packs.access a WHERE a.pack_id = %[1]s.pack_id AND (%[1]s.state <> 'draft' OR a.role = 'editor') AND (a.user_id = %[2]s OR a.group_id IN (SELECT gm.group_id FROM users.group_member gm WHERE gm.user_id = %[2]s)))))", pack, param)
+}
+
+// Returns the role of the user of the session, which is nil for the
+// anonymous users, in the pack, or an empty string if they can't see it.
+func packRole(conn *pgx.Conn, pack *Pack, session *Session) (string, error) {
+	if session != nil && session.UserId == pack.UserId {
+		return ROLE_OWNER, nil
+	}
+
+	if session != nil {
+		var authorRole string
+		err := database.QueryRow(conn, "SELECT role FROM packs.author WHERE pack_id = $1 AND user_id = $2",
+			pack.Id, session.UserId).Scan(&authorRole)
+		if err == nil {
+			return authorRole, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+	}
+
+	role := ""
+	switch pack.Visibility {
+	case VISIBILITY_PUBLIC, VISIBILITY_UNLISTED:
+		role = ROLE_VIEWER
+	case VISIBILITY_SHARED:
+		if session == nil {
+			break
+		}
+		var shared, editor bool
+		err := database.QueryRow(conn, "SELECT COUNT(*) > 0, COALESCE(BOOL_OR(role = $3), false) FROM packs.access WHERE pack_id = $1 AND (user_id = $2 OR group_id IN (SELECT group_id FROM users.group_member WHERE user_id = $2))",
+			pack.Id, session.UserId, ROLE_EDITOR).Scan(&shared, &editor)
+		if err != nil {
+			return "", err
+		}
+		if editor {
+			role = ROLE_EDITOR
+		} else if shared {
+			role = ROLE_VIEWER
+		}
+	}
+
+	// The drafts are shown to the people working on them only.
+	if pack.State == PACK_DRAFT && role != ROLE_EDITOR {
+		return "", nil
+	}
+	return role, nil
+}
+
+// Returns whether the user can see the pack in any state. Pass zero userId
+// for the anonymous users.
+func CanViewPack(conn *pgx.Conn, packId any, userId int) (bool, error) {
+	var viewable bool
+	err := database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM packs.pack p WHERE p.pack_id = $1 AND " + viewablePackSql("p", "$2") + ")",
+		packId, userId).Scan(&viewable)
+	return viewable, err
+}
+
+// Returns false if the user can't see the pack of the room. The rooms that
+// don't exist are reported as visible, the caller tells the user there's
+// no such room.
+func CanViewRoomPack(conn *pgx.Conn, roomId int, userId int) (bool, error) {
+	var hidden bool
+	err := database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM rooms.room r JOIN packs.pack p ON r.pack_id = p.pack_id WHERE r.room_id = $1 AND NOT " + viewablePackSql("p", "$2") + ")",
+		roomId, userId).Scan(&hidden)
+	return !hidden, err
+}
+
+// Returns false if the user can't see the room. Only the owner and the
+// invited players can see a private room: the players seated in it, the
+// ones seeded into it by a tournament and the ones who know its password.
+// The rooms that don't exist are reported as visible, the caller tells the
+// user there's no such room.
+func CanSeeRoom(conn *pgx.Conn, roomId int, userId int, password string) (bool, error) {
+	var hidden bool
+	err := database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM rooms.room r WHERE r.room_id = $1 AND r.settings->>'visibility' = $4 AND r.user_id <> $2 AND (COALESCE(r.password, '') = '' OR r.password <> $3) AND NOT EXISTS (SELECT * FROM rooms.player p WHERE p.room_id = r.room_id AND p.user_id = $2) AND NOT EXISTS (SELECT * FROM rooms.tournament_match m JOIN rooms.tournament_entry e ON e.tournament_id = m.tournament_id AND e.round = m.round AND e.slot = m.slot WHERE m.room_id = r.room_id AND m.state = $5 AND e.user_id = $2))",
+		roomId, userId, password, VISIBILITY_PRIVATE, MATCH_PLAYING).Scan(&hidden)
+	return !hidden, err
+}
+
+// Same as getViewablePack, but only for the author and the editors of the
+// pack.
+func getEditablePack(w http.ResponseWriter, r *http.Request, conn *pgx.Conn, session *Session, pack *Pack) bool {
+	role, ok := getPackWithRole(w, r, conn, session, pack)
+	if !ok {
+		return false
+	}
+
+	if role != ROLE_OWNER && role != ROLE_EDITOR {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Can't modify a pack that is not shared with them for editing.")
+		return false
+	}
+	return true
+}
+
+func GetPackAccess(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getOwnPack(w, r, conn, session, &pack) {
+		return
+	}
+
+	rows := database.QueryRows(conn, "SELECT access_id, pack_id, user_id, group_id, role, created_at FROM packs.access WHERE pack_id = $1 ORDER BY created_at",
+		pack.Id)
+	defer rows.Close()
+
+	entries := []PackAccess{}
+	for rows.Next() {
+		var entry PackAccess
+		err := rows.Scan(&entry.Id, &entry.PackId, &entry.UserId, &entry.GroupId, &entry.Role, &entry.CreatedAt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read access GET /api/packs/id/access: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read the access list.")
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate access GET /api/packs/id/access: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate the access list.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Grants the user or the group the role in the pack, or changes the role
+// they have. The access list is used once the pack is shared.
+func PutPackAccess(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getOwnPack(w, r, conn, session, &pack) {
+		return
+	}
+
+	var entry PackAccess
+	err := json.NewDecoder(r.Body).Decode(&entry)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	if (entry.UserId == nil) == (entry.GroupId == nil) {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Either user_id or group_id must be specified.")
+		return
+	}
+
+	if entry.UserId != nil && *entry.UserId == pack.UserId {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"The creator always has access to their pack.")
+		return
+	}
+
+	if entry.Role == "" {
+		entry.Role = ROLE_VIEWER
+	}
+	if entry.Role != ROLE_VIEWER && entry.Role != ROLE_EDITOR {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"role must be either viewer or editor.")
+		return
+	}
+
+	conflict := "user_id"
+	if entry.GroupId != nil {
+		conflict = "group_id"
+	}
+	err = database.QueryRow(conn, "INSERT INTO packs.access (pack_id, user_id, group_id, role) VALUES ($1, $2, $3, $4) ON CONFLICT (pack_id, " + conflict + ") DO UPDATE SET role = EXCLUDED.role RETURNING access_id, pack_id, created_at",
+		pack.Id, entry.UserId, entry.GroupId, entry.Role).Scan(&entry.Id, &entry.PackId, &entry.CreatedAt)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == database.ForeignKeyViolation {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No user or group with given id exists.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not put access PUT /api/packs/id/access: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not save the access.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(entry)
+}
+
+func DeletePackAccess(w http.ResponseWriter, r *http.Request) {
+	accessId := mux.Vars(r)["access_id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getOwnPack(w, r, conn, session, &pack) {
+		return
+	}
+
+	tag, err := database.Execute(conn, "DELETE FROM packs.access WHERE access_id = $1 AND pack_id = $2",
+		accessId, pack.Id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not delete access DELETE /api/packs/id/access/access_id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not delete the access.")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"The pack has no access entry with the given id.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func SetPackVisibility(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getOwnPack(w, r, conn, session, &pack) {
+		return
+	}
+
+	var request PackVisibilityRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	if !isVisibility(request.Visibility) {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"visibility must be one of private, unlisted, public or shared.")
+		return
+	}
+
+	err = scanPack(database.QueryRow(conn, "UPDATE packs.pack SET visibility = $1 WHERE pack_id = $2 RETURNING " + PACK_COLUMNS,
+		request.Visibility, pack.Id), &pack)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No pack with given id exists.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not set visibility PUT /api/packs/id/visibility: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not update the pack.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(pack)
+}
@@ -0,0 +1,341 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The packs can be written by several authors. The creator of the pack
+// and the co-authors with the owner role invite the other users, who
+// become co-authors once they accept the invite. The editors change the
+// pack, the owners also manage it like its creator does (see access.go):
+// packs.author(
+//   pack_id  int (from packs.pack),
+//   user_id  int (from users.user),
+//   role     varchar(16),
+//   added_at timestamptz
+// )
+// packs.author_invite(
+//   invite_id  serial primary int,
+//   pack_id    int (from packs.pack),
+//   user_id    int (from users.user, the invited one),
+//   role       varchar(16),
+//   invited_by int (from users.user),
+//   created_at timestamptz
+// )
+
+type PackAuthor struct {
+	PackId  int       `json:"pack_id"`
+	UserId  int       `json:"user_id"`
+	Role    string    `json:"role"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type AuthorInvite struct {
+	Id        int       `json:"id"`
+	PackId    int       `json:"pack_id"`
+	PackName  string    `json:"pack_name"`
+	UserId    int       `json:"user_id"`
+	Role      string    `json:"role"`
+	InvitedBy *int      `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PackAuthorsResponse struct {
+	CreatorId int            `json:"creator_id"`
+	Authors   []PackAuthor   `json:"authors"`
+	Invites   []AuthorInvite `json:"invites"`
+}
+
+const AUTHOR_INVITE_COLUMNS = "i.invite_id, i.pack_id, p.name, i.user_id, i.role, i.invited_by, i.created_at"
+
+func scanAuthorInvite(row pgx.Row, invite *AuthorInvite) error {
+	return row.Scan(&invite.Id, &invite.PackId, &invite.PackName, &invite.UserId, &invite.Role, &invite.InvitedBy, &invite.CreatedAt)
+}
+
+// Returns the co-authors and the pending invites of the pack to the people
+// working on it.
+func GetPackAuthors(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getEditablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	response := PackAuthorsResponse{ CreatorId: pack.UserId, Authors: []PackAuthor{}, Invites: []AuthorInvite{}, }
+	rows := database.QueryRows(conn, "SELECT pack_id, user_id, role, added_at FROM packs.author WHERE pack_id = $1 ORDER BY added_at",
+		pack.Id)
+	for rows.Next() {
+		var author PackAuthor
+		err := rows.Scan(&author.PackId, &author.UserId, &author.Role, &author.AddedAt)
+		if err != nil {
+			rows.Close()
+			fmt.Fprintf(os.Stderr, "Could not read authors GET /api/packs/id/authors: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read the authors.")
+			return
+		}
+		response.Authors = append(response.Authors, author)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate authors GET /api/packs/id/authors: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate the authors.")
+		return
+	}
+
+	rows = database.QueryRows(conn, "SELECT " + AUTHOR_INVITE_COLUMNS + " FROM packs.author_invite i JOIN packs.pack p ON i.pack_id = p.pack_id WHERE i.pack_id = $1 ORDER BY i.created_at",
+		pack.Id)
+	defer rows.Close()
+	for rows.Next() {
+		var invite AuthorInvite
+		err := scanAuthorInvite(rows, &invite)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read invites GET /api/packs/id/authors: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read the invites.")
+			return
+		}
+		response.Invites = append(response.Invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate invites GET /api/packs/id/authors: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate the invites.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Invites the user to co-author the pack. Inviting the user again changes
+// the role they're invited with.
+func InvitePackAuthor(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getOwnPack(w, r, conn, session, &pack) {
+		return
+	}
+
+	var invite AuthorInvite
+	err := json.NewDecoder(r.Body).Decode(&invite)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	if invite.UserId == 0 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Missing fields",
+			"user_id field must be specified.")
+		return
+	}
+
+	if invite.Role == "" {
+		invite.Role = ROLE_EDITOR
+	}
+	if invite.Role != ROLE_EDITOR && invite.Role != ROLE_OWNER {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"role must be either editor or owner.")
+		return
+	}
+
+	var author bool
+	err = database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM packs.pack WHERE pack_id = $1 AND user_id = $2) OR EXISTS (SELECT * FROM packs.author WHERE pack_id = $1 AND user_id = $2)",
+		pack.Id, invite.UserId).Scan(&author)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check author POST /api/packs/id/authors: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not check the authors.")
+		return
+	}
+	if author {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Conflict",
+			"The user is already an author of the pack.")
+		return
+	}
+
+	err = database.QueryRow(conn, "INSERT INTO packs.author_invite (pack_id, user_id, role, invited_by) VALUES ($1, $2, $3, $4) ON CONFLICT (pack_id, user_id) DO UPDATE SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by RETURNING invite_id, invited_by, created_at",
+		pack.Id, invite.UserId, invite.Role, session.UserId).Scan(&invite.Id, &invite.InvitedBy, &invite.CreatedAt)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == database.ForeignKeyViolation {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No user with given id exists.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not insert invite POST /api/packs/id/authors: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not invite the user.")
+		return
+	}
+	invite.PackId = pack.Id
+	invite.PackName = pack.Name
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(invite)
+}
+
+// Removes the co-author from the pack. The owners remove anyone, the
+// co-authors remove themselves.
+func RemovePackAuthor(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["user_id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	role, ok := getPackWithRole(w, r, conn, session, &pack)
+	if !ok {
+		return
+	}
+
+	if role != ROLE_OWNER && userId != strconv.Itoa(session.UserId) {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Only the owners can remove the other authors.")
+		return
+	}
+
+	tag, err := database.Execute(conn, "DELETE FROM packs.author WHERE pack_id = $1 AND user_id = $2",
+		pack.Id, userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not delete author DELETE /api/packs/id/authors/user_id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not remove the author.")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"The user is not a co-author of the pack.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the pending invites of the user.
+func GetAuthorInvites(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	rows := database.QueryRows(conn, "SELECT " + AUTHOR_INVITE_COLUMNS + " FROM packs.author_invite i JOIN packs.pack p ON i.pack_id = p.pack_id WHERE i.user_id = $1 ORDER BY i.created_at",
+		session.UserId)
+	defer rows.Close()
+
+	invites := []AuthorInvite{}
+	for rows.Next() {
+		var invite AuthorInvite
+		err := scanAuthorInvite(rows, &invite)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read invites GET /api/packs/invites: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read the invites.")
+			return
+		}
+		invites = append(invites, invite)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate invites GET /api/packs/invites: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate the invites.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(invites)
+}
+
+func AcceptAuthorInvite(w http.ResponseWriter, r *http.Request) {
+	inviteId := mux.Vars(r)["invite_id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var author PackAuthor
+	err := database.QueryRow(conn, "WITH i AS (DELETE FROM packs.author_invite WHERE invite_id = $1 AND user_id = $2 RETURNING pack_id, user_id, role) INSERT INTO packs.author (pack_id, user_id, role) SELECT pack_id, user_id, role FROM i ON CONFLICT (pack_id, user_id) DO UPDATE SET role = EXCLUDED.role RETURNING pack_id, user_id, role, added_at",
+		inviteId, session.UserId).Scan(&author.PackId, &author.UserId, &author.Role, &author.AddedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"You have no invite with the given id.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not accept invite POST /api/packs/invites/id/accept: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not accept the invite.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(author)
+}
+
+// Declines the invite, or cancels it for the owners of the pack.
+func DeleteAuthorInvite(w http.ResponseWriter, r *http.Request) {
+	inviteId := mux.Vars(r)["invite_id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var invite AuthorInvite
+	var pack Pack
+	err := scanAuthorInvite(database.QueryRow(conn, "SELECT " + AUTHOR_INVITE_COLUMNS + " FROM packs.author_invite i JOIN packs.pack p ON i.pack_id = p.pack_id WHERE i.invite_id = $1", inviteId), &invite)
+	if err == nil && invite.UserId != session.UserId {
+		err = scanPack(database.QueryRow(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack WHERE pack_id = $1", invite.PackId), &pack)
+		var role string
+		if err == nil {
+			role, err = packRole(conn, &pack, session)
+		}
+		if err == nil && role != ROLE_OWNER {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"You have no invite with the given id.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not get invite DELETE /api/packs/invites/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the invite.")
+		return
+	}
+
+	_, err = database.Execute(conn, "DELETE FROM packs.author_invite WHERE invite_id = $1", invite.Id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not delete invite DELETE /api/packs/invites/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not delete the invite.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
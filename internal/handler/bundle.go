@@ -0,0 +1,477 @@
+package handler
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/detectivekaktus/JGame/internal/media"
+	"github.com/detectivekaktus/JGame/internal/validation"
+	"github.com/jackc/pgx/v5"
+)
+
+// A bundle is a zip with everything a pack needs, so it can be backed up
+// or moved to another server:
+//   manifest.json  what's in the bundle, see BundleManifest,
+//   pack.json      the pack as GetPack returns it,
+//   media/         the pictures and clips of the pack.
+// Importing the bundle uploads the media again for the importing user,
+// counting towards their quota, and points the pack to the new urls. The
+// media that couldn't be downloaded on export is left at its url.
+//
+// Exporting downloads the media from other hosts, so only the signed in
+// users can export, and a bundle takes up to MAX_BUNDLE_MEDIA files and a
+// media quota worth of bytes. The rest of the media is left at its url.
+
+const (
+	BUNDLE_FORMAT   = "jgame-pack-bundle"
+	BUNDLE_VERSION  = 1
+	BUNDLE_MANIFEST = "manifest.json"
+	BUNDLE_PACK     = "pack.json"
+
+	MAX_BUNDLE_MEDIA = 200
+)
+
+var bundleExtRegexp = regexp.MustCompile(`^\.[A-Za-z0-9]{1,5}$`)
+
+type BundleMedia struct {
+	File string `json:"file"`
+	// The url the media had in the exported pack.
+	Url  string `json:"url"`
+	Size int64  `json:"size"`
+}
+
+type BundleManifest struct {
+	Format     string        `json:"format"`
+	Version    int           `json:"version"`
+	ExportedAt time.Time     `json:"exported_at"`
+	PackId     int           `json:"pack_id"`
+	Revision   int           `json:"revision"`
+	Media      []BundleMedia `json:"media"`
+	// The urls that couldn't be downloaded on export.
+	Missing    []string      `json:"missing,omitempty"`
+}
+
+// Calls f with every picture and clip url of the body and replaces the url
+// with what it returns.
+func mapPackMediaUrls(body *PackBody, f func(url string) string) {
+	replace := func(url *string) {
+		if *url != "" {
+			*url = f(*url)
+		}
+	}
+	for i := range body.Questions {
+		q := &body.Questions[i]
+		replace(&q.ImgUrl)
+		if q.Media != nil {
+			replace(&q.Media.Url)
+		}
+		for j := range q.Answers {
+			replace(&q.Answers[j].ImgUrl)
+		}
+	}
+}
+
+// Returns the content of the media at the url. The media uploaded to this
+// server is read from the storage, the rest is downloaded from its host
+// the way the publishing checks reach it.
+func downloadMedia(rawUrl string) ([]byte, error) {
+	var reader io.ReadCloser
+	if key, ok := strings.CutPrefix(rawUrl, media.Url("")); ok {
+		f, err := media.Default.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		reader = f
+	} else {
+		res, err := mediaCheckClient.Get(rawUrl)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 400 {
+			res.Body.Close()
+			return nil, fmt.Errorf("the host responded with %s", res.Status)
+		}
+		reader = res.Body
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, media.MAX_UPLOAD_SIZE + 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > media.MAX_UPLOAD_SIZE {
+		return nil, media.ErrTooLarge
+	}
+	return data, nil
+}
+
+// Returns the name of the nth media file in the bundle, keeping the
+// extension of the url if it looks like one.
+func bundleMediaFile(n int, rawUrl string) string {
+	name := fmt.Sprintf("media/%03d", n)
+	u, err := url.Parse(rawUrl)
+	if err == nil && bundleExtRegexp.MatchString(path.Ext(u.Path)) {
+		name += strings.ToLower(path.Ext(u.Path))
+	}
+	return name
+}
+
+// Returns the zip of the pack with its media. The zip is streamed as the
+// media is downloaded, so a failing download only leaves the media out.
+func ExportPackBundle(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getViewablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	var body PackBody
+	err := json.Unmarshal(pack.Body, &body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not decode pack body GET /api/packs/id/bundle: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not export the pack.")
+		return
+	}
+
+	var urls []string
+	seen := make(map[string]bool)
+	mapPackMediaUrls(&body, func(url string) string {
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+		return url
+	})
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pack-%d.zip"`, pack.Id))
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+	manifest := BundleManifest{
+		Format: BUNDLE_FORMAT,
+		Version: BUNDLE_VERSION,
+		ExportedAt: time.Now().UTC(),
+		PackId: pack.Id,
+		Revision: pack.Revision,
+		Media: []BundleMedia{},
+	}
+
+	writeFile := func(name string, data []byte) error {
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	// The headers are sent already, so the failures can only be logged and
+	// leave a broken zip behind.
+	var size int64
+	for _, url := range urls {
+		if len(manifest.Media) >= MAX_BUNDLE_MEDIA || size >= config.AppConfig.MediaQuota {
+			manifest.Missing = append(manifest.Missing, url)
+			continue
+		}
+		data, err := downloadMedia(url)
+		if err != nil || size + int64(len(data)) > config.AppConfig.MediaQuota {
+			manifest.Missing = append(manifest.Missing, url)
+			continue
+		}
+		size += int64(len(data))
+
+		file := bundleMediaFile(len(manifest.Media) + 1, url)
+		err = writeFile(file, data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write media of bundle GET /api/packs/id/bundle: %v\n", err)
+			return
+		}
+		manifest.Media = append(manifest.Media, BundleMedia{ File: file, Url: url, Size: int64(len(data)), })
+	}
+
+	packData, err := json.MarshalIndent(pack, "", "  ")
+	if err == nil {
+		err = writeFile(BUNDLE_PACK, packData)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write pack of bundle GET /api/packs/id/bundle: %v\n", err)
+		return
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = writeFile(BUNDLE_MANIFEST, manifestData)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write manifest of bundle GET /api/packs/id/bundle: %v\n", err)
+	}
+}
+
+// Removes the media stored by a failed import.
+func discardImportedMedia(conn *pgx.Conn, ids []int, keys []*string) {
+	if len(ids) > 0 {
+		_, err := database.Execute(conn, "DELETE FROM users.media WHERE media_id = ANY($1)", ids)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not delete imported media: %v\n", err)
+		}
+	}
+	deleteMediaFiles(keys...)
+}
+
+// Creates a draft pack from the bundle in the body of the request. Takes
+// the name of the pack from the `name` query parameter, the name of the
+// exported pack by default.
+func ImportPackBundle(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if len([]rune(name)) > 32 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"name can't be longer than 32 characters.")
+		return
+	}
+
+	// The bundle is kept in a temporary file rather than in memory while
+	// it's checked. The media of the bundle can't take more than the whole
+	// quota.
+	tmp, err := os.CreateTemp("", "bundle-*.zip")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create temporary file POST /api/packs/import/bundle: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not import the bundle.")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	limit := config.AppConfig.MediaQuota + MAX_IMPORT_SIZE
+	n, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusRequestEntityTooLarge, "Too large",
+			fmt.Sprintf("The bundle can be up to %d MB.", limit >> 20))
+		return
+	}
+
+	archive, err := zip.NewReader(tmp, n)
+	if err != nil {
+		sendImportProblems(w, []ImportProblem{ { Message: "The bundle is not a zip.", }, })
+		return
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		files[path.Clean(f.Name)] = f
+	}
+
+	var problems importProblems
+	readJson := func(name string, v any) bool {
+		f, ok := files[name]
+		if !ok {
+			problems.addIn(name, 0, "", "the file is missing")
+			return false
+		}
+		data, ok := readZipFile(f, MAX_IMPORT_SIZE, &problems)
+		if !ok {
+			return false
+		}
+		err := json.Unmarshal(data, v)
+		if err != nil {
+			problems.addIn(name, 0, "", "could not read the JSON: %v", err)
+			return false
+		}
+		return true
+	}
+
+	var manifest BundleManifest
+	var original Pack
+	if readJson(BUNDLE_MANIFEST, &manifest) {
+		if manifest.Format != BUNDLE_FORMAT {
+			problems.addIn(BUNDLE_MANIFEST, 0, "format", "the zip is not a pack bundle")
+		} else if manifest.Version < 1 || manifest.Version > BUNDLE_VERSION {
+			problems.addIn(BUNDLE_MANIFEST, 0, "version", "bundles of version %d can't be imported", manifest.Version)
+		} else if len(manifest.Media) > MAX_BUNDLE_MEDIA {
+			problems.addIn(BUNDLE_MANIFEST, 0, "media", "the bundle can have up to %d media files", MAX_BUNDLE_MEDIA)
+		}
+	}
+	if readJson(BUNDLE_PACK, &original) {
+		for _, e := range validation.Validate(validation.PACK_SCHEMA, original.Body) {
+			problems.addIn(BUNDLE_PACK, 0, "", "the pack does not satisfy the schema, /body%s: %s", e.Pointer, e.Message)
+		}
+	}
+	if len(problems) > 0 {
+		sendImportProblems(w, problems)
+		return
+	}
+
+	var body PackBody
+	err = json.Unmarshal(original.Body, &body)
+	if err != nil {
+		sendImportProblems(w, []ImportProblem{ { File: BUNDLE_PACK, Message: "The pack body can't be read.", }, })
+		return
+	}
+	if name == "" {
+		name = original.Name
+	}
+	if name == "" {
+		name = "Imported pack"
+	}
+
+	// The sizes the zip declares are checked before the media is read.
+	var declared uint64
+	for _, m := range manifest.Media {
+		if f, ok := files[path.Clean(m.File)]; ok {
+			declared += f.UncompressedSize64
+		}
+	}
+	if declared > uint64(config.AppConfig.MediaQuota) {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Quota exceeded",
+			fmt.Sprintf("The media of the bundle takes %d MB, you can store up to %d MB of media.",
+				(declared + (1 << 20) - 1) >> 20, config.AppConfig.MediaQuota >> 20))
+		return
+	}
+
+	// Every file is checked before anything is stored.
+	var assets []*media.Asset
+	var size int64
+	for _, m := range manifest.Media {
+		f, ok := files[path.Clean(m.File)]
+		if !ok {
+			problems.addIn(m.File, 0, "", "the file is missing")
+			continue
+		}
+		data, ok := readZipFile(f, media.MAX_UPLOAD_SIZE, &problems)
+		if !ok {
+			continue
+		}
+
+		asset, err := media.Process(data)
+		if err == media.ErrUnsupportedType {
+			problems.addIn(m.File, 0, "", "only JPEG, PNG and GIF images, MP3, WAV and OGG audio, and MP4 and WebM videos can be imported")
+			continue
+		} else if err == media.ErrTooLarge {
+			problems.addIn(m.File, 0, "", "the file is too large")
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not process media POST /api/packs/import/bundle: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not process the media.")
+			return
+		}
+		assets = append(assets, asset)
+		size += asset.Size()
+	}
+	if len(problems) > 0 {
+		sendImportProblems(w, problems)
+		return
+	}
+
+	// The pack is linted with the urls of the stored media, before
+	// anything is stored.
+	urls := make(map[string]string)
+	for i, asset := range assets {
+		urls[manifest.Media[i].Url] = media.Url(asset.Key)
+	}
+	mapPackMediaUrls(&body, func(url string) string {
+		if newUrl, ok := urls[url]; ok {
+			return newUrl
+		}
+		return url
+	})
+	body.Title = name
+	warnings := problems.lint(BUNDLE_PACK, nil, &body)
+	if len(problems) > 0 {
+		sendImportProblems(w, problems)
+		return
+	}
+
+	used, err := usedMediaSpace(conn, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get used media space POST /api/packs/import/bundle: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not check the media quota.")
+		return
+	}
+	if used + size > config.AppConfig.MediaQuota {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Quota exceeded",
+			fmt.Sprintf("The media of the bundle takes %d MB, you can store up to %d MB of media. Delete some files first.",
+				(size + (1 << 20) - 1) >> 20, config.AppConfig.MediaQuota >> 20))
+		return
+	}
+
+	var ids []int
+	var keys []*string
+	for _, asset := range assets {
+		var thumbnailKey *string
+		keys = append(keys, &asset.Key)
+		err = media.Default.Put(asset.Key, asset.ContentType, asset.Data)
+		if err == nil && asset.Thumbnail != nil {
+			thumbnailKey = &asset.Thumbnail.Key
+			keys = append(keys, thumbnailKey)
+			err = media.Default.Put(asset.Thumbnail.Key, asset.Thumbnail.ContentType, asset.Thumbnail.Data)
+		}
+
+		var id int
+		if err == nil {
+			err = database.QueryRow(conn, "INSERT INTO users.media (user_id, storage_key, thumbnail_key, content_type, size) VALUES ($1, $2, $3, $4, $5) RETURNING media_id",
+				session.UserId, asset.Key, thumbnailKey, asset.ContentType, asset.Size()).Scan(&id)
+		}
+		if err != nil {
+			discardImportedMedia(conn, ids, keys)
+			fmt.Fprintf(os.Stderr, "Could not store media POST /api/packs/import/bundle: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not store the media.")
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		discardImportedMedia(conn, ids, keys)
+		fmt.Fprintf(os.Stderr, "Could not encode imported pack POST /api/packs/import/bundle: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not import the pack.")
+		return
+	}
+
+	pack := Pack{
+		UserId: session.UserId,
+		Name: name,
+		Body: raw,
+		Visibility: forkVisibility(original.Visibility),
+		Note: fmt.Sprintf("Imported from the bundle of pack %d at revision %d", manifest.PackId, manifest.Revision),
+	}
+	err = insertPack(conn, &pack)
+	if err != nil {
+		discardImportedMedia(conn, ids, keys)
+		fmt.Fprintf(os.Stderr, "Could not insert imported pack POST /api/packs/import/bundle: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not create pack.")
+		return
+	}
+
+	pack.Note = ""
+	pack.Warnings = warnings
+	setRevisionETag(w, pack.Revision)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(pack)
+}
@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Challenges let the users play the same pack at different times. The
+// creator of a challenge invites other users, and each of them plays the
+// pack solo over the websocket with the timer and the scoring of the
+// challenge settings. The results end up on the scoreboard of the
+// challenge, and nobody can start playing once the deadline has passed.
+//
+// The challenges are stored inside the following PostgreSQL tables:
+// rooms.challenge(
+//   challenge_id serial,
+//   user_id      int (from users.user),
+//   pack_id      int (from packs.pack),
+//   settings     jsonb,
+//   deadline     timestamptz,
+//   created_at   timestamptz,
+//   revision_id  int (from packs.revision)
+// )
+// rooms.challenge_invite(
+//   challenge_id int (from rooms.challenge),
+//   user_id      int (from users.user)
+// )
+// rooms.challenge_result(
+//   challenge_id int (from rooms.challenge),
+//   user_id      int (from users.user),
+//   score        int,
+//   correct      int,
+//   started_at   timestamptz,
+//   finished_at  timestamptz
+// )
+//
+// The settings share the schema with the room settings, although only the
+// ones that make sense for a single player are used.
+
+const (
+	MAX_CHALLENGES_RESPONSE = 2 << 5
+	MAX_CHALLENGE_INVITEES = 2 << 6
+	MAX_CHALLENGE_DURATION = 30 * 24 * time.Hour
+)
+
+type Challenge struct {
+	Id        int          `json:"challenge_id"`
+	UserId    int          `json:"user_id"`
+	PackId    int          `json:"pack_id"`
+	Settings  RoomSettings `json:"settings"`
+	Deadline  time.Time    `json:"deadline"`
+	CreatedAt time.Time    `json:"created_at"`
+	// Everyone plays the revision of the pack that was the latest when the
+	// challenge was created.
+	RevisionId *int        `json:"revision_id"`
+}
+
+type ChallengeRequest struct {
+	PackId   int             `json:"pack_id"`
+	Settings json.RawMessage `json:"settings"`
+	Deadline *time.Time      `json:"deadline"`
+	Invitees []int           `json:"invitees"`
+}
+
+type ChallengeResult struct {
+	UserId     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Score      int        `json:"score"`
+	Correct    int        `json:"correct"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+type ChallengeResponse struct {
+	Challenge
+	Invitees   []int             `json:"invitees"`
+	Scoreboard []ChallengeResult `json:"scoreboard"`
+}
+
+func ScanChallenge(row pgx.Row, challenge *Challenge) error {
+	return row.Scan(&challenge.Id, &challenge.UserId, &challenge.PackId, &challenge.Settings,
+		&challenge.Deadline, &challenge.CreatedAt, &challenge.RevisionId)
+}
+
+// Returns whether the user was invited to the challenge. The creator is
+// always invited.
+func IsInvited(conn *pgx.Conn, challengeId int, userId int) (bool, error) {
+	var invited bool
+	err := database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM rooms.challenge_invite WHERE challenge_id = $1 AND user_id = $2)",
+		challengeId, userId).Scan(&invited)
+	return invited, err
+}
+
+func CreateChallenge(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var request ChallengeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	now := time.Now()
+	if request.Deadline == nil || request.Deadline.Before(now) || request.Deadline.After(now.Add(MAX_CHALLENGE_DURATION)) {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"deadline must be in the future, but not more than 30 days ahead.")
+		return
+	}
+
+	if len(request.Invitees) > MAX_CHALLENGE_INVITEES {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Too many invitees.")
+		return
+	}
+
+	var packExists bool
+	packExists, err = CanPlayPack(conn, request.PackId, session.UserId, false)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not retrieve pack associated with the challenge.")
+		return
+	}
+
+	if !packExists {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"No published pack with the given id exists.")
+		return
+	}
+
+	settings := DefaultRoomSettings()
+	if msg := applyRoomSettings(&settings, request.Settings, 0); msg != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
+		return
+	}
+
+	challenge := Challenge{
+		UserId: session.UserId,
+		PackId: request.PackId,
+		Settings: settings,
+		Deadline: request.Deadline.UTC(),
+	}
+	err = database.QueryRow(conn, "INSERT INTO rooms.challenge (user_id, pack_id, settings, deadline, revision_id) VALUES ($1, $2, $3, $4, " + latestRevisionSql("$2") + ") RETURNING challenge_id, created_at, revision_id",
+		challenge.UserId, challenge.PackId, challenge.Settings, challenge.Deadline).Scan(&challenge.Id, &challenge.CreatedAt, &challenge.RevisionId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create challenge POST /api/challenges: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not create challenge.")
+		return
+	}
+
+	// Unknown users are silently skipped.
+	invitees := append(request.Invitees, session.UserId)
+	_, err = database.Execute(conn, "INSERT INTO rooms.challenge_invite (challenge_id, user_id) SELECT $1, user_id FROM users.\"user\" WHERE user_id = ANY($2)",
+		challenge.Id, invitees)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not invite users POST /api/challenges: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not invite users to the challenge.")
+		return
+	}
+
+	sendChallengeResponse(w, conn, challenge, http.StatusCreated)
+}
+
+func sendChallengeResponse(w http.ResponseWriter, conn *pgx.Conn, challenge Challenge, status int) {
+	response := ChallengeResponse{
+		Challenge: challenge,
+		Invitees: []int{},
+		Scoreboard: []ChallengeResult{},
+	}
+
+	rows := database.QueryRows(conn, "SELECT user_id FROM rooms.challenge_invite WHERE challenge_id = $1 ORDER BY user_id", challenge.Id)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			break
+		}
+		response.Invitees = append(response.Invitees, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read invitees /api/challenges/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read invitees.")
+		return
+	}
+
+	rows = database.QueryRows(conn, "SELECT r.user_id, u.name, r.score, r.correct, r.started_at, r.finished_at FROM rooms.challenge_result r JOIN users.\"user\" u ON r.user_id = u.user_id WHERE r.challenge_id = $1 ORDER BY r.score DESC, r.finished_at NULLS LAST",
+		challenge.Id)
+	for rows.Next() {
+		var result ChallengeResult
+		err := rows.Scan(&result.UserId, &result.Name, &result.Score, &result.Correct, &result.StartedAt, &result.FinishedAt)
+		if err != nil {
+			break
+		}
+		response.Scoreboard = append(response.Scoreboard, result)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read scoreboard /api/challenges/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read the scoreboard.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Returns the challenge with its scoreboard. Only the invitees can see it.
+func GetChallenge(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var challenge Challenge
+	err := ScanChallenge(database.QueryRow(conn, "SELECT * FROM rooms.challenge WHERE challenge_id = $1", id), &challenge)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No challenge with given id exists.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not get challenge GET /api/challenges/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the challenge with the given id.")
+		return
+	}
+
+	invited, err := IsInvited(conn, challenge.Id, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check invite GET /api/challenges/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the challenge with the given id.")
+		return
+	}
+
+	if !invited {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"No challenge with given id exists.")
+		return
+	}
+
+	sendChallengeResponse(w, conn, challenge, http.StatusOK)
+}
+
+// Lists the challenges the user was invited to, the latest first. Returns
+// max MAX_CHALLENGES_RESPONSE challenges.
+func GetChallenges(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	rows := database.QueryRows(conn, "SELECT c.* FROM rooms.challenge c JOIN rooms.challenge_invite i ON c.challenge_id = i.challenge_id WHERE i.user_id = $1 ORDER BY c.created_at DESC LIMIT $2",
+		session.UserId, MAX_CHALLENGES_RESPONSE)
+	defer rows.Close()
+
+	challenges := []Challenge{}
+	for rows.Next() {
+		var challenge Challenge
+		err := ScanChallenge(rows, &challenge)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read challenges at GET /api/challenges: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read challenges")
+			return
+		}
+		challenges = append(challenges, challenge)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate challenges at GET /api/challenges: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate challenges")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(challenges)
+}
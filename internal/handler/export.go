@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/jackc/pgx/v5"
+)
+
+// Returns the pack in the quiz format of the `format` query parameter as a
+// file to download.
+func ExportPack(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case IMPORT_GIFT, IMPORT_MOODLE, IMPORT_QTI:
+	case "":
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"format is required.")
+		return
+	default:
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"format must be one of gift, moodle or qti.")
+		return
+	}
+
+	var pack Pack
+	if !getViewablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	var body PackBody
+	err := json.Unmarshal(pack.Body, &body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not decode pack body GET /api/packs/id/export: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not export the pack.")
+		return
+	}
+
+	var data []byte
+	var contentType, extension string
+	switch format {
+	case IMPORT_GIFT:
+		data = writeGift(&body)
+		contentType, extension = "text/plain; charset=utf-8", "gift"
+	case IMPORT_MOODLE:
+		data, err = writeMoodle(&body)
+		contentType, extension = "application/xml; charset=utf-8", "xml"
+	case IMPORT_QTI:
+		data, err = writeQti(&body)
+		contentType, extension = "application/zip", "zip"
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write pack GET /api/packs/id/export: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not export the pack.")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pack-%d.%s"`, pack.Id, extension))
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(data)
+}
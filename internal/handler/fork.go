@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/jackc/pgx/v5"
+)
+
+// Anyone who can see a pack can fork it: the latest revision of the pack
+// is copied into a new draft owned by them, which remembers the pack it
+// was forked from in packs.pack.forked_from. The fork is never more
+// visible than the original, so the forks of the packs that are not for
+// everyone start private.
+
+// Returns the visibility the fork of a pack with the visibility starts with.
+func forkVisibility(visibility string) string {
+	switch visibility {
+	case VISIBILITY_PUBLIC, VISIBILITY_UNLISTED:
+		return visibility
+	}
+	return VISIBILITY_PRIVATE
+}
+
+func ForkPack(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var original Pack
+	if !getViewablePack(w, r, conn, session, &original) {
+		return
+	}
+
+	var fork Pack
+	err := scanPack(database.QueryRow(conn, "WITH p AS (INSERT INTO packs.pack (user_id, name, body, visibility, forked_from) VALUES ($1, $2, $3, $4, $5) RETURNING " + PACK_COLUMNS + "), r AS (INSERT INTO packs.revision (pack_id, number, user_id, name, body, note) SELECT pack_id, 1, user_id, name, body, $6::varchar FROM p) SELECT * FROM p",
+		session.UserId, original.Name, original.Body, forkVisibility(original.Visibility), original.Id,
+		fmt.Sprintf("Forked from pack %d at revision %d", original.Id, original.Revision)), &fork)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not fork pack POST /api/packs/id/fork: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not fork the pack.")
+		return
+	}
+
+	setRevisionETag(w, fork.Revision)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(fork)
+}
+
+// Returns the forks of the pack the user can see, max MAX_PACKS_RESPONSE.
+func GetPackForks(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
+
+	var original Pack
+	if !getViewablePack(w, r, conn, session, &original) {
+		return
+	}
+
+	userId := 0
+	if session != nil {
+		userId = session.UserId
+	}
+
+	rows := database.QueryRows(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack p WHERE p.forked_from = $1 AND " + viewablePackSql("p", "$2") + " ORDER BY p.pack_id LIMIT $3",
+		original.Id, userId, MAX_PACKS_RESPONSE)
+	defer rows.Close()
+
+	forks := []Pack{}
+	for rows.Next() {
+		var fork Pack
+		err := scanPack(rows, &fork)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read forks GET /api/packs/id/forks: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read forks.")
+			return
+		}
+		forks = append(forks, fork)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate forks GET /api/packs/id/forks: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate forks.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(forks)
+}
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The helpers shared by the quiz formats the packs are imported from and
+// exported to. The formats of the learning management systems keep the
+// questions as HTML, the packs as plain text with the pictures and the
+// clips next to it. The part of a clip to play is kept in the url as a
+// media fragment, e.g. `clip.mp3#t=10,20`.
+
+// The value of the imported questions when the format doesn't have one.
+const IMPORT_DEFAULT_VALUE = 100
+
+var (
+	htmlTagRegexp   = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlBreakRegexp = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>`)
+	spacesRegexp    = regexp.MustCompile(`[ \t\r\f\v]+`)
+	newlinesRegexp  = regexp.MustCompile(`\s*\n\s*`)
+	htmlMediaRegexp = regexp.MustCompile(`(?is)<(img|audio|video|source|object)\b[^>]*?\b(src|data)\s*=\s*("[^"]*"|'[^']*')[^>]*>`)
+	htmlTypeRegexp  = regexp.MustCompile(`(?is)\btype\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// Returns the text of the HTML without the tags. The paragraphs and the
+// line breaks are kept as new lines.
+func htmlToText(s string) string {
+	s = htmlBreakRegexp.ReplaceAllString(s, "\n")
+	s = htmlTagRegexp.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = spacesRegexp.ReplaceAllString(s, " ")
+	s = newlinesRegexp.ReplaceAllString(s, "\n")
+	return strings.TrimSpace(s)
+}
+
+// Returns the HTML showing the text as it is.
+func textToHtml(s string) string {
+	return strings.ReplaceAll(html.EscapeString(s), "\n", "<br/>")
+}
+
+// Takes the first picture and the first clip out of the HTML. Returns the
+// rest of the HTML, the url of the picture and the clip.
+func extractHtmlMedia(s string) (string, string, *PackMedia) {
+	var img string
+	var media *PackMedia
+	s = htmlMediaRegexp.ReplaceAllStringFunc(s, func(tag string) string {
+		m := htmlMediaRegexp.FindStringSubmatch(tag)
+		kind := strings.ToLower(m[1])
+		url := html.UnescapeString(m[3][1:len(m[3]) - 1])
+
+		if kind == "object" || kind == "source" {
+			if t := htmlTypeRegexp.FindStringSubmatch(tag); t != nil {
+				kind = strings.ToLower(t[1][1:len(t[1]) - 1])
+			}
+			kind, _, _ = strings.Cut(kind, "/")
+		}
+
+		switch {
+		case kind == "img" || kind == "image":
+			if img == "" {
+				img = url
+				return ""
+			}
+		case kind == MEDIA_AUDIO || kind == MEDIA_VIDEO:
+			if media == nil {
+				media = parseMediaUrl(kind, url)
+				return ""
+			}
+		}
+		return tag
+	})
+	return s, img, media
+}
+
+// Returns the clip at the url, reading the part to play from the media
+// fragment.
+func parseMediaUrl(kind string, url string) *PackMedia {
+	media := &PackMedia{ Type: kind, Url: url, }
+	base, fragment, ok := strings.Cut(url, "#t=")
+	if !ok {
+		return media
+	}
+
+	start, end, _ := strings.Cut(fragment, ",")
+	s, err1 := strconv.ParseFloat(start, 64)
+	e, err2 := strconv.ParseFloat(end, 64)
+	if err1 != nil || (end != "" && err2 != nil) {
+		return media
+	}
+	media.Url = base
+	media.Start = s
+	media.End = e
+	return media
+}
+
+// Returns the url of the clip with the part to play as a media fragment.
+func mediaUrl(media *PackMedia) string {
+	if media.Start == 0 && media.End == 0 {
+		return media.Url
+	}
+	fragment := strconv.FormatFloat(media.Start, 'f', -1, 64)
+	if media.End != 0 {
+		fragment += "," + strconv.FormatFloat(media.End, 'f', -1, 64)
+	}
+	return media.Url + "#t=" + fragment
+}
+
+// Returns the HTML of the question with its picture and clip. The clips
+// are embedded as objects, since QTI 2.1 has no audio and video elements,
+// unless html5 is set.
+func questionHtml(q *PackQuestion, html5 bool) string {
+	var b strings.Builder
+	b.WriteString("<p>" + textToHtml(q.Title) + "</p>")
+	if q.ImgUrl != "" {
+		fmt.Fprintf(&b, `<p><img src="%s" alt=""/></p>`, html.EscapeString(q.ImgUrl))
+	}
+
+	if q.Media != nil {
+		url := html.EscapeString(mediaUrl(q.Media))
+		switch {
+		case q.Media.Type == MEDIA_IMAGE:
+			fmt.Fprintf(&b, `<p><img src="%s" alt=""/></p>`, url)
+		case html5:
+			fmt.Fprintf(&b, `<p><%[1]s controls="controls" src="%[2]s"></%[1]s></p>`, q.Media.Type, url)
+		default:
+			fmt.Fprintf(&b, `<p><object data="%s" type="%s/*"></object></p>`, url, q.Media.Type)
+		}
+	}
+	return b.String()
+}
+
+// Returns the HTML of the answer with its picture.
+func answerHtml(a *PackAnswer) string {
+	s := textToHtml(a.Text)
+	if a.ImgUrl != "" {
+		s += fmt.Sprintf(` <img src="%s" alt=""/>`, html.EscapeString(a.ImgUrl))
+	}
+	return s
+}
+
+// Reads the question from its HTML, the picture of the question and its
+// clip included.
+func questionFromHtml(q *PackQuestion, s string) {
+	s, img, media := extractHtmlMedia(s)
+	q.Title = htmlToText(s)
+	q.ImgUrl = img
+	if media != nil {
+		q.Media = media
+	} else if img != "" && q.Title == "" {
+		q.Title = img
+	}
+}
+
+// Reads the answer from its HTML.
+func answerFromHtml(s string, correct bool) PackAnswer {
+	s, img, _ := extractHtmlMedia(s)
+	return PackAnswer{ Text: htmlToText(s), Correct: correct, ImgUrl: img, }
+}
+
+// Returns the explanation of the question with its source, for the formats
+// having only feedback.
+func questionFeedback(q *PackQuestion) string {
+	feedback := textToHtml(q.Explanation)
+	if q.Source != "" {
+		if feedback != "" {
+			feedback += "<br/>"
+		}
+		feedback += fmt.Sprintf(`Source: <a href="%[1]s">%[1]s</a>`, html.EscapeString(q.Source))
+	}
+	return feedback
+}
+
+// Reads the explanation and the source of the question from the feedback
+// written by questionFeedback.
+func explanationFromFeedback(s string) (string, string) {
+	text := htmlToText(s)
+	i := strings.LastIndex(text, "Source: ")
+	if i < 0 || (i > 0 && text[i - 1] != '\n') {
+		return text, ""
+	}
+	source := strings.TrimSpace(text[i + len("Source: "):])
+	if strings.ContainsAny(source, " \n") || !isHttpUrl(source) {
+		return text, ""
+	}
+	return strings.TrimSpace(text[:i]), source
+}
+
+// Checks the question read from another format can be played: it has the
+// answers, one of them correct, and its urls are http ones.
+func checkImportedQuestion(problems *importProblems, file string, line int, q *PackQuestion) {
+	add := func(format string, args ...any) {
+		problems.addIn(file, line, "", format, args...)
+	}
+
+	if q.Title == "" {
+		add("the question is empty")
+	}
+	if len(q.Answers) < 2 {
+		add("at least 2 answers are required")
+	}
+
+	hasCorrect := false
+	for i, a := range q.Answers {
+		hasCorrect = hasCorrect || a.Correct
+		if a.Text == "" && a.ImgUrl == "" {
+			add("answer %d is empty", i + 1)
+		}
+		if a.ImgUrl != "" && !isHttpUrl(a.ImgUrl) {
+			add("the picture of answer %d must have an http or https url", i + 1)
+		}
+	}
+	if !hasCorrect {
+		add("no answer is marked as correct")
+	}
+
+	if q.ImgUrl != "" && !isHttpUrl(q.ImgUrl) {
+		add("the picture must have an http or https url, the embedded files can't be imported")
+	}
+	if q.Media != nil && !isHttpUrl(q.Media.Url) {
+		add("the clip must have an http or https url, the embedded files can't be imported")
+	}
+	if q.Source != "" && !isHttpUrl(q.Source) {
+		add("the source must be an http or https url")
+	}
+	if len([]rune(q.Explanation)) > 4000 {
+		add("the explanation can't be longer than 4000 characters")
+	}
+}
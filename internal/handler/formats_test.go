@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A pack with everything the quiz formats can carry: several correct
+// answers, pictures of the questions and the answers, a part of a clip,
+// the explanations, the sources and the characters special to the formats.
+func formatsPack() PackBody {
+	return PackBody{
+		Title: "Formats",
+		Questions: []PackQuestion{
+			{
+				Title: "What is the capital of France?",
+				Value: 100,
+				Answers: []PackAnswer{
+					{ Text: "Paris", Correct: true, },
+					{ Text: "London", },
+					{ Text: "Berlin", },
+				},
+				Explanation: "Paris has been the capital since 987.",
+				Source: "https://en.wikipedia.org/wiki/Paris",
+			},
+			{
+				Title: "Which of these are {prime}: numbers = ~ # \\ <b>?",
+				Value: 250,
+				Answers: []PackAnswer{
+					{ Text: "2", Correct: true, },
+					{ Text: "3", Correct: true, },
+					{ Text: "4 & 6", },
+				},
+			},
+			{
+				Title: "Whose voice is this?",
+				Value: 300,
+				ImgUrl: "https://example.com/stage.png",
+				Media: &PackMedia{ Type: MEDIA_AUDIO, Url: "https://example.com/voice.mp3", Start: 10, End: 12.5, },
+				Answers: []PackAnswer{
+					{ Text: "Freddie", ImgUrl: "https://example.com/freddie.jpg", Correct: true, },
+					{ Text: "Elton", ImgUrl: "https://example.com/elton.jpg", },
+				},
+			},
+		},
+	}
+}
+
+// Checks the questions read back from a format are the ones written to it.
+func checkRoundTrip(t *testing.T, got []PackQuestion, want []PackQuestion) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d questions, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("question %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHtmlToText(t *testing.T) {
+	tests := []struct {
+		html string
+		text string
+	}{
+		{ "plain", "plain", },
+		{ "<p>One</p><p>Two</p>", "One\nTwo", },
+		{ "a<br>b<BR/>c", "a\nb\nc", },
+		{ "<b>bold</b>  and\t<i>italic</i>", "bold and italic", },
+		{ "&lt;tag&gt; &amp; &quot;", "<tag> & \"", },
+		{ textToHtml("a < b\nc & d"), "a < b\nc & d", },
+	}
+
+	for _, tt := range tests {
+		if text := htmlToText(tt.html); text != tt.text {
+			t.Errorf("htmlToText(%q) = %q, want %q", tt.html, text, tt.text)
+		}
+	}
+}
+
+func TestExtractHtmlMedia(t *testing.T) {
+	tests := []struct {
+		html  string
+		rest  string
+		img   string
+		media *PackMedia
+	}{
+		{ `<p>Text</p>`, `<p>Text</p>`, "", nil, },
+		{ `A<img src="a.png"/>B<img src='b.png'>`, `AB<img src='b.png'>`, "a.png", nil, },
+		{ `<audio controls src="a.mp3#t=1,2"></audio>`, `</audio>`, "", &PackMedia{ Type: MEDIA_AUDIO, Url: "a.mp3", Start: 1, End: 2, }, },
+		{ `<object data="v.mp4#t=5" type="video/*"></object>`, `</object>`, "", &PackMedia{ Type: MEDIA_VIDEO, Url: "v.mp4", Start: 5, }, },
+		{ `<img src="a.png?x=1&amp;y=2">`, ``, "a.png?x=1&y=2", nil, },
+	}
+
+	for _, tt := range tests {
+		rest, img, media := extractHtmlMedia(tt.html)
+		if rest != tt.rest || img != tt.img || !reflect.DeepEqual(media, tt.media) {
+			t.Errorf("extractHtmlMedia(%q) = %q, %q, %+v, want %q, %q, %+v", tt.html, rest, img, media, tt.rest, tt.img, tt.media)
+		}
+	}
+}
+
+func TestMediaUrl(t *testing.T) {
+	tests := []struct {
+		media PackMedia
+		url   string
+	}{
+		{ PackMedia{ Url: "a.mp3", }, "a.mp3", },
+		{ PackMedia{ Url: "a.mp3", Start: 10, }, "a.mp3#t=10", },
+		{ PackMedia{ Url: "a.mp3", Start: 1.5, End: 20, }, "a.mp3#t=1.5,20", },
+		{ PackMedia{ Url: "a.mp3", End: 3, }, "a.mp3#t=0,3", },
+	}
+
+	for _, tt := range tests {
+		tt.media.Type = MEDIA_AUDIO
+		url := mediaUrl(&tt.media)
+		if url != tt.url {
+			t.Errorf("mediaUrl(%+v) = %q, want %q", tt.media, url, tt.url)
+		}
+		if media := parseMediaUrl(MEDIA_AUDIO, url); !reflect.DeepEqual(*media, tt.media) {
+			t.Errorf("parseMediaUrl(%q) = %+v, want %+v", url, *media, tt.media)
+		}
+	}
+
+	media := parseMediaUrl(MEDIA_VIDEO, "v.mp4#t=abc")
+	if media.Url != "v.mp4#t=abc" || media.Start != 0 {
+		t.Errorf("parseMediaUrl kept a broken fragment as %+v", media)
+	}
+}
+
+func TestExplanationFromFeedback(t *testing.T) {
+	questions := []PackQuestion{
+		{ Explanation: "Because.", },
+		{ Source: "https://example.com/a?b=1&c=2", },
+		{ Explanation: "Line one.\nLine two.", Source: "https://example.com", },
+	}
+
+	for _, q := range questions {
+		explanation, source := explanationFromFeedback(questionFeedback(&q))
+		if explanation != q.Explanation || source != q.Source {
+			t.Errorf("explanationFromFeedback(questionFeedback(%+v)) = %q, %q", q, explanation, source)
+		}
+	}
+
+	explanation, source := explanationFromFeedback("See the Source: https://example.com")
+	if explanation != "See the Source: https://example.com" || source != "" {
+		t.Errorf("the source in the middle of a line was read as %q, %q", explanation, source)
+	}
+}
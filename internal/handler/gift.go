@@ -0,0 +1,341 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GIFT is the text format of the Moodle question banks:
+//   // value: 200
+//   ::Capital:: What is the capital of France? {
+//     =Paris
+//     ~London#Feedback of the answer
+//     ####The explanation.
+//   }
+// The multiple choice and the true/false questions can be imported. The
+// points of the question and its source are kept in the `// value:` and
+// `// source:` comments before the question, which GIFT ignores. The
+// questions with pictures and clips are exported in the HTML format.
+
+var (
+	giftValueRegexp  = regexp.MustCompile(`^//\s*value:\s*(\d+)\s*$`)
+	giftSourceRegexp = regexp.MustCompile(`^//\s*source:\s*(\S+)\s*$`)
+	giftWeightRegexp = regexp.MustCompile(`^%(-?[0-9.]+)%`)
+)
+
+// The characters escaped with a backslash in GIFT.
+const GIFT_SPECIAL = "~=#{}:\\"
+
+type giftBlock struct {
+	Line   int
+	Text   string
+	Value  int
+	Source string
+}
+
+// Returns the index of the first unescaped occurrence of sub in s or -1.
+func indexUnescaped(s string, sub string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(s[i:], sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeGift(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i + 1 < len(s) {
+			i++
+			if s[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func escapeGift(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c == '\n' {
+			b.WriteString("\\n")
+			continue
+		}
+		if strings.ContainsRune(GIFT_SPECIAL, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Splits the file into the questions, which are separated by empty lines
+// outside of the answers.
+func splitGift(data []byte) []giftBlock {
+	var blocks []giftBlock
+	var cur giftBlock
+	var lines []string
+	depth := 0
+	flush := func() {
+		if len(lines) > 0 {
+			cur.Text = strings.Join(lines, "\n")
+			blocks = append(blocks, cur)
+		}
+		cur = giftBlock{}
+		lines = nil
+	}
+
+	for i, line := range strings.Split(strings.TrimPrefix(string(data), "\ufeff"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if depth == 0 {
+			if trimmed == "" {
+				flush()
+				continue
+			}
+			if m := giftValueRegexp.FindStringSubmatch(trimmed); m != nil {
+				cur.Value, _ = strconv.Atoi(m[1])
+				continue
+			}
+			if m := giftSourceRegexp.FindStringSubmatch(trimmed); m != nil {
+				cur.Source = m[1]
+				continue
+			}
+			if strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, "$CATEGORY:") {
+				continue
+			}
+		}
+
+		if len(lines) == 0 {
+			cur.Line = i + 1
+		}
+		lines = append(lines, line)
+		for j := 0; j < len(line); j++ {
+			switch line[j] {
+			case '\\':
+				j++
+			case '{':
+				depth++
+			case '}':
+				depth = max(depth - 1, 0)
+			}
+		}
+	}
+	flush()
+	return blocks
+}
+
+// Splits the answers by their unescaped `=` and `~` markers.
+func splitGiftAnswers(s string) ([]byte, []string) {
+	var markers []byte
+	var answers []string
+	start := -1
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == '=' || s[i] == '~' {
+			if start >= 0 {
+				answers = append(answers, s[start:i])
+			}
+			markers = append(markers, s[i])
+			start = i + 1
+		}
+	}
+	if start >= 0 {
+		answers = append(answers, s[start:])
+	}
+	return markers, answers
+}
+
+// Reads the question of the block. Returns the reason the question can't
+// be imported if it's not a multiple choice or a true/false one.
+func parseGiftQuestion(block giftBlock, problems *importProblems) (PackQuestion, string) {
+	q := PackQuestion{ Value: IMPORT_DEFAULT_VALUE, Source: block.Source, }
+	if block.Value != 0 {
+		q.Value = block.Value
+	}
+	text := strings.TrimSpace(block.Text)
+
+	if strings.HasPrefix(text, "::") {
+		end := indexUnescaped(text[2:], "::")
+		if end < 0 {
+			problems.add(block.Line, "", "the name of the question is not closed with ::")
+			return q, ""
+		}
+		text = strings.TrimSpace(text[end + 4:])
+	}
+
+	format := "moodle"
+	if strings.HasPrefix(text, "[") {
+		if end := strings.IndexByte(text, ']'); end > 0 {
+			format = strings.ToLower(text[1:end])
+			text = strings.TrimSpace(text[end + 1:])
+		}
+	}
+
+	open := indexUnescaped(text, "{")
+	if open < 0 {
+		return q, "descriptions without answers can't be expressed in a pack"
+	}
+	close := indexUnescaped(text[open:], "}")
+	if close < 0 {
+		problems.add(block.Line, "", "the answers are not closed with }")
+		return q, ""
+	}
+	close += open
+	answers := text[open + 1:close]
+	title := strings.TrimSpace(text[:open])
+	if rest := strings.TrimSpace(text[close + 1:]); rest != "" {
+		title += " _____ " + rest
+	}
+
+	if format == "html" {
+		questionFromHtml(&q, unescapeGift(title))
+	} else {
+		q.Title = unescapeGift(title)
+	}
+
+	if i := indexUnescaped(answers, "####"); i >= 0 {
+		q.Explanation = htmlToText(unescapeGift(answers[i + 4:]))
+		answers = answers[:i]
+	}
+	answers = strings.TrimSpace(answers)
+
+	if answers == "" {
+		return q, "essay questions can't be expressed in a pack"
+	}
+	if strings.HasPrefix(answers, "#") {
+		return q, "numerical questions can't be expressed in a pack"
+	}
+
+	verdict := answers
+	if i := indexUnescaped(verdict, "#"); i >= 0 {
+		verdict = verdict[:i]
+	}
+	switch strings.ToUpper(strings.TrimSpace(verdict)) {
+	case "T", "TRUE":
+		q.Answers = []PackAnswer{ { Text: "True", Correct: true, }, { Text: "False", }, }
+		return q, ""
+	case "F", "FALSE":
+		q.Answers = []PackAnswer{ { Text: "True", }, { Text: "False", Correct: true, }, }
+		return q, ""
+	}
+
+	markers, texts := splitGiftAnswers(answers)
+	if len(markers) == 0 {
+		problems.add(block.Line, "", "the answers must start with = or ~")
+		return q, ""
+	}
+
+	wrong := 0
+	for i, a := range texts {
+		if indexUnescaped(a, "->") >= 0 {
+			return q, "matching questions can't be expressed in a pack"
+		}
+		if j := indexUnescaped(a, "#"); j >= 0 {
+			a = a[:j]
+		}
+		a = strings.TrimSpace(a)
+
+		correct := markers[i] == '='
+		if m := giftWeightRegexp.FindStringSubmatch(a); m != nil {
+			weight, _ := strconv.ParseFloat(m[1], 64)
+			correct = weight > 0
+			a = a[len(m[0]):]
+		}
+		if !correct {
+			wrong++
+		}
+
+		if format == "html" {
+			q.Answers = append(q.Answers, answerFromHtml(unescapeGift(a), correct))
+		} else {
+			q.Answers = append(q.Answers, PackAnswer{ Text: unescapeGift(a), Correct: correct, })
+		}
+	}
+	if wrong == 0 {
+		return q, "short answer questions can't be expressed in a pack"
+	}
+	return q, ""
+}
+
+func parseGift(data []byte) (PackBody, []importSource, importProblems, importProblems) {
+	var problems, unsupported importProblems
+	var sources []importSource
+	body := PackBody{ Questions: []PackQuestion{}, }
+
+	for _, block := range splitGift(data) {
+		before := len(problems)
+		q, reason := parseGiftQuestion(block, &problems)
+		if reason != "" {
+			unsupported.add(block.Line, "", "%s", reason)
+			continue
+		}
+		if len(problems) > before {
+			continue
+		}
+		checkImportedQuestion(&problems, "", block.Line, &q)
+		body.Questions = append(body.Questions, q)
+		sources = append(sources, importSource{ Line: block.Line, })
+	}
+
+	if len(body.Questions) == 0 && len(problems) == 0 && len(unsupported) == 0 {
+		problems.add(1, "", "the file has no questions")
+	}
+	return body, sources, problems, unsupported
+}
+
+func writeGift(body *PackBody) []byte {
+	var b strings.Builder
+	for i, q := range body.Questions {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "// value: %d\n", q.Value)
+		if q.Source != "" {
+			fmt.Fprintf(&b, "// source: %s\n", q.Source)
+		}
+
+		html := q.ImgUrl != "" || q.Media != nil
+		for _, a := range q.Answers {
+			html = html || a.ImgUrl != ""
+		}
+
+		fmt.Fprintf(&b, "::Question %d:: ", i + 1)
+		if html {
+			b.WriteString("[html]" + escapeGift(questionHtml(&q, true)))
+		} else {
+			b.WriteString(escapeGift(q.Title))
+		}
+		b.WriteString(" {\n")
+
+		for _, a := range q.Answers {
+			marker := "~"
+			if a.Correct {
+				marker = "="
+			}
+			text := a.Text
+			if html {
+				text = answerHtml(&a)
+			}
+			fmt.Fprintf(&b, "\t%s%s\n", marker, escapeGift(text))
+		}
+		if q.Explanation != "" {
+			fmt.Fprintf(&b, "\t####%s\n", escapeGift(q.Explanation))
+		}
+		b.WriteString("}\n")
+	}
+	return []byte(b.String())
+}
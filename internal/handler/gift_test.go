@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGiftEscape(t *testing.T) {
+	for _, s := range []string{ "plain", "a = b ~ c", "{x}: #1 \\ y", "two\nlines", } {
+		if got := unescapeGift(escapeGift(s)); got != s {
+			t.Errorf("unescapeGift(escapeGift(%q)) = %q", s, got)
+		}
+	}
+}
+
+func TestParseGift(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		questions   []PackQuestion
+		problems    []ImportProblem
+		unsupported []ImportProblem
+	}{
+		{
+			name: "multiple choice",
+			data: "// value: 200\n// source: https://example.com\n::Capital:: What is the capital of France? {\n\t=Paris\n\t~London#Wrong\n\t####Since 987.\n}\n",
+			questions: []PackQuestion{
+				{ Title: "What is the capital of France?", Value: 200, Source: "https://example.com", Explanation: "Since 987.", Answers: []PackAnswer{
+					{ Text: "Paris", Correct: true, }, { Text: "London", },
+				}, },
+			},
+		},
+		{
+			name: "true and false",
+			data: "The sky is blue. {T}\n\nThe sun is cold. {FALSE#It's hot.}\n",
+			questions: []PackQuestion{
+				{ Title: "The sky is blue.", Value: IMPORT_DEFAULT_VALUE, Answers: []PackAnswer{
+					{ Text: "True", Correct: true, }, { Text: "False", },
+				}, },
+				{ Title: "The sun is cold.", Value: IMPORT_DEFAULT_VALUE, Answers: []PackAnswer{
+					{ Text: "True", }, { Text: "False", Correct: true, },
+				}, },
+			},
+		},
+		{
+			name: "weights, escapes and a missing word",
+			data: "$CATEGORY: $course$/Maths\n// a comment\n2 \\+ 2 \\= {~%50%4 ~%-50%5 ~3} and \\{that\\}.\n",
+			questions: []PackQuestion{
+				{ Title: "2 + 2 = _____ and {that}.", Value: IMPORT_DEFAULT_VALUE, Answers: []PackAnswer{
+					{ Text: "4", Correct: true, }, { Text: "5", }, { Text: "3", },
+				}, },
+			},
+		},
+		{
+			name: "html",
+			data: "[html]<p>Who?</p><img src=\"https://example.com/a.png\"> {=<b>Me</b> ~You <img src\\=\"https://example.com/you.png\">}\n",
+			questions: []PackQuestion{
+				{ Title: "Who?", ImgUrl: "https://example.com/a.png", Value: IMPORT_DEFAULT_VALUE, Answers: []PackAnswer{
+					{ Text: "Me", Correct: true, }, { Text: "You", ImgUrl: "https://example.com/you.png", },
+				}, },
+			},
+		},
+		{
+			name: "unsupported",
+			data: "Describe it. {}\n\nJust text.\n\nPi? {#3.14}\n\nPair {=a -> 1 =b -> 2}\n\nName it {=Paris =paris}\n",
+			unsupported: []ImportProblem{
+				{ Line: 1, Message: "essay questions can't be expressed in a pack", },
+				{ Line: 3, Message: "descriptions without answers can't be expressed in a pack", },
+				{ Line: 5, Message: "numerical questions can't be expressed in a pack", },
+				{ Line: 7, Message: "matching questions can't be expressed in a pack", },
+				{ Line: 9, Message: "short answer questions can't be expressed in a pack", },
+			},
+		},
+		{
+			name: "problems",
+			data: "::Name Question {=a ~b}\n\nQ {a b}\n\nQ {~a ~b}\n\nOpen {=a ~b\n",
+			problems: []ImportProblem{
+				{ Line: 1, Message: "the name of the question is not closed with ::", },
+				{ Line: 3, Message: "the answers must start with = or ~", },
+				{ Line: 5, Message: "no answer is marked as correct", },
+				{ Line: 7, Message: "the answers are not closed with }", },
+			},
+		},
+		{
+			name: "empty",
+			data: "// only a comment\n",
+			problems: []ImportProblem{ { Line: 1, Message: "the file has no questions", }, },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _, problems, unsupported := parseGift([]byte(tt.data))
+			if !reflect.DeepEqual([]ImportProblem(problems), tt.problems) {
+				t.Errorf("problems = %+v, want %+v", problems, tt.problems)
+			}
+			if !reflect.DeepEqual([]ImportProblem(unsupported), tt.unsupported) {
+				t.Errorf("unsupported = %+v, want %+v", unsupported, tt.unsupported)
+			}
+			if tt.questions != nil {
+				checkRoundTrip(t, body.Questions, tt.questions)
+			}
+		})
+	}
+}
+
+func TestGiftRoundTrip(t *testing.T) {
+	pack := formatsPack()
+	body, _, problems, unsupported := parseGift(writeGift(&pack))
+	if len(problems) > 0 || len(unsupported) > 0 {
+		t.Fatalf("problems = %+v, unsupported = %+v", problems, unsupported)
+	}
+	checkRoundTrip(t, body.Questions, pack.Questions)
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The groups are named lists of users, e.g. a class or a team, the packs
+// can be shared with at once (see access.go). Only the owner of a group
+// manages its members, the members can leave it themselves:
+// users.group(
+//   group_id   serial primary int,
+//   user_id    int (from users.user, the owner),
+//   name       varchar(32),
+//   created_at timestamptz
+// )
+// users.group_member(
+//   group_id int (from users.group),
+//   user_id  int (from users.user),
+//   added_at timestamptz
+// )
+
+type Group struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Members   []int     `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The columns scanned by scanGroup, for the queries selecting from
+// users.group g joined with users.group_member m.
+const GROUP_COLUMNS = "g.group_id, g.user_id, g.name, g.created_at, COALESCE(array_agg(m.user_id ORDER BY m.added_at) FILTER (WHERE m.user_id IS NOT NULL), '{}')"
+
+func scanGroup(row pgx.Row, group *Group) error {
+	return row.Scan(&group.Id, &group.UserId, &group.Name, &group.CreatedAt, &group.Members)
+}
+
+// Gets the group with the id from the path of the request if the user owns
+// it or is one of its members. Writes the error response and returns false
+// otherwise.
+func getGroup(w http.ResponseWriter, r *http.Request, conn *pgx.Conn, session *Session, group *Group) bool {
+	id := mux.Vars(r)["id"]
+
+	err := scanGroup(database.QueryRow(conn, "SELECT " + GROUP_COLUMNS + " FROM users.\"group\" g LEFT JOIN users.group_member m ON g.group_id = m.group_id WHERE g.group_id = $1 AND (g.user_id = $2 OR EXISTS (SELECT * FROM users.group_member WHERE group_id = g.group_id AND user_id = $2)) GROUP BY g.group_id",
+		id, session.UserId), group)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No group with given id exists.")
+			return false
+		}
+		fmt.Fprintf(os.Stderr, "Could not get group %s: %v\n", id, err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the group.")
+		return false
+	}
+	return true
+}
+
+func CreateGroup(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var group Group
+	err := json.NewDecoder(r.Body).Decode(&group)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" || len(group.Name) > 32 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"name must be from 1 to 32 characters long.")
+		return
+	}
+
+	err = database.QueryRow(conn, "INSERT INTO users.\"group\" (user_id, name) VALUES ($1, $2) RETURNING group_id, user_id, created_at",
+		session.UserId, group.Name).Scan(&group.Id, &group.UserId, &group.CreatedAt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create group POST /api/groups: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not create the group.")
+		return
+	}
+	group.Members = []int{}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(group)
+}
+
+// Returns the groups the user owns or is a member of.
+func GetGroups(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	rows := database.QueryRows(conn, "SELECT " + GROUP_COLUMNS + " FROM users.\"group\" g LEFT JOIN users.group_member m ON g.group_id = m.group_id WHERE g.user_id = $1 OR EXISTS (SELECT * FROM users.group_member WHERE group_id = g.group_id AND user_id = $1) GROUP BY g.group_id ORDER BY g.created_at",
+		session.UserId)
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var group Group
+		err := scanGroup(rows, &group)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read groups GET /api/groups: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read groups.")
+			return
+		}
+		groups = append(groups, group)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate groups GET /api/groups: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate groups.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(groups)
+}
+
+func GetGroup(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var group Group
+	if !getGroup(w, r, conn, session, &group) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(group)
+}
+
+// Deletes the group. The packs shared with it are no longer shared with
+// its members.
+func DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var group Group
+	if !getGroup(w, r, conn, session, &group) {
+		return
+	}
+
+	if group.UserId != session.UserId {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Only the owner can delete the group.")
+		return
+	}
+
+	_, err := database.Execute(conn, "DELETE FROM users.\"group\" WHERE group_id = $1", group.Id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not delete group DELETE /api/groups/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not delete the group.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AddGroupMember(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["user_id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var group Group
+	if !getGroup(w, r, conn, session, &group) {
+		return
+	}
+
+	if group.UserId != session.UserId {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Only the owner can add members to the group.")
+		return
+	}
+
+	_, err := database.Execute(conn, "INSERT INTO users.group_member (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		group.Id, userId)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == database.ForeignKeyViolation {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No user with given id exists.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not add group member PUT /api/groups/id/members/user_id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not add the member.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Removes the member from the group. The owner removes anyone, the members
+// remove themselves.
+func RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["user_id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var group Group
+	if !getGroup(w, r, conn, session, &group) {
+		return
+	}
+
+	if group.UserId != session.UserId && userId != fmt.Sprint(session.UserId) {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Only the owner can remove other members from the group.")
+		return
+	}
+
+	tag, err := database.Execute(conn, "DELETE FROM users.group_member WHERE group_id = $1 AND user_id = $2",
+		group.Id, userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not remove group member DELETE /api/groups/id/members/user_id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not remove the member.")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"The user is not a member of the group.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
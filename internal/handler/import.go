@@ -0,0 +1,506 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/detectivekaktus/JGame/internal/validation"
+	"github.com/jackc/pgx/v5"
+)
+
+// The packs can be imported from CSV and TSV spreadsheets, one question
+// per row, and from the quiz formats of the learning management systems,
+// GIFT, Moodle XML and QTI 2.1, see gift.go, moodle.go and qti.go.
+//
+// The first row of the spreadsheets names the columns, in any order:
+//   question    (required) the title of the question,
+//   value       (required) the points of the question, a whole number,
+//   answers     (required) the answers separated by `|`, at least two,
+//   correct     the numbers of the correct answers, from 1, separated by
+//               `|`. The answers may be marked as correct with a leading
+//               `*` instead,
+//   image       the url of the picture of the question,
+//   explanation shown once the question is revealed,
+//   source      the url of where the answer comes from.
+// `\|` and `\*` are a literal bar and asterisk in the answers, `\\` is a
+// backslash.
+//
+// The whole file is checked before anything is saved, and the problems are
+// reported with their line. With `dry_run=true` the pack isn't created,
+// only the body it would have is returned. The questions the formats can
+// have but the packs can't, like the essays, fail the import unless
+// `skip_unsupported=true` leaves them out.
+
+const (
+	MAX_IMPORT_SIZE     = 1 << 20
+	MAX_IMPORT_PROBLEMS = 100
+)
+
+const (
+	IMPORT_CSV    = "csv"
+	IMPORT_TSV    = "tsv"
+	IMPORT_GIFT   = "gift"
+	IMPORT_MOODLE = "moodle"
+	IMPORT_QTI    = "qti"
+)
+
+const (
+	COLUMN_QUESTION    = "question"
+	COLUMN_VALUE       = "value"
+	COLUMN_ANSWERS     = "answers"
+	COLUMN_CORRECT     = "correct"
+	COLUMN_IMAGE       = "image"
+	COLUMN_EXPLANATION = "explanation"
+	COLUMN_SOURCE      = "source"
+)
+
+var importColumns = []string{
+	COLUMN_QUESTION, COLUMN_VALUE, COLUMN_ANSWERS, COLUMN_CORRECT,
+	COLUMN_IMAGE, COLUMN_EXPLANATION, COLUMN_SOURCE,
+}
+
+type ImportProblem struct {
+	// The file of the zip the problem is in.
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportErrorResponse struct {
+	Error    string          `json:"error"`
+	Message  string          `json:"message"`
+	Problems []ImportProblem `json:"problems"`
+}
+
+type ImportPreviewResponse struct {
+	Name      string          `json:"name"`
+	Questions int             `json:"questions"`
+	Body      PackBody        `json:"body"`
+	// The questions left out with `skip_unsupported=true`.
+	Skipped   []ImportProblem `json:"skipped,omitempty"`
+	Warnings  []LintProblem   `json:"warnings,omitempty"`
+}
+
+// Where an imported question comes from.
+type importSource struct {
+	File string
+	Line int
+}
+
+// Collects the problems of an import up to MAX_IMPORT_PROBLEMS.
+type importProblems []ImportProblem
+
+func (p *importProblems) add(line int, column string, format string, args ...any) {
+	p.addIn("", line, column, format, args...)
+}
+
+// Adds the problem of the value at the JSON pointer of the imported pack.
+// The problems of a question are reported where the question comes from,
+// `sources` has the source of every question. The other ones are reported
+// in the file, with no line.
+func (p *importProblems) addAt(file string, sources []importSource, pointer string, format string, args ...any) {
+	source := importSource{ File: file, }
+	if rest, ok := strings.CutPrefix(pointer, "/questions/"); ok {
+		index, _, _ := strings.Cut(rest, "/")
+		if i, err := strconv.Atoi(index); err == nil && i < len(sources) {
+			source = sources[i]
+		}
+	}
+	p.addIn(source.File, source.Line, "", format, args...)
+}
+
+// Lints the imported pack like a saved one. The errors are added to the
+// problems of the import, the warnings are returned.
+func (p *importProblems) lint(file string, sources []importSource, body *PackBody) []LintProblem {
+	lint := lintPack(body)
+	for _, e := range lint.Errors {
+		p.addAt(file, sources, e.Pointer, "%s, the rule %s at %s", e.Message, e.Rule, e.Pointer)
+	}
+	return lint.Warnings
+}
+
+func (p *importProblems) addIn(file string, line int, column string, format string, args ...any) {
+	if len(*p) < MAX_IMPORT_PROBLEMS {
+		*p = append(*p, ImportProblem{ File: file, Line: line, Column: column, Message: fmt.Sprintf(format, args...), })
+	}
+}
+
+func isHttpUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Splits the answers cell by the unescaped bars. Returns the answers and
+// whether each of them is marked as correct.
+func splitAnswers(cell string) ([]string, []bool) {
+	var answers []string
+	var marked []bool
+	var cur strings.Builder
+	escaped, star := false, false
+	flush := func() {
+		answers = append(answers, strings.TrimSpace(cur.String()))
+		marked = append(marked, star)
+		cur.Reset()
+		star = false
+	}
+
+	for _, c := range cell {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '|':
+			flush()
+		case c == '*' && strings.TrimSpace(cur.String()) == "" && !star:
+			star = true
+			cur.Reset()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	flush()
+	return answers, marked
+}
+
+// Reads the pack body from the spreadsheet separated by the comma.
+func parseSpreadsheet(data []byte, comma rune) (PackBody, []importSource, importProblems) {
+	var body PackBody
+	var sources []importSource
+	var problems importProblems
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	if comma == '\t' {
+		reader.LazyQuotes = true
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		problems.add(1, "", "the file is empty")
+		return body, sources, problems
+	} else if err != nil {
+		problems.add(1, "", "could not read the header: %v", err)
+		return body, sources, problems
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		known := false
+		for _, c := range importColumns {
+			known = known || c == name
+		}
+		if !known {
+			problems.add(1, name, "unknown column, expected one of %s", strings.Join(importColumns, ", "))
+			continue
+		}
+		if _, ok := columns[name]; ok {
+			problems.add(1, name, "the column is given twice")
+			continue
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{ COLUMN_QUESTION, COLUMN_VALUE, COLUMN_ANSWERS, } {
+		if _, ok := columns[name]; !ok {
+			problems.add(1, name, "the column is missing")
+		}
+	}
+	if len(problems) > 0 {
+		return body, sources, problems
+	}
+
+	body.Questions = []PackQuestion{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				problems.add(parseErr.Line, "", "%v", parseErr.Err)
+				continue
+			}
+			problems.add(0, "", "could not read the file: %v", err)
+			break
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			problems.add(line, "", "expected %d cells, got %d", len(header), len(record))
+			continue
+		}
+		cell := func(name string) string {
+			i, ok := columns[name]
+			if !ok {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		q := PackQuestion{
+			Title: cell(COLUMN_QUESTION),
+			ImgUrl: cell(COLUMN_IMAGE),
+			Explanation: cell(COLUMN_EXPLANATION),
+			Source: cell(COLUMN_SOURCE),
+		}
+		if q.Title == "" {
+			problems.add(line, COLUMN_QUESTION, "the question is empty")
+		}
+
+		q.Value, err = strconv.Atoi(cell(COLUMN_VALUE))
+		if err != nil {
+			problems.add(line, COLUMN_VALUE, "the value must be a whole number")
+		}
+
+		var answers []string
+		var marked []bool
+		if cell(COLUMN_ANSWERS) != "" {
+			answers, marked = splitAnswers(cell(COLUMN_ANSWERS))
+		}
+		for i, text := range answers {
+			if text == "" {
+				problems.add(line, COLUMN_ANSWERS, "answer %d is empty", i + 1)
+			}
+			q.Answers = append(q.Answers, PackAnswer{ Text: text, Correct: marked[i], })
+		}
+		if len(answers) < 2 {
+			problems.add(line, COLUMN_ANSWERS, "at least 2 answers are required")
+		}
+
+		if correct := cell(COLUMN_CORRECT); correct != "" {
+			for _, n := range strings.Split(correct, "|") {
+				i, err := strconv.Atoi(strings.TrimSpace(n))
+				if err != nil || i < 1 || i > len(q.Answers) {
+					problems.add(line, COLUMN_CORRECT, "%q is not the number of an answer", strings.TrimSpace(n))
+					continue
+				}
+				q.Answers[i - 1].Correct = true
+			}
+		}
+
+		hasCorrect := false
+		for _, a := range q.Answers {
+			hasCorrect = hasCorrect || a.Correct
+		}
+		if !hasCorrect {
+			problems.add(line, COLUMN_ANSWERS, "no answer is marked as correct")
+		}
+
+		if q.ImgUrl != "" && !isHttpUrl(q.ImgUrl) {
+			problems.add(line, COLUMN_IMAGE, "the image must be an http or https url")
+		}
+		if q.Source != "" && !isHttpUrl(q.Source) {
+			problems.add(line, COLUMN_SOURCE, "the source must be an http or https url")
+		}
+		if len([]rune(q.Explanation)) > 4000 {
+			problems.add(line, COLUMN_EXPLANATION, "the explanation can't be longer than 4000 characters")
+		}
+
+		body.Questions = append(body.Questions, q)
+		sources = append(sources, importSource{ Line: line, })
+	}
+
+	if len(body.Questions) == 0 && len(problems) == 0 {
+		problems.add(1, "", "the file has no questions")
+	}
+	return body, sources, problems
+}
+
+// Returns the format of the import from the `format` query parameter, the
+// Content-Type of the request or, when neither tells, the file itself.
+func importFormat(r *http.Request, data []byte) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "text/csv":
+		return IMPORT_CSV
+	case "text/tab-separated-values":
+		return IMPORT_TSV
+	case "application/zip":
+		return IMPORT_QTI
+	}
+
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return IMPORT_QTI
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\ufeff")))
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		if bytes.Contains(trimmed, []byte("<quiz")) {
+			return IMPORT_MOODLE
+		}
+		return IMPORT_QTI
+	}
+
+	firstLine, _, _ := bytes.Cut(trimmed, []byte("\n"))
+	header := bytes.ToLower(firstLine)
+	if !bytes.Contains(header, []byte(COLUMN_QUESTION)) && bytes.ContainsRune(trimmed, '{') {
+		return IMPORT_GIFT
+	}
+	if bytes.ContainsRune(firstLine, '\t') {
+		return IMPORT_TSV
+	}
+	return IMPORT_CSV
+}
+
+func importFormatName(format string) string {
+	switch format {
+	case IMPORT_GIFT:
+		return "GIFT"
+	case IMPORT_MOODLE:
+		return "Moodle XML"
+	case IMPORT_QTI:
+		return "QTI 2.1"
+	}
+	return strings.ToUpper(format)
+}
+
+func sendImportProblems(w http.ResponseWriter, problems []ImportProblem) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(ImportErrorResponse{
+		Error: "Invalid import",
+		Message: "The file has problems, nothing was imported.",
+		Problems: problems,
+	})
+}
+
+// Creates a draft pack from the file in the body of the request. Takes the
+// name of the pack from the `name` query parameter.
+func ImportPack(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Imported pack"
+	}
+	if len([]rune(name)) > 32 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"name can't be longer than 32 characters.")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_IMPORT_SIZE))
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusRequestEntityTooLarge, "Too large",
+			fmt.Sprintf("The file can be up to %d KB.", MAX_IMPORT_SIZE >> 10))
+		return
+	}
+
+	var body PackBody
+	var sources []importSource
+	var problems, unsupported importProblems
+	format := importFormat(r, data)
+	switch format {
+	case IMPORT_CSV:
+		body, sources, problems = parseSpreadsheet(data, ',')
+	case IMPORT_TSV:
+		body, sources, problems = parseSpreadsheet(data, '\t')
+	case IMPORT_GIFT:
+		body, sources, problems, unsupported = parseGift(data)
+	case IMPORT_MOODLE:
+		body, sources, problems, unsupported = parseMoodle(data)
+	case IMPORT_QTI:
+		body, sources, problems, unsupported = parseQti(data)
+	default:
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"format must be one of csv, tsv, gift, moodle or qti.")
+		return
+	}
+
+	// The questions a pack can't express fail the import unless they are
+	// asked to be left out.
+	skip := r.URL.Query().Get("skip_unsupported") == "true"
+	if !skip {
+		problems = append(problems, unsupported...)
+	}
+	if len(problems) > 0 {
+		sendImportProblems(w, problems)
+		return
+	}
+	if len(body.Questions) == 0 {
+		sendImportProblems(w, []ImportProblem{ { Message: "None of the questions can be expressed in a pack.", }, })
+		return
+	}
+	body.Title = name
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not encode imported pack POST /api/packs/import: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not import the pack.")
+		return
+	}
+	if errs := validation.Validate(validation.PACK_SCHEMA, raw); len(errs) > 0 {
+		problems = nil
+		for _, e := range errs {
+			problems.addAt("", sources, e.Pointer, "the imported pack does not satisfy the schema, %s", e)
+		}
+		sendImportProblems(w, problems)
+		return
+	}
+	warnings := problems.lint("", sources, &body)
+	if len(problems) > 0 {
+		sendImportProblems(w, problems)
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		json.NewEncoder(w).Encode(ImportPreviewResponse{
+			Name: name,
+			Questions: len(body.Questions),
+			Body: body,
+			Skipped: unsupported,
+			Warnings: warnings,
+		})
+		return
+	}
+
+	pack := Pack{
+		UserId: session.UserId,
+		Name: name,
+		Body: raw,
+		Visibility: VISIBILITY_PUBLIC,
+		Note: "Imported from " + importFormatName(format),
+	}
+	if len(unsupported) > 0 {
+		pack.Note += fmt.Sprintf(", %d unsupported questions skipped", len(unsupported))
+	}
+	err = insertPack(conn, &pack)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not insert imported pack POST /api/packs/import: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not create pack.")
+		return
+	}
+
+	pack.Note = ""
+	pack.Warnings = warnings
+	setRevisionETag(w, pack.Revision)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(pack)
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitAnswers(t *testing.T) {
+	tests := []struct {
+		cell    string
+		answers []string
+		marked  []bool
+	}{
+		{ "a|b|c", []string{ "a", "b", "c", }, []bool{ false, false, false, }, },
+		{ " a | b ", []string{ "a", "b", }, []bool{ false, false, }, },
+		{ "*a|b", []string{ "a", "b", }, []bool{ true, false, }, },
+		{ "a| * b", []string{ "a", "b", }, []bool{ false, true, }, },
+		{ "a*b|c", []string{ "a*b", "c", }, []bool{ false, false, }, },
+		{ `\*a|b`, []string{ "*a", "b", }, []bool{ false, false, }, },
+		{ `a\|b|c`, []string{ "a|b", "c", }, []bool{ false, false, }, },
+		{ `a\\|b`, []string{ `a\`, "b", }, []bool{ false, false, }, },
+		{ "a||b", []string{ "a", "", "b", }, []bool{ false, false, false, }, },
+		{ "**a|b", []string{ "*a", "b", }, []bool{ true, false, }, },
+	}
+
+	for _, tt := range tests {
+		answers, marked := splitAnswers(tt.cell)
+		if !reflect.DeepEqual(answers, tt.answers) || !reflect.DeepEqual(marked, tt.marked) {
+			t.Errorf("splitAnswers(%q) = %q, %v, want %q, %v", tt.cell, answers, marked, tt.answers, tt.marked)
+		}
+	}
+}
+
+func TestParseSpreadsheet(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		comma     rune
+		questions []PackQuestion
+		problems  []ImportProblem
+	}{
+		{
+			name: "correct column",
+			data: "question,value,answers,correct\nCapital of Italy?,100,Rome|Milan|Turin,1\n",
+			comma: ',',
+			questions: []PackQuestion{
+				{ Title: "Capital of Italy?", Value: 100, Answers: []PackAnswer{
+					{ Text: "Rome", Correct: true, }, { Text: "Milan", }, { Text: "Turin", },
+				}, },
+			},
+		},
+		{
+			name: "starred answers and optional columns in any order",
+			data: "\ufeffAnswers,Value,Question,Explanation,Source\n*4|5,200,2 + 2?,Basic math,https://example.com\n",
+			comma: ',',
+			questions: []PackQuestion{
+				{ Title: "2 + 2?", Value: 200, Explanation: "Basic math", Source: "https://example.com", Answers: []PackAnswer{
+					{ Text: "4", Correct: true, }, { Text: "5", },
+				}, },
+			},
+		},
+		{
+			name: "tabs",
+			data: "question\tvalue\tanswers\tcorrect\nThe \"quoted\" title\t50\ta|b\t1|2\n",
+			comma: '\t',
+			questions: []PackQuestion{
+				{ Title: "The \"quoted\" title", Value: 50, Answers: []PackAnswer{
+					{ Text: "a", Correct: true, }, { Text: "b", Correct: true, },
+				}, },
+			},
+		},
+		{
+			name: "empty file",
+			data: "",
+			comma: ',',
+			problems: []ImportProblem{ { Line: 1, Message: "the file is empty", }, },
+		},
+		{
+			name: "missing and unknown columns",
+			data: "question,points\n",
+			comma: ',',
+			problems: []ImportProblem{
+				{ Line: 1, Column: "points", Message: "unknown column, expected one of " + strings.Join(importColumns, ", "), },
+				{ Line: 1, Column: "value", Message: "the column is missing", },
+				{ Line: 1, Column: "answers", Message: "the column is missing", },
+			},
+		},
+		{
+			name: "no questions",
+			data: "question,value,answers\n",
+			comma: ',',
+			problems: []ImportProblem{ { Line: 1, Message: "the file has no questions", }, },
+		},
+		{
+			name: "bad rows",
+			data: "question,value,answers,correct,image\n" +
+				",ten,a,,\n" +
+				"Title,10,a|b,3,ftp://example.com/a.png\n" +
+				"Short,10\n",
+			comma: ',',
+			problems: []ImportProblem{
+				{ Line: 2, Column: "question", Message: "the question is empty", },
+				{ Line: 2, Column: "value", Message: "the value must be a whole number", },
+				{ Line: 2, Column: "answers", Message: "at least 2 answers are required", },
+				{ Line: 2, Column: "answers", Message: "no answer is marked as correct", },
+				{ Line: 3, Column: "correct", Message: "\"3\" is not the number of an answer", },
+				{ Line: 3, Column: "answers", Message: "no answer is marked as correct", },
+				{ Line: 3, Column: "image", Message: "the image must be an http or https url", },
+				{ Line: 4, Message: "expected 5 cells, got 2", },
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _, problems := parseSpreadsheet([]byte(tt.data), tt.comma)
+			if !reflect.DeepEqual([]ImportProblem(problems), tt.problems) {
+				t.Fatalf("problems = %+v, want %+v", problems, tt.problems)
+			}
+			if tt.problems == nil && !reflect.DeepEqual(body.Questions, tt.questions) {
+				t.Errorf("questions = %+v, want %+v", body.Questions, tt.questions)
+			}
+		})
+	}
+}
+
+func TestImportFormat(t *testing.T) {
+	tests := []struct {
+		query       string
+		contentType string
+		data        string
+		format      string
+	}{
+		{ "?format=gift", "text/csv", "", IMPORT_GIFT, },
+		{ "", "text/csv; charset=utf-8", "", IMPORT_CSV, },
+		{ "", "text/tab-separated-values", "", IMPORT_TSV, },
+		{ "", "application/zip", "", IMPORT_QTI, },
+		{ "", "", "PK\x03\x04...", IMPORT_QTI, },
+		{ "", "", "<?xml version=\"1.0\"?>\n<quiz></quiz>", IMPORT_MOODLE, },
+		{ "", "", "<assessmentItem/>", IMPORT_QTI, },
+		{ "", "", "Capital of Italy? {=Rome ~Milan}", IMPORT_GIFT, },
+		{ "", "", "question,value,answers\n\"{a}\",1,a|b", IMPORT_CSV, },
+		{ "", "", "question\tvalue\tanswers\n", IMPORT_TSV, },
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/packs/import" + tt.query, nil)
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if format := importFormat(r, []byte(tt.data)); format != tt.format {
+			t.Errorf("importFormat(%q, %q, %q) = %s, want %s", tt.query, tt.contentType, tt.data, format, tt.format)
+		}
+	}
+}
+
+func TestImportLintLines(t *testing.T) {
+	data := "question,value,answers\n" +
+		"First?,100,*a|b\n" +
+		"Second?,100,*a|b\n"
+	body, sources, problems := parseSpreadsheet([]byte(data), ',')
+	if len(problems) != 0 {
+		t.Fatalf("problems = %+v", problems)
+	}
+	if want := []importSource{ { Line: 2, }, { Line: 3, }, }; !reflect.DeepEqual(sources, want) {
+		t.Fatalf("sources = %+v, want %+v", sources, want)
+	}
+
+	problems = nil
+	body.Questions[1].Answers[1].Text = ""
+	problems.lint("", sources, &body)
+	want := []ImportProblem{
+		{ Line: 3, Message: "the answer has neither text nor picture, the rule empty-answer at /questions/1/answers/1", },
+	}
+	if !reflect.DeepEqual([]ImportProblem(problems), want) {
+		t.Errorf("problems = %+v, want %+v", problems, want)
+	}
+
+	problems = nil
+	problems.lint(BUNDLE_PACK, nil, &PackBody{})
+	want = []ImportProblem{
+		{ File: BUNDLE_PACK, Message: "the pack has no questions, the rule no-questions at /questions", },
+	}
+	if !reflect.DeepEqual([]ImportProblem(problems), want) {
+		t.Errorf("problems = %+v, want %+v", problems, want)
+	}
+}
@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/detectivekaktus/JGame/internal/media"
+	"github.com/detectivekaktus/JGame/internal/validation"
+)
+
+// The linter checks what the schema can't express. The errors make the
+// pack unplayable and fail the saves, the warnings are sent back with the
+// saved pack. The problems point to the value with a JSON pointer, like
+// the schema errors do, and name the rule they break:
+//   no-questions        (error)   the pack has no questions,
+//   empty-title         (error)   the question has no title,
+//   empty-answer        (error)   the answer has neither text nor picture,
+//   no-correct-answer   (error)   none of the answers is correct,
+//   all-correct         (warning) every answer is correct,
+//   duplicate-answer    (warning) the question has the same answer twice,
+//   duplicate-question  (warning) the pack has the same question twice,
+//   extreme-value       (warning) the value isn't between 1 and
+//                                 MAX_QUESTION_VALUE,
+//   broken-url          (error)   the url of a picture or a clip isn't an
+//                                 http or https one,
+//   media-range         (error)   the clip ends before it starts,
+//   long-text           (warning) the title or an answer is too long to
+//                                 be shown well.
+// Whether the media can actually be loaded is checked on publish only,
+// see publish.go.
+
+const (
+	LINT_ERROR   = "error"
+	LINT_WARNING = "warning"
+)
+
+const (
+	MAX_QUESTION_VALUE  = 10000
+	MAX_QUESTION_LENGTH = 300
+	MAX_ANSWER_LENGTH   = 150
+)
+
+type LintProblem struct {
+	Severity string `json:"severity"`
+	Pointer  string `json:"pointer"`
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+}
+
+type LintResponse struct {
+	Errors   []LintProblem `json:"errors"`
+	Warnings []LintProblem `json:"warnings"`
+}
+
+type LintErrorResponse struct {
+	Error    string        `json:"error"`
+	Message  string        `json:"message"`
+	Errors   []LintProblem `json:"errors"`
+	Warnings []LintProblem `json:"warnings"`
+}
+
+func (l *LintResponse) add(severity string, pointer string, rule string, format string, args ...any) {
+	problem := LintProblem{ Severity: severity, Pointer: pointer, Rule: rule, Message: fmt.Sprintf(format, args...), }
+	if severity == LINT_ERROR {
+		l.Errors = append(l.Errors, problem)
+	} else {
+		l.Warnings = append(l.Warnings, problem)
+	}
+}
+
+// Returns whether the url can be a picture or a clip of a pack.
+func isMediaUrl(s string) bool {
+	if key, ok := strings.CutPrefix(s, media.Url("")); ok {
+		return key != "" && !strings.ContainsAny(key, "/?#")
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Returns the text the duplicates are compared by.
+func normalizeLintText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+func lintPack(body *PackBody) LintResponse {
+	lint := LintResponse{ Errors: []LintProblem{}, Warnings: []LintProblem{}, }
+	if len(body.Questions) == 0 {
+		lint.add(LINT_ERROR, "/questions", "no-questions", "the pack has no questions")
+	}
+
+	checkUrl := func(pointer string, s string) {
+		if s != "" && !isMediaUrl(s) {
+			lint.add(LINT_ERROR, pointer, "broken-url", "%q is not an http or https url", s)
+		}
+	}
+
+	questions := make(map[string]int)
+	for i, q := range body.Questions {
+		pointer := fmt.Sprintf("/questions/%d", i)
+
+		title := normalizeLintText(q.Title)
+		if title == "" {
+			lint.add(LINT_ERROR, pointer + "/title", "empty-title", "the question has no title")
+		} else if first, ok := questions[title]; ok {
+			lint.add(LINT_WARNING, pointer + "/title", "duplicate-question", "the same question is asked at /questions/%d", first)
+		} else {
+			questions[title] = i
+		}
+		if n := len([]rune(q.Title)); n > MAX_QUESTION_LENGTH {
+			lint.add(LINT_WARNING, pointer + "/title", "long-text", "the title is %d characters long, more than %d", n, MAX_QUESTION_LENGTH)
+		}
+
+		if q.Value <= 0 || q.Value > MAX_QUESTION_VALUE {
+			lint.add(LINT_WARNING, pointer + "/value", "extreme-value", "the value should be between 1 and %d", MAX_QUESTION_VALUE)
+		}
+
+		checkUrl(pointer + "/image_url", q.ImgUrl)
+		if q.Media != nil {
+			checkUrl(pointer + "/media/url", q.Media.Url)
+			if q.Media.End != 0 && q.Media.End <= q.Media.Start {
+				lint.add(LINT_ERROR, pointer + "/media/end", "media-range", "the clip ends before it starts")
+			}
+		}
+
+		correct := 0
+		answers := make(map[string]int)
+		for j, a := range q.Answers {
+			answer := fmt.Sprintf("%s/answers/%d", pointer, j)
+			if a.Correct {
+				correct++
+			}
+
+			text := normalizeLintText(a.Text)
+			if text == "" && a.ImgUrl == "" {
+				lint.add(LINT_ERROR, answer, "empty-answer", "the answer has neither text nor picture")
+			} else if first, ok := answers[text + "\x00" + a.ImgUrl]; ok {
+				lint.add(LINT_WARNING, answer, "duplicate-answer", "the answer is the same as %s/answers/%d", pointer, first)
+			} else {
+				answers[text + "\x00" + a.ImgUrl] = j
+			}
+			if n := len([]rune(a.Text)); n > MAX_ANSWER_LENGTH {
+				lint.add(LINT_WARNING, answer + "/text", "long-text", "the answer is %d characters long, more than %d", n, MAX_ANSWER_LENGTH)
+			}
+			checkUrl(answer + "/image_url", a.ImgUrl)
+		}
+
+		if correct == 0 {
+			lint.add(LINT_ERROR, pointer + "/answers", "no-correct-answer", "none of the answers is correct")
+		} else if correct == len(q.Answers) && correct > 1 {
+			lint.add(LINT_WARNING, pointer + "/answers", "all-correct", "every answer is correct")
+		}
+	}
+	return lint
+}
+
+// Checks the body of the pack against the schema and lints it. Writes the
+// error response and returns false if the pack can't be saved, returns the
+// warnings otherwise.
+func ensureValidPack(w http.ResponseWriter, rawBody json.RawMessage) ([]LintProblem, bool) {
+	if !ensurePackSchema(w, rawBody) {
+		return nil, false
+	}
+
+	var body PackBody
+	err := json.Unmarshal(rawBody, &body)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the pack.")
+		return nil, false
+	}
+
+	lint := lintPack(&body)
+	if len(lint.Errors) == 0 {
+		return lint.Warnings, true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(LintErrorResponse{
+		Error: "Invalid pack",
+		Message: "The pack can't be saved until the errors are fixed.",
+		Errors: lint.Errors,
+		Warnings: lint.Warnings,
+	})
+	return nil, false
+}
+
+// Lints the pack body in the request without saving anything. The schema
+// errors are reported as lint errors, so the tools get every problem in
+// the same shape.
+func LintPack(w http.ResponseWriter, r *http.Request) {
+	var rawBody json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&rawBody)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	lint := LintResponse{ Errors: []LintProblem{}, Warnings: []LintProblem{}, }
+	for _, e := range validation.Validate(validation.PACK_SCHEMA, rawBody) {
+		lint.add(LINT_ERROR, e.Pointer, "schema/" + e.Rule, "%s", e.Message)
+	}
+	if len(lint.Errors) == 0 {
+		var body PackBody
+		err = json.Unmarshal(rawBody, &body)
+		if err != nil {
+			httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+				"Could not process the body of the pack.")
+			return
+		}
+		lint = lintPack(&body)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(lint)
+}
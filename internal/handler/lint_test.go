@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/detectivekaktus/JGame/internal/media"
+)
+
+// Returns a question that breaks none of the rules.
+func lintQuestion(title string) PackQuestion {
+	return PackQuestion{
+		Title: title,
+		Value: 100,
+		Answers: []PackAnswer{ { Text: "Right", Correct: true, }, { Text: "Wrong", }, },
+	}
+}
+
+func TestLintPack(t *testing.T) {
+	tests := []struct {
+		name      string
+		questions func(q []PackQuestion)
+		problems  []LintProblem
+	}{
+		{
+			name: "clean",
+			questions: func(q []PackQuestion) {
+				q[0].ImgUrl = media.Url("abc.png")
+				q[0].Media = &PackMedia{ Type: MEDIA_AUDIO, Url: "https://example.com/a.mp3", Start: 1, End: 2, }
+				q[1].Answers[1].Text = ""
+				q[1].Answers[1].ImgUrl = "https://example.com/b.png"
+			},
+		},
+		{
+			name: "empty title and answers",
+			questions: func(q []PackQuestion) {
+				q[0].Title = "  "
+				q[0].Answers[1].Text = ""
+			},
+			problems: []LintProblem{
+				{ LINT_ERROR, "/questions/0/title", "empty-title", "the question has no title", },
+				{ LINT_ERROR, "/questions/0/answers/1", "empty-answer", "the answer has neither text nor picture", },
+			},
+		},
+		{
+			name: "correct answers",
+			questions: func(q []PackQuestion) {
+				q[0].Answers[0].Correct = false
+				q[1].Answers[1].Correct = true
+			},
+			problems: []LintProblem{
+				{ LINT_ERROR, "/questions/0/answers", "no-correct-answer", "none of the answers is correct", },
+				{ LINT_WARNING, "/questions/1/answers", "all-correct", "every answer is correct", },
+			},
+		},
+		{
+			name: "duplicates",
+			questions: func(q []PackQuestion) {
+				q[1].Title = "  first   QUESTION "
+				q[1].Answers[1].Text = "right"
+			},
+			problems: []LintProblem{
+				{ LINT_WARNING, "/questions/1/title", "duplicate-question", "the same question is asked at /questions/0", },
+				{ LINT_WARNING, "/questions/1/answers/1", "duplicate-answer", "the answer is the same as /questions/1/answers/0", },
+			},
+		},
+		{
+			name: "values",
+			questions: func(q []PackQuestion) {
+				q[0].Value = 0
+				q[1].Value = MAX_QUESTION_VALUE + 1
+			},
+			problems: []LintProblem{
+				{ LINT_WARNING, "/questions/0/value", "extreme-value", "the value should be between 1 and 10000", },
+				{ LINT_WARNING, "/questions/1/value", "extreme-value", "the value should be between 1 and 10000", },
+			},
+		},
+		{
+			name: "media",
+			questions: func(q []PackQuestion) {
+				q[0].ImgUrl = "file:///etc/passwd"
+				q[0].Media = &PackMedia{ Type: MEDIA_VIDEO, Url: "https://example.com/v.mp4", Start: 5, End: 5, }
+				q[1].Answers[0].ImgUrl = media.Url("a/b.png")
+			},
+			problems: []LintProblem{
+				{ LINT_ERROR, "/questions/0/image_url", "broken-url", "\"file:///etc/passwd\" is not an http or https url", },
+				{ LINT_ERROR, "/questions/0/media/end", "media-range", "the clip ends before it starts", },
+				{ LINT_ERROR, "/questions/1/answers/0/image_url", "broken-url", "\"" + media.Url("a/b.png") + "\" is not an http or https url", },
+			},
+		},
+		{
+			name: "long text",
+			questions: func(q []PackQuestion) {
+				q[0].Title = strings.Repeat("é", MAX_QUESTION_LENGTH + 1)
+				q[1].Answers[1].Text = strings.Repeat("a", MAX_ANSWER_LENGTH + 1)
+			},
+			problems: []LintProblem{
+				{ LINT_WARNING, "/questions/0/title", "long-text", "the title is 301 characters long, more than 300", },
+				{ LINT_WARNING, "/questions/1/answers/1/text", "long-text", "the answer is 151 characters long, more than 150", },
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := PackBody{ Questions: []PackQuestion{ lintQuestion("First question"), lintQuestion("Second question"), }, }
+			tt.questions(body.Questions)
+
+			lint := lintPack(&body)
+			for _, p := range lint.Errors {
+				if p.Severity != LINT_ERROR {
+					t.Errorf("the warning %+v is reported as an error", p)
+				}
+			}
+			for _, p := range lint.Warnings {
+				if p.Severity != LINT_WARNING {
+					t.Errorf("the error %+v is reported as a warning", p)
+				}
+			}
+
+			problems := append(lint.Errors, lint.Warnings...)
+			if !sameProblems(problems, tt.problems) {
+				t.Errorf("problems = %+v, want %+v", problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestLintEmptyPack(t *testing.T) {
+	lint := lintPack(&PackBody{})
+	want := []LintProblem{ { LINT_ERROR, "/questions", "no-questions", "the pack has no questions", }, }
+	if len(lint.Warnings) != 0 || !reflect.DeepEqual(lint.Errors, want) {
+		t.Errorf("lintPack of an empty pack = %+v, want the errors %+v", lint, want)
+	}
+}
+
+func TestLintPackSchema(t *testing.T) {
+	tests := []struct {
+		body  string
+		rules []string
+	}{
+		{ `{}`, []string{ "schema/required", }, },
+		{ `{"questions": []}`, []string{ "schema/minItems", }, },
+		{ `{"questions": [{"title": "Q", "value": 1, "image_url": "ftp://example.com/a.png", "answers": [{"text": "a", "correct": true}, {"text": "b", "correct": false}]}]}`, []string{ "schema/pattern", }, },
+		{ `{"questions": [{"title": "Q", "value": 1, "image_url": "https://example.com/a.png", "answers": [{"text": "a", "correct": true}, {"text": "b", "correct": false}]}]}`, []string{}, },
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		LintPack(w, httptest.NewRequest("POST", "/api/packs/lint", strings.NewReader(tt.body)))
+
+		var lint LintResponse
+		err := json.NewDecoder(w.Body).Decode(&lint)
+		if err != nil {
+			t.Fatalf("LintPack(%s) sent %d: %v", tt.body, w.Code, err)
+		}
+		rules := []string{}
+		for _, e := range lint.Errors {
+			rules = append(rules, e.Rule)
+		}
+		if !reflect.DeepEqual(rules, tt.rules) {
+			t.Errorf("LintPack(%s) broke the rules %v, want %v", tt.body, rules, tt.rules)
+		}
+	}
+}
+
+func containsProblem(problems []LintProblem, p LintProblem) bool {
+	for _, q := range problems {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares the problems ignoring their order.
+func sameProblems(a []LintProblem, b []LintProblem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, p := range a {
+		if !containsProblem(b, p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+	"github.com/detectivekaktus/JGame/internal/validation"
+)
+
+// The tests run without the environment of the server: they get the config
+// they need instead of `.env`, and load the schemas from the root of the
+// project, where the server runs.
+func TestMain(m *testing.M) {
+	config.AppConfig = &config.Config{
+		MaxRoomUsers: 16,
+		MediaBaseUrl: "https://localhost:8080",
+		MediaQuota: 100 << 20,
+	}
+
+	dir, err := os.Getwd()
+	if err == nil {
+		err = os.Chdir("../..")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not change to the root of the project: %v\n", err)
+		os.Exit(1)
+	}
+	validation.LoadSchemas()
+	err = os.Chdir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not change back to %s: %v\n", dir, err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/detectivekaktus/JGame/internal/media"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// The pack authors upload the pictures and clips of their packs as
+// multipart forms with the file in the `file` field, and get back the url
+// to put in the pack. The files are stored by the media package and
+// served by this server. Every file counts towards the quota of its owner:
+// users.media(
+//   media_id      serial primary int,
+//   user_id       int (from users.user),
+//   storage_key   unique varchar(64),
+//   thumbnail_key unique varchar(64),
+//   content_type  varchar(64),
+//   size          bigint (the thumbnail included),
+//   created_at    timestamptz
+// )
+
+type Media struct {
+	Id           int       `json:"id"`
+	Url          string    `json:"url"`
+	ThumbnailUrl string    `json:"thumbnail_url,omitempty"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type MediaListResponse struct {
+	Media []Media `json:"media"`
+	Used  int64   `json:"used"`
+	Quota int64   `json:"quota"`
+}
+
+func scanMedia(row pgx.Row) (Media, error) {
+	var m Media
+	var key string
+	var thumbnailKey *string
+	err := row.Scan(&m.Id, &key, &thumbnailKey, &m.ContentType, &m.Size, &m.CreatedAt)
+	if err != nil {
+		return m, err
+	}
+
+	m.Url = media.Url(key)
+	if thumbnailKey != nil {
+		m.ThumbnailUrl = media.Url(*thumbnailKey)
+	}
+	return m, nil
+}
+
+func usedMediaSpace(conn *pgx.Conn, userId int) (int64, error) {
+	var used int64
+	err := database.QueryRow(conn, "SELECT COALESCE(SUM(size), 0) FROM users.media WHERE user_id = $1",
+		userId).Scan(&used)
+	return used, err
+}
+
+// Removes the files of the media from the storage ignoring the failures,
+// which leave unreachable files behind at worst.
+func deleteMediaFiles(keys ...*string) {
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		err := media.Default.Delete(*key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not delete media file %s: %v\n", *key, err)
+		}
+	}
+}
+
+func UploadMedia(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	// The multipart encoding adds a little on top of the file.
+	r.Body = http.MaxBytesReader(w, r.Body, media.MAX_UPLOAD_SIZE + (1 << 20))
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			httputils.SendErrorMessage(w, http.StatusRequestEntityTooLarge, "Too large",
+				"The file is too large.")
+			return
+		}
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Expected a multipart form with the file in the `file` field.")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not read the file.")
+		return
+	}
+
+	asset, err := media.Process(data)
+	if err == media.ErrUnsupportedType {
+		httputils.SendErrorMessage(w, http.StatusUnsupportedMediaType, "Unsupported media type",
+			"Only JPEG, PNG and GIF images, MP3, WAV and OGG audio, and MP4 and WebM videos can be uploaded.")
+		return
+	} else if err == media.ErrTooLarge {
+		httputils.SendErrorMessage(w, http.StatusRequestEntityTooLarge, "Too large",
+			fmt.Sprintf("Images can be up to %d MB and %d pixels, audio up to %d MB and videos up to %d MB.",
+				media.MAX_IMAGE_SIZE >> 20, media.MAX_IMAGE_PIXELS, media.MAX_AUDIO_SIZE >> 20, media.MAX_VIDEO_SIZE >> 20))
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not process media POST /api/media: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not process the file.")
+		return
+	}
+
+	used, err := usedMediaSpace(conn, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get used media space POST /api/media: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not check the media quota.")
+		return
+	}
+	if used + asset.Size() > config.AppConfig.MediaQuota {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Quota exceeded",
+			fmt.Sprintf("You can store up to %d MB of media. Delete some files first.", config.AppConfig.MediaQuota >> 20))
+		return
+	}
+
+	var thumbnailKey *string
+	err = media.Default.Put(asset.Key, asset.ContentType, asset.Data)
+	if err == nil && asset.Thumbnail != nil {
+		thumbnailKey = &asset.Thumbnail.Key
+		err = media.Default.Put(asset.Thumbnail.Key, asset.Thumbnail.ContentType, asset.Thumbnail.Data)
+	}
+	if err != nil {
+		deleteMediaFiles(&asset.Key, thumbnailKey)
+		fmt.Fprintf(os.Stderr, "Could not store media POST /api/media: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not store the file.")
+		return
+	}
+
+	m, err := scanMedia(database.QueryRow(conn, "INSERT INTO users.media (user_id, storage_key, thumbnail_key, content_type, size) VALUES ($1, $2, $3, $4, $5) RETURNING media_id, storage_key, thumbnail_key, content_type, size, created_at",
+		session.UserId, asset.Key, thumbnailKey, asset.ContentType, asset.Size()))
+	if err != nil {
+		deleteMediaFiles(&asset.Key, thumbnailKey)
+		fmt.Fprintf(os.Stderr, "Could not insert media POST /api/media: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not save the file.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(m)
+}
+
+func GetMedia(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	response := MediaListResponse{ Media: []Media{}, Quota: config.AppConfig.MediaQuota, }
+	rows := database.QueryRows(conn, "SELECT media_id, storage_key, thumbnail_key, content_type, size, created_at FROM users.media WHERE user_id = $1 ORDER BY created_at DESC",
+		session.UserId)
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read media GET /api/media: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read media.")
+			return
+		}
+		response.Media = append(response.Media, m)
+		response.Used += m.Size
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate media GET /api/media: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate media.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Deletes the media of the user. The packs using it are left as they are
+// and show a broken picture or clip.
+func DeleteMedia(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var key string
+	var thumbnailKey *string
+	err := database.QueryRow(conn, "DELETE FROM users.media WHERE media_id = $1 AND user_id = $2 RETURNING storage_key, thumbnail_key",
+		id, session.UserId).Scan(&key, &thumbnailKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"You have no media with the given id.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not delete media DELETE /api/media/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not delete the media.")
+		return
+	}
+
+	deleteMediaFiles(&key, thumbnailKey)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves the stored files. They never change under the same key, so the
+// clients and the proxies can cache them forever.
+func ServeMedia(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	f, err := media.Default.Get(key)
+	if err == media.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get media file GET /media/key: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the file.")
+		return
+	}
+	defer f.Close()
+
+	// The range requests let the players seek in the clips, so the file
+	// must be seekable. Only the local files are, the others are buffered.
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read media file GET /media/key: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read the file.")
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	w.Header().Set("Content-Type", media.ContentType(key))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", "\"" + key + "\"")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
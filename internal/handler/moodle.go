@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Moodle XML keeps the questions as HTML inside <quiz>. The multiple
+// choice and the true/false questions can be imported, the answers with a
+// positive fraction are the correct ones. The default grade of the
+// question times IMPORT_DEFAULT_VALUE is its value. The general feedback
+// is the explanation, its last `Source:` line the source.
+
+const (
+	MOODLE_CATEGORY    = "category"
+	MOODLE_MULTICHOICE = "multichoice"
+	MOODLE_TRUEFALSE   = "truefalse"
+	MOODLE_DESCRIPTION = "description"
+)
+
+type moodleCdata struct {
+	Value string `xml:",cdata"`
+}
+
+type moodleText struct {
+	Format string      `xml:"format,attr,omitempty"`
+	Text   moodleCdata `xml:"text"`
+}
+
+type moodleAnswer struct {
+	Fraction string      `xml:"fraction,attr"`
+	Format   string      `xml:"format,attr,omitempty"`
+	Text     moodleCdata `xml:"text"`
+}
+
+type moodleQuestion struct {
+	XMLName         xml.Name       `xml:"question"`
+	Type            string         `xml:"type,attr"`
+	Name            moodleText     `xml:"name"`
+	QuestionText    moodleText     `xml:"questiontext"`
+	GeneralFeedback moodleText     `xml:"generalfeedback"`
+	DefaultGrade    string         `xml:"defaultgrade,omitempty"`
+	Single          string         `xml:"single,omitempty"`
+	ShuffleAnswers  string         `xml:"shuffleanswers,omitempty"`
+	Answers         []moodleAnswer `xml:"answer"`
+}
+
+type moodleQuiz struct {
+	XMLName   xml.Name         `xml:"quiz"`
+	Questions []moodleQuestion `xml:"question"`
+}
+
+// Reads the text of the Moodle element as HTML unless it's marked as
+// plain text.
+func moodleHtml(t moodleText) string {
+	switch t.Format {
+	case "plain_text", "moodle_auto_format", "markdown":
+		return textToHtml(t.Text.Value)
+	}
+	return t.Text.Value
+}
+
+func parseMoodleQuestion(mq *moodleQuestion, line int, problems *importProblems) (PackQuestion, string) {
+	q := PackQuestion{ Value: IMPORT_DEFAULT_VALUE, }
+	switch mq.Type {
+	case MOODLE_MULTICHOICE, MOODLE_TRUEFALSE:
+	case MOODLE_DESCRIPTION:
+		return q, "descriptions without answers can't be expressed in a pack"
+	case "":
+		problems.add(line, "", "the question has no type")
+		return q, ""
+	default:
+		return q, fmt.Sprintf("%s questions can't be expressed in a pack", mq.Type)
+	}
+
+	questionFromHtml(&q, moodleHtml(mq.QuestionText))
+	q.Explanation, q.Source = explanationFromFeedback(moodleHtml(mq.GeneralFeedback))
+
+	if grade := strings.TrimSpace(mq.DefaultGrade); grade != "" {
+		g, err := strconv.ParseFloat(grade, 64)
+		if err != nil || g < 0 {
+			problems.add(line, "defaultgrade", "the default grade must be a number")
+		} else if g > 0 {
+			q.Value = int(math.Round(g * IMPORT_DEFAULT_VALUE))
+		}
+	}
+
+	for i, a := range mq.Answers {
+		fraction, err := strconv.ParseFloat(strings.TrimSpace(a.Fraction), 64)
+		if err != nil {
+			problems.add(line, "answer", "the fraction of answer %d must be a number", i + 1)
+			continue
+		}
+
+		answer := answerFromHtml(a.Text.Value, fraction > 0)
+		if a.Format == "plain_text" {
+			answer.Text = strings.TrimSpace(a.Text.Value)
+		}
+		switch {
+		case mq.Type != MOODLE_TRUEFALSE:
+		case strings.EqualFold(answer.Text, "true"):
+			answer.Text = "True"
+		case strings.EqualFold(answer.Text, "false"):
+			answer.Text = "False"
+		}
+		q.Answers = append(q.Answers, answer)
+	}
+	return q, ""
+}
+
+func parseMoodle(data []byte) (PackBody, []importSource, importProblems, importProblems) {
+	var problems, unsupported importProblems
+	var sources []importSource
+	body := PackBody{ Questions: []PackQuestion{}, }
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	inQuiz := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			line, _ := decoder.InputPos()
+			var syntaxErr *xml.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				line = syntaxErr.Line
+			}
+			problems.add(line, "", "could not read the XML: %v", err)
+			break
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if !inQuiz {
+			if start.Name.Local != "quiz" {
+				problems.add(1, "", "expected <quiz>, got <%s>", start.Name.Local)
+				break
+			}
+			inQuiz = true
+			continue
+		}
+
+		line, _ := decoder.InputPos()
+		if start.Name.Local != "question" {
+			decoder.Skip()
+			continue
+		}
+
+		var mq moodleQuestion
+		err = decoder.DecodeElement(&mq, &start)
+		if err != nil {
+			problems.add(line, "", "could not read the question: %v", err)
+			break
+		}
+		if mq.Type == MOODLE_CATEGORY {
+			continue
+		}
+
+		before := len(problems)
+		q, reason := parseMoodleQuestion(&mq, line, &problems)
+		if reason != "" {
+			unsupported.add(line, "", "%s", reason)
+			continue
+		}
+		if len(problems) > before {
+			continue
+		}
+		checkImportedQuestion(&problems, "", line, &q)
+		body.Questions = append(body.Questions, q)
+		sources = append(sources, importSource{ Line: line, })
+	}
+
+	if len(body.Questions) == 0 && len(problems) == 0 && len(unsupported) == 0 {
+		problems.add(1, "", "the file has no questions")
+	}
+	return body, sources, problems, unsupported
+}
+
+func writeMoodle(body *PackBody) ([]byte, error) {
+	quiz := moodleQuiz{}
+	for i, q := range body.Questions {
+		mq := moodleQuestion{
+			Type: MOODLE_MULTICHOICE,
+			Name: moodleText{ Text: moodleCdata{ fmt.Sprintf("Question %d", i + 1), }, },
+			QuestionText: moodleText{ Format: "html", Text: moodleCdata{ questionHtml(&q, true), }, },
+			GeneralFeedback: moodleText{ Format: "html", Text: moodleCdata{ questionFeedback(&q), }, },
+			DefaultGrade: fmt.Sprintf("%.7f", float64(q.Value) / IMPORT_DEFAULT_VALUE),
+			Single: "true",
+			ShuffleAnswers: "false",
+		}
+
+		correct := 0
+		for _, a := range q.Answers {
+			if a.Correct {
+				correct++
+			}
+		}
+		if correct > 1 {
+			mq.Single = "false"
+		}
+
+		for _, a := range q.Answers {
+			fraction := 0.0
+			if a.Correct {
+				fraction = 100 / float64(correct)
+			}
+			mq.Answers = append(mq.Answers, moodleAnswer{
+				Fraction: strconv.FormatFloat(fraction, 'f', 5, 64),
+				Format: "html",
+				Text: moodleCdata{ answerHtml(&a), },
+			})
+		}
+		quiz.Questions = append(quiz.Questions, mq)
+	}
+
+	data, err := xml.MarshalIndent(quiz, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
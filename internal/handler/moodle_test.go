@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMoodle(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		questions   []PackQuestion
+		problems    []ImportProblem
+		unsupported []ImportProblem
+	}{
+		{
+			name: "multiple choice and true/false",
+			data: `<?xml version="1.0" encoding="UTF-8"?>
+<quiz>
+  <question type="category"><category><text>$course$/Top</text></category></question>
+  <question type="multichoice">
+    <name><text>Capital</text></name>
+    <questiontext format="html"><text><![CDATA[<p>What is the <b>capital</b> of France?</p>]]></text></questiontext>
+    <generalfeedback format="html"><text><![CDATA[Since 987.<br/>Source: <a href="https://example.com">https://example.com</a>]]></text></generalfeedback>
+    <defaultgrade>2.5</defaultgrade>
+    <answer fraction="100" format="html"><text>Paris</text></answer>
+    <answer fraction="0" format="html"><text>London</text></answer>
+  </question>
+  <question type="truefalse">
+    <questiontext format="plain_text"><text>1 &lt; 2</text></questiontext>
+    <answer fraction="100"><text>true</text></answer>
+    <answer fraction="0"><text>false</text></answer>
+  </question>
+</quiz>
+`,
+			questions: []PackQuestion{
+				{ Title: "What is the capital of France?", Value: 250, Explanation: "Since 987.", Source: "https://example.com", Answers: []PackAnswer{
+					{ Text: "Paris", Correct: true, }, { Text: "London", },
+				}, },
+				{ Title: "1 < 2", Value: IMPORT_DEFAULT_VALUE, Answers: []PackAnswer{
+					{ Text: "True", Correct: true, }, { Text: "False", },
+				}, },
+			},
+		},
+		{
+			name: "unsupported",
+			data: `<quiz>
+<question type="essay"><questiontext><text>Why?</text></questiontext></question>
+<question type="description"><questiontext><text>Read this.</text></questiontext></question>
+</quiz>`,
+			unsupported: []ImportProblem{
+				{ Line: 2, Message: "essay questions can't be expressed in a pack", },
+				{ Line: 3, Message: "descriptions without answers can't be expressed in a pack", },
+			},
+		},
+		{
+			name: "problems",
+			data: `<quiz>
+<question><questiontext><text>No type</text></questiontext></question>
+<question type="multichoice"><questiontext><text>Bad</text></questiontext><defaultgrade>x</defaultgrade><answer fraction="all"><text>a</text></answer></question>
+<question type="multichoice"><questiontext><text>One</text></questiontext><answer fraction="100"><text>a</text></answer></question>
+</quiz>`,
+			problems: []ImportProblem{
+				{ Line: 2, Message: "the question has no type", },
+				{ Line: 3, Column: "defaultgrade", Message: "the default grade must be a number", },
+				{ Line: 3, Column: "answer", Message: "the fraction of answer 1 must be a number", },
+				{ Line: 4, Message: "at least 2 answers are required", },
+			},
+		},
+		{
+			name: "not a quiz",
+			data: `<questions></questions>`,
+			problems: []ImportProblem{ { Line: 1, Message: "expected <quiz>, got <questions>", }, },
+		},
+		{
+			name: "broken xml",
+			data: "<quiz>\n<question type=\"multichoice\">\n</quiz>",
+			problems: []ImportProblem{ { Line: 2, Message: "could not read the question: XML syntax error on line 3: element <question> closed by </quiz>", }, },
+		},
+		{
+			name: "empty",
+			data: `<quiz></quiz>`,
+			problems: []ImportProblem{ { Line: 1, Message: "the file has no questions", }, },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _, problems, unsupported := parseMoodle([]byte(tt.data))
+			if !reflect.DeepEqual([]ImportProblem(problems), tt.problems) {
+				t.Errorf("problems = %+v, want %+v", problems, tt.problems)
+			}
+			if !reflect.DeepEqual([]ImportProblem(unsupported), tt.unsupported) {
+				t.Errorf("unsupported = %+v, want %+v", unsupported, tt.unsupported)
+			}
+			if tt.questions != nil {
+				checkRoundTrip(t, body.Questions, tt.questions)
+			}
+		})
+	}
+}
+
+func TestMoodleRoundTrip(t *testing.T) {
+	pack := formatsPack()
+	data, err := writeMoodle(&pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, problems, unsupported := parseMoodle(data)
+	if len(problems) > 0 || len(unsupported) > 0 {
+		t.Fatalf("problems = %+v, unsupported = %+v", problems, unsupported)
+	}
+	checkRoundTrip(t, body.Questions, pack.Questions)
+}
@@ -4,25 +4,35 @@ package handler
 // Currently the table looks like this, considering all the migrations
 // done in the past:
 // packs.pack(
-//   pack_id primary int,
-//   user_id int (from users.user)
-//   body    json
-//   name    varchar(32)
+//   pack_id      primary int,
+//   user_id      int (from users.user)
+//   body         json
+//   name         varchar(32)
+//   state        varchar(16)
+//   published_at timestamptz
+//   visibility   varchar(16)
+//   revision     int (the number of the latest revision)
+//   forked_from  int (from packs.pack, see fork.go)
 // )
 //
 // The body is defined within /api/pack_schema.json schema file and all
 // the operations on the packs that require creation or modification on
-// packs are compared against the schema.
+// packs are compared against the schema. Every change of the name or the
+// body is saved as a revision too, see revision.go.
+//
+// The packs are created as drafts, visible only to their author. Once
+// published (see publish.go) everyone can browse and play them. The
+// archived packs are still shown by id, so the games played with them
+// keep their pack, but can't be browsed or played anymore. Who can see
+// the pack besides its author is decided by its visibility, see access.go.
 
 import (
-	"context"
-	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/detectivekaktus/JGame/internal/database"
 	"github.com/detectivekaktus/JGame/internal/httputils"
@@ -34,15 +44,135 @@ import (
 
 const MAX_PACKS_RESPONSE = 2 << 5
 
+const (
+	PACK_DRAFT     = "draft"
+	PACK_PUBLISHED = "published"
+	PACK_ARCHIVED  = "archived"
+)
+
+// The columns scanned by scanPack.
+const PACK_COLUMNS = "pack_id, user_id, body, name, state, published_at, visibility, revision, forked_from"
+
 type Pack struct {
 	Id      int             `json:"id"`
 	UserId  int             `json:"user_id"`
 	Name    string          `json:"name"`
 	Body    json.RawMessage `json:"body"`
+	State       string     `json:"state"`
+	PublishedAt *time.Time `json:"published_at"`
+	Visibility  string     `json:"visibility"`
+	// The number of the latest revision. The saves send back the number
+	// of the revision they edited, see revision.go.
+	Revision    int        `json:"revision"`
+	ForkedFrom  *int       `json:"forked_from"`
+	// The number of the forks of the pack, only counted for a single pack.
+	Forks       *int       `json:"forks,omitempty"`
+	// The change note of the revision saved by the request. It's kept
+	// with the revision only.
+	Note    string          `json:"note,omitempty"`
+	// The lint warnings of the body saved by the request, see lint.go.
+	Warnings []LintProblem  `json:"warnings,omitempty"`
+}
+
+func scanPack(row pgx.Row, pack *Pack) error {
+	return row.Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name, &pack.State, &pack.PublishedAt, &pack.Visibility, &pack.Revision, &pack.ForkedFrom)
+}
+
+// Returns whether the user can play the pack. The published packs can be
+// played by everyone who can see them, the drafts only alone, so solo is
+// false for the games with other players.
+func CanPlayPack(conn *pgx.Conn, packId any, userId int, solo bool) (bool, error) {
+	var playable bool
+	err := database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM packs.pack p WHERE p.pack_id = $1 AND (p.state = $2 OR ($3::boolean AND p.state = $4)) AND " + viewablePackSql("p", "$5") + ")",
+		packId, PACK_PUBLISHED, solo, PACK_DRAFT, userId).Scan(&playable)
+	return playable, err
+}
+
+// Returns a message describing the problem with the change note or an
+// empty string.
+func checkRevisionNote(note string) string {
+	if len([]rune(note)) > MAX_REVISION_NOTE {
+		return fmt.Sprintf("note can't be longer than %d characters.", MAX_REVISION_NOTE)
+	}
+	return ""
+}
+
+// The body of the pack as defined by the schema.
+type PackBody struct {
+	Title     string         `json:"title"`
+	Questions []PackQuestion `json:"questions"`
+}
+
+type PackQuestion struct {
+	Title       string       `json:"title"`
+	ImgUrl      string       `json:"image_url,omitempty"`
+	Value       int          `json:"value"`
+	Answers     []PackAnswer `json:"answers"`
+	// Markdown shown once the question is revealed.
+	Explanation string       `json:"explanation,omitempty"`
+	// Link to where the answer comes from.
+	Source      string       `json:"source,omitempty"`
+	Media       *PackMedia   `json:"media,omitempty"`
+}
+
+type PackAnswer struct {
+	Text    string `json:"text"`
+	Correct bool   `json:"correct"`
+	// Answers can be pictures instead of or next to the text.
+	ImgUrl  string `json:"image_url,omitempty"`
+}
+
+const (
+	MEDIA_IMAGE = "image"
+	MEDIA_AUDIO = "audio"
+	MEDIA_VIDEO = "video"
+)
+
+// A picture or a clip played with the question. Start and End are offsets
+// in seconds of the part of the clip to play. Zero End plays the clip to
+// its end.
+type PackMedia struct {
+	Type  string  `json:"type"`
+	Url   string  `json:"url"`
+	Start float64 `json:"start,omitempty"`
+	End   float64 `json:"end,omitempty"`
+}
+
+type SchemaErrorResponse struct {
+	Error    string                   `json:"error"`
+	Message  string                   `json:"message"`
+	Problems []validation.SchemaError `json:"problems"`
+}
+
+// Checks the body of the pack against the schema. Writes the error
+// response with every broken rule and returns false if it doesn't
+// satisfy the schema.
+func ensurePackSchema(w http.ResponseWriter, body json.RawMessage) bool {
+	problems := validation.Validate(validation.PACK_SCHEMA, body)
+	if len(problems) == 0 {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(SchemaErrorResponse{
+		Error: "Malformatted request",
+		Message: "The body parameter does not satisfy the schema.",
+		Problems: problems,
+	})
+	return false
+}
+
+// Inserts the pack with its first revision, which has the note of the
+// pack, and fills in the rest of its fields.
+func insertPack(conn *pgx.Conn, pack *Pack) error {
+	return scanPack(database.QueryRow(conn, "WITH p AS (INSERT INTO packs.pack (user_id, name, body, visibility) VALUES ($1, $2, $3, $4) RETURNING " + PACK_COLUMNS + "), r AS (INSERT INTO packs.revision (pack_id, number, user_id, name, body, note) SELECT pack_id, 1, user_id, name, body, $5::varchar FROM p) SELECT * FROM p",
+		pack.UserId, pack.Name, pack.Body, pack.Visibility, pack.Note), pack)
 }
 
 func CreatePack(w http.ResponseWriter, r *http.Request) {
 	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
 
 	var pack Pack
 	err := json.NewDecoder(r.Body).Decode(&pack)
@@ -52,15 +182,44 @@ func CreatePack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !validation.ValidateAgainstSchema(validation.PACK_SCHEMA, pack.Body) {
+	// The owner decides who can see and edit the pack, so the packs are
+	// only created for the user themselves.
+	if pack.UserId != 0 && pack.UserId != session.UserId {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Can't create a pack owned by another user.")
+		return
+	}
+	pack.UserId = session.UserId
+
+	warnings, ok := ensureValidPack(w, pack.Body)
+	if !ok {
+		return
+	}
+
+	if pack.State != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"The packs are created as drafts. Publish the pack once it's ready.")
+		return
+	}
+
+	if pack.Visibility == "" {
+		pack.Visibility = VISIBILITY_PUBLIC
+	}
+	if !isVisibility(pack.Visibility) {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
-			"The body parameter does not satisfy the schema.")
+			"visibility must be one of private, unlisted, public or shared.")
+		return
+	}
+
+	if msg := checkRevisionNote(pack.Note); msg != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
 		return
 	}
+	if pack.Note == "" {
+		pack.Note = "Created"
+	}
 
-	err = database.QueryRow(conn, "INSERT INTO packs.pack (user_id, name, body) VALUES ($1, $2, $3) RETURNING pack_id",
-		pack.UserId, pack.Name, pack.Body).
-		Scan(&pack.Id)
+	err = insertPack(conn, &pack)
 	if err != nil {
 		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == database.ForeignKeyViolation {
 			httputils.SendErrorMessage(w, http.StatusBadRequest, "User error",
@@ -74,6 +233,9 @@ func CreatePack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	pack.Note = ""
+	pack.Warnings = warnings
+	setRevisionETag(w, pack.Revision)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 
@@ -81,52 +243,73 @@ func CreatePack(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetPack(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	conn := database.GetConnection()
-	defer conn.Close(context.Background())
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
 
 	var pack Pack
-	err := database.QueryRow(conn, "SELECT * FROM packs.pack WHERE pack_id = $1", id).
-		Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name)
+	if !getViewablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	userId := 0
+	if session != nil {
+		userId = session.UserId
+	}
+
+	// Only the forks the user can see are counted, like GetPackForks lists.
+	var forks int
+	err := database.QueryRow(conn, "SELECT COUNT(*) FROM packs.pack p WHERE p.forked_from = $1 AND " + viewablePackSql("p", "$2"),
+		pack.Id, userId).Scan(&forks)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
-				"No pack with given id exists.")
-			return
-		}
-		fmt.Fprintf(os.Stderr, "Could not read packs at GET /api/packs/id: %v", err)
+		fmt.Fprintf(os.Stderr, "Could not count forks at GET /api/packs/id: %v\n", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 			"Could not read pack")
 		return
 	}
+	pack.Forks = &forks
 
+	setRevisionETag(w, pack.Revision)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	json.NewEncoder(w).Encode(pack)
 }
 
-// Can apply `name` filter to the result. Returns max MAX_PACKS_RESPONSE packs.
+// Can apply `name` filter to the result. Returns max MAX_PACKS_RESPONSE
+// published public packs, the packs of the user in any state with
+// `mine=true`, including the packs they co-author, or the packs shared with
+// the user with `shared=true`.
 func GetPacks(w http.ResponseWriter, r *http.Request) {
 	name := "%" + strings.ToLower(r.URL.Query().Get("name")) + "%"
 
-	conn := database.GetConnection()
-	defer conn.Close(context.Background())
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
+
+	mine := r.URL.Query().Get("mine") == "true"
+	shared := r.URL.Query().Get("shared") == "true"
+	if (mine || shared) && session == nil {
+		httputils.SendErrorMessage(w, http.StatusUnauthorized, "Unauthorized",
+			"You must be logged in to see your packs.")
+		return
+	}
 
 	var rows pgx.Rows
-	if name == "" {
-		rows = database.QueryRows(conn, "SELECT * FROM packs.pack LIMIT $1", MAX_PACKS_RESPONSE)
+	if mine {
+		rows = database.QueryRows(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack p WHERE (p.user_id = $1 OR EXISTS (SELECT * FROM packs.author a WHERE a.pack_id = p.pack_id AND a.user_id = $1)) AND LOWER(p.name) ILIKE $2 ORDER BY p.pack_id LIMIT $3",
+			session.UserId, name, MAX_PACKS_RESPONSE)
+	} else if shared {
+		rows = database.QueryRows(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack p WHERE p.visibility = $1 AND p.user_id <> $2 AND NOT EXISTS (SELECT * FROM packs.author a WHERE a.pack_id = p.pack_id AND a.user_id = $2) AND " + viewablePackSql("p", "$2") + " AND LOWER(p.name) ILIKE $3 ORDER BY p.pack_id LIMIT $4",
+			VISIBILITY_SHARED, session.UserId, name, MAX_PACKS_RESPONSE)
 	} else {
-		rows = database.QueryRows(conn, "SELECT * FROM packs.pack WHERE LOWER(name) ILIKE $1 LIMIT $2", name, MAX_PACKS_RESPONSE)
+		rows = database.QueryRows(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack WHERE state = $1 AND visibility = $2 AND LOWER(name) ILIKE $3 LIMIT $4",
+			PACK_PUBLISHED, VISIBILITY_PUBLIC, name, MAX_PACKS_RESPONSE)
 	}
 	defer rows.Close()
 
 	var packs []Pack
 	for rows.Next() {
 		var pack Pack
-		err := rows.Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name)
+		err := scanPack(rows, &pack)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not read packs at GET /api/packs: %v", err)
 			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
@@ -158,23 +341,12 @@ func PutPack(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*Session)
 
 	var pack Pack
-	err := database.QueryRow(conn, "SELECT * FROM packs.pack WHERE pack_id = $1", id).
-		Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not get pack for PUT /api/packs/id: %v\n", err)
-		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
-			"Could not get the pack.")
-		return
-	}
-
-	if pack.UserId != session.UserId {
-		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
-			"Can't modify a pack that is not owned by themselves.")
+	if !getEditablePack(w, r, conn, session, &pack) {
 		return
 	}
 
 	var requestPack Pack 
-	err = json.NewDecoder(r.Body).Decode(&requestPack)
+	err := json.NewDecoder(r.Body).Decode(&requestPack)
 	if err != nil {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
 			"Could not process the body of the request.")
@@ -193,38 +365,68 @@ func PutPack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if requestPack.State != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Publish or archive the pack to change its state.")
+		return
+	}
+
+	if requestPack.Visibility != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Use PUT /api/packs/id/visibility to change the visibility of the pack.")
+		return
+	}
+
 	if strings.TrimSpace(requestPack.Name) == "" {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Missing fields",
 			"name and body fields must be specified on PUT request.")
 		return
 	}
 
-	if !validation.ValidateAgainstSchema(validation.PACK_SCHEMA, requestPack.Body) {
-		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
-			"The body parameter does not satisfy the schema.")
+	warnings, ok := ensureValidPack(w, requestPack.Body)
+	if !ok {
+		return
+	}
+
+	if msg := checkRevisionNote(requestPack.Note); msg != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
+		return
+	}
+
+	// The published packs must stay playable.
+	if pack.State == PACK_PUBLISHED && !ensurePublishable(w, conn, requestPack.Body) {
+		return
+	}
+
+	expected, ok := expectedRevision(w, r, requestPack.Revision)
+	if !ok {
 		return
 	}
 
-	_, err = database.Execute(conn, "UPDATE packs.pack SET body = $1, name = $2 WHERE pack_id = $3",
-		requestPack.Body, requestPack.Name, id)
+	rev, err := saveRevision(conn, id, session.UserId, requestPack.Name, requestPack.Body, requestPack.Note, expected)
 	if err != nil {
+		if err == errRevisionConflict {
+			sendRevisionConflict(w)
+			return
+		}
 		fmt.Fprintf(os.Stderr, "Could not update pack at PUT /api/packs/id: %v", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 			"Could not update pack.")
 		return
 	}
 
+	setRevisionETag(w, rev.Number)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	err = database.QueryRow(conn, "SELECT * FROM packs.pack WHERE pack_id = $1", id).
-		Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name)
+	err = scanPack(database.QueryRow(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack WHERE pack_id = $1", id), &pack)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not get pack for PUT /api/packs/id: %v\n", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 			"Could not get the pack.")
 		return
 	}
+	pack.Warnings = warnings
 
 	json.NewEncoder(w).Encode(pack)
 }
@@ -237,23 +439,12 @@ func PatchPack(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*Session)
 
 	var pack Pack
-	err := database.QueryRow(conn, "SELECT * FROM packs.pack WHERE pack_id = $1", id).
-		Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not get pack for PATCH /api/packs/id: %v\n", err)
-		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
-			"Could not get the pack.")
-		return
-	}
-
-	if pack.UserId != session.UserId {
-		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
-			"Can't modify a pack that is not owned by themselves.")
+	if !getEditablePack(w, r, conn, session, &pack) {
 		return
 	}
 
 	var requestPack Pack 
-	err = json.NewDecoder(r.Body).Decode(&requestPack)
+	err := json.NewDecoder(r.Body).Decode(&requestPack)
 	if err != nil {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
 			"Could not process the body of the request.")
@@ -272,49 +463,77 @@ func PatchPack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var fieldsSb strings.Builder
-	var args []any // check handler/user.go:221
-	fieldsSb.WriteString("UPDATE packs.pack SET ")
+	if requestPack.State != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Publish or archive the pack to change its state.")
+		return
+	}
+
+	if requestPack.Visibility != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Use PUT /api/packs/id/visibility to change the visibility of the pack.")
+		return
+	}
+
+	if strings.TrimSpace(requestPack.Name) == "" && len(requestPack.Body) == 0 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Missing fields",
+			"name or body field must be specified on PATCH request.")
+		return
+	}
 
 	if strings.TrimSpace(requestPack.Name) != "" {
-		args = append(args, requestPack.Name)
-		fieldsSb.WriteString(fmt.Sprintf("name = $%d", len(args)))
+		pack.Name = requestPack.Name
 	}
 
+	var warnings []LintProblem
 	if len(requestPack.Body) != 0 {
-		if !validation.ValidateAgainstSchema(validation.PACK_SCHEMA, requestPack.Body) {
-			httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
-				"The body parameter does not satisfy the schema.")
+		var ok bool
+		warnings, ok = ensureValidPack(w, requestPack.Body)
+		if !ok {
 			return
 		}
-		if len(args) != 0 {
-			fieldsSb.WriteString(", ")
-		}
-		args = append(args, requestPack.Body)
-		fieldsSb.WriteString(fmt.Sprintf("body = $%d", len(args)))
+		pack.Body = requestPack.Body
+	}
+
+	if msg := checkRevisionNote(requestPack.Note); msg != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
+		return
+	}
+
+	// The published packs must stay playable.
+	if pack.State == PACK_PUBLISHED && !ensurePublishable(w, conn, pack.Body) {
+		return
 	}
 
-	args = append(args, id)
-	fieldsSb.WriteString(fmt.Sprintf(" WHERE pack_id = $%d", len(args)))
-	_, err = database.Execute(conn, fieldsSb.String(), args...)
+	expected, ok := expectedRevision(w, r, requestPack.Revision)
+	if !ok {
+		return
+	}
+
+	rev, err := saveRevision(conn, id, session.UserId, pack.Name, pack.Body, requestPack.Note, expected)
 	if err != nil {
+		if err == errRevisionConflict {
+			sendRevisionConflict(w)
+			return
+		}
 		fmt.Fprintf(os.Stderr, "Could not update pack for PATCH /api/packs/id: %v\n", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 			"Could not update pack.")
 		return
 	}
 
+	setRevisionETag(w, rev.Number)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	err = database.QueryRow(conn, "SELECT * FROM packs.pack WHERE pack_id = $1", id).
-		Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name)
+	err = scanPack(database.QueryRow(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack WHERE pack_id = $1", id), &pack)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not get pack for PATCH /api/packs/id: %v\n", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 			"Could not get the pack.")
 		return
 	}
+	pack.Warnings = warnings
 
 	json.NewEncoder(w).Encode(pack)
 }
@@ -327,22 +546,11 @@ func DeletePack(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*Session)
 
 	var pack Pack
-	err := database.QueryRow(conn, "SELECT * FROM packs.pack WHERE pack_id = $1", id).
-		Scan(&pack.Id, &pack.UserId, &pack.Body, &pack.Name)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not get pack for DELETE /api/packs/id: %v\n", err)
-		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
-			"Could not get the pack.")
-		return
-	}
-
-	if pack.UserId != session.UserId {
-		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
-			"Can't modify a pack that is not owned by themselves.")
+	if !getOwnPack(w, r, conn, session, &pack) {
 		return
 	}
 
-	_, err = database.Execute(conn, "DELETE FROM packs.pack WHERE pack_id = $1", id)
+	_, err := database.Execute(conn, "DELETE FROM packs.pack WHERE pack_id = $1", id)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not delete pack at /api/packs/id: %v", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
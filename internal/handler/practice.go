@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/jackc/pgx/v5"
+)
+
+// Practice is played solo over the websocket and doesn't count towards the
+// competitive stats of the user (matches_played and matches_won). It has
+// its own stats and the questions answered wrong are remembered, so they
+// can be practiced again:
+// users.practice_stats(
+//   user_id            primary int (from users.user),
+//   sessions_played    int,
+//   questions_answered int,
+//   correct_answers    int
+// )
+// users.practice_mistake(
+//   user_id    int (from users.user),
+//   pack_id    int (from packs.pack),
+//   question   text,
+//   created_at timestamptz
+// )
+
+type PackMistakes struct {
+	PackId   int `json:"pack_id"`
+	Mistakes int `json:"mistakes"`
+}
+
+type PracticeStatsResponse struct {
+	SessionsPlayed    int            `json:"sessions_played"`
+	QuestionsAnswered int            `json:"questions_answered"`
+	CorrectAnswers    int            `json:"correct_answers"`
+	Mistakes          []PackMistakes `json:"mistakes"`
+}
+
+func GetPracticeStats(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	response := PracticeStatsResponse{ Mistakes: []PackMistakes{} }
+	err := database.QueryRow(conn, "SELECT COALESCE(SUM(sessions_played), 0), COALESCE(SUM(questions_answered), 0), COALESCE(SUM(correct_answers), 0) FROM users.practice_stats WHERE user_id = $1",
+		session.UserId).Scan(&response.SessionsPlayed, &response.QuestionsAnswered, &response.CorrectAnswers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get practice stats GET /api/users/me/practice: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get practice stats.")
+		return
+	}
+
+	rows := database.QueryRows(conn, "SELECT pack_id, COUNT(*) FROM users.practice_mistake WHERE user_id = $1 GROUP BY pack_id ORDER BY pack_id",
+		session.UserId)
+	defer rows.Close()
+
+	for rows.Next() {
+		var mistakes PackMistakes
+		err := rows.Scan(&mistakes.PackId, &mistakes.Mistakes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read mistakes GET /api/users/me/practice: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read mistakes.")
+			return
+		}
+		response.Mistakes = append(response.Mistakes, mistakes)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate mistakes GET /api/users/me/practice: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate mistakes.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,307 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/detectivekaktus/JGame/internal/media"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Publishing a pack checks more than the schema does: every question must
+// be answerable, and the pictures and clips of the pack must be reachable.
+// The media uploaded to this server is looked up in the storage, the rest
+// is requested from its host. The published packs are checked again on
+// every save, so they stay playable.
+
+// How long a media host has to respond and how many of them are asked at
+// the same time.
+const (
+	MEDIA_CHECK_TIMEOUT     = 5 * time.Second
+	MEDIA_CHECK_CONCURRENCY = 8
+)
+
+type PublishErrorResponse struct {
+	Error    string   `json:"error"`
+	Message  string   `json:"message"`
+	Problems []string `json:"problems"`
+}
+
+var errPrivateAddress = errors.New("the address is not public")
+
+// Doesn't let the media checks reach the server itself or the private
+// network it runs in.
+var mediaCheckClient = &http.Client{
+	Timeout: MEDIA_CHECK_TIMEOUT,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: MEDIA_CHECK_TIMEOUT,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// Returns whether the media at the url can be loaded. The hosts that don't
+// support HEAD requests are asked for the first byte instead.
+func mediaReachable(url string) bool {
+	res, err := mediaCheckClient.Head(url)
+	if err == nil && (res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented) {
+		res.Body.Close()
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return false
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		res, err = mediaCheckClient.Do(req)
+	}
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode < 400
+}
+
+// Returns the problems that prevent the pack from being published.
+func checkPublishable(conn *pgx.Conn, rawBody json.RawMessage) ([]string, error) {
+	var body PackBody
+	err := json.Unmarshal(rawBody, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []string{}
+	if len(body.Questions) == 0 {
+		problems = append(problems, "The pack has no questions.")
+	}
+
+	// The places every url is used at, in the order they were found.
+	var urls []string
+	places := make(map[string][]string)
+	addUrl := func(url string, place string) {
+		if url == "" {
+			return
+		}
+		if _, ok := places[url]; !ok {
+			urls = append(urls, url)
+		}
+		places[url] = append(places[url], place)
+	}
+
+	for i, q := range body.Questions {
+		question := fmt.Sprintf("Question %d", i + 1)
+		if strings.TrimSpace(q.Title) == "" {
+			problems = append(problems, question + " has no title.")
+		}
+
+		correct := false
+		for j, a := range q.Answers {
+			correct = correct || a.Correct
+			if strings.TrimSpace(a.Text) == "" && a.ImgUrl == "" {
+				problems = append(problems, fmt.Sprintf("%s: answer %d is empty.", question, j + 1))
+			}
+			addUrl(a.ImgUrl, fmt.Sprintf("%s, answer %d", question, j + 1))
+		}
+		if !correct {
+			problems = append(problems, question + " has no correct answer.")
+		}
+
+		addUrl(q.ImgUrl, question)
+		if q.Media != nil {
+			addUrl(q.Media.Url, question)
+		}
+	}
+
+	// The uploaded media is looked up one by one, since the connection
+	// can't be shared, and the other hosts are asked concurrently.
+	reachable := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MEDIA_CHECK_CONCURRENCY)
+	for _, url := range urls {
+		if key, ok := strings.CutPrefix(url, media.Url("")); ok {
+			var exists bool
+			err := database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM users.media WHERE storage_key = $1 OR thumbnail_key = $1)", key).
+				Scan(&exists)
+			if err != nil {
+				return nil, err
+			}
+			reachable[url] = exists
+			continue
+		}
+
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			ok := mediaReachable(url)
+			<-sem
+
+			mu.Lock()
+			reachable[url] = ok
+			mu.Unlock()
+		}(url)
+	}
+	wg.Wait()
+
+	for _, url := range urls {
+		if !reachable[url] {
+			problems = append(problems, fmt.Sprintf("%s: %s can't be loaded.", strings.Join(places[url], "; "), url))
+		}
+	}
+	return problems, nil
+}
+
+// Checks that the body can be published. Writes the error response and
+// returns false if it can't.
+func ensurePublishable(w http.ResponseWriter, conn *pgx.Conn, body json.RawMessage) bool {
+	problems, err := checkPublishable(conn, body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check the pack for publishing: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not check the pack.")
+		return false
+	}
+	if len(problems) == 0 {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(PublishErrorResponse{
+		Error: "Not publishable",
+		Message: "The pack can't be published until the problems are fixed.",
+		Problems: problems,
+	})
+	return false
+}
+
+// Gets the pack with the id from the path of the request and the role of
+// the user in it. Writes the error response and returns false if the user
+// can't see the pack.
+func getPackWithRole(w http.ResponseWriter, r *http.Request, conn *pgx.Conn, session *Session, pack *Pack) (string, bool) {
+	id := mux.Vars(r)["id"]
+
+	role := ""
+	err := scanPack(database.QueryRow(conn, "SELECT " + PACK_COLUMNS + " FROM packs.pack WHERE pack_id = $1", id), pack)
+	if err == nil {
+		role, err = packRole(conn, pack, session)
+	}
+	if err == nil && role == "" {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No pack with given id exists.")
+			return "", false
+		}
+		fmt.Fprintf(os.Stderr, "Could not get pack %s: %v\n", id, err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the pack.")
+		return "", false
+	}
+	return role, true
+}
+
+// Gets the pack with the id from the path of the request if the user can
+// see it. Writes the error response and returns false otherwise.
+func getViewablePack(w http.ResponseWriter, r *http.Request, conn *pgx.Conn, session *Session, pack *Pack) bool {
+	_, ok := getPackWithRole(w, r, conn, session, pack)
+	return ok
+}
+
+// Same as getViewablePack, but only for the author of the pack.
+func getOwnPack(w http.ResponseWriter, r *http.Request, conn *pgx.Conn, session *Session, pack *Pack) bool {
+	role, ok := getPackWithRole(w, r, conn, session, pack)
+	if !ok {
+		return false
+	}
+
+	if role != ROLE_OWNER {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Can't modify a pack that is not owned by themselves.")
+		return false
+	}
+	return true
+}
+
+func setPackState(w http.ResponseWriter, conn *pgx.Conn, pack *Pack, state string) {
+	err := scanPack(database.QueryRow(conn, "UPDATE packs.pack SET state = $1, published_at = CASE WHEN $1 = $2 THEN COALESCE(published_at, NOW()) ELSE published_at END WHERE pack_id = $3 RETURNING " + PACK_COLUMNS,
+		state, PACK_PUBLISHED, pack.Id), pack)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set state of pack %d: %v\n", pack.Id, err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not update the pack.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(pack)
+}
+
+// Publishes the draft or brings the archived pack back.
+func PublishPack(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getOwnPack(w, r, conn, session, &pack) {
+		return
+	}
+
+	if pack.State == PACK_PUBLISHED {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Conflict",
+			"The pack is already published.")
+		return
+	}
+
+	if !ensurePublishable(w, conn, pack.Body) {
+		return
+	}
+
+	setPackState(w, conn, &pack, PACK_PUBLISHED)
+}
+
+// Hides the pack from browsing and from new games.
+func ArchivePack(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getOwnPack(w, r, conn, session, &pack) {
+		return
+	}
+
+	if pack.State == PACK_ARCHIVED {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Conflict",
+			"The pack is already archived.")
+		return
+	}
+
+	setPackState(w, conn, &pack, PACK_ARCHIVED)
+}
@@ -0,0 +1,404 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IMS QTI 2.1 keeps every question in its own assessmentItem file. They
+// are imported either one at a time or from the zip of a content package,
+// whose imsmanifest.xml lists the items. The items with a single choice
+// interaction can be imported, the choices of the correct response being
+// the correct answers. The normal maximum of the SCORE outcome times
+// IMPORT_DEFAULT_VALUE is the value of the question, the modal feedback
+// its explanation.
+//
+// The packs are exported as content packages, the clips as objects.
+
+const (
+	MAX_IMPORT_FILES = 500
+	QTI_MANIFEST     = "imsmanifest.xml"
+	QTI_NAMESPACE    = "http://www.imsglobal.org/xsd/imsqti_v2p1"
+	QTI_ITEM_TYPE    = "imsqti_item_xmlv2p1"
+)
+
+var qtiChoiceRegexp = regexp.MustCompile(`(?s)<(\w+:)?choiceInteraction\b.*?</(\w+:)?choiceInteraction>`)
+
+// Any element of the item, with its attributes and its children.
+type qtiNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",innerxml"`
+	Nodes   []qtiNode  `xml:",any"`
+}
+
+func (n *qtiNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Returns the descendants of the node with the name, in document order.
+func (n *qtiNode) find(name string) []*qtiNode {
+	var found []*qtiNode
+	for i := range n.Nodes {
+		child := &n.Nodes[i]
+		if child.XMLName.Local == name {
+			found = append(found, child)
+		}
+		found = append(found, child.find(name)...)
+	}
+	return found
+}
+
+// Returns the interactions of the node, which are the questions of QTI.
+func (n *qtiNode) interactions() []*qtiNode {
+	var found []*qtiNode
+	for i := range n.Nodes {
+		child := &n.Nodes[i]
+		if strings.HasSuffix(child.XMLName.Local, "Interaction") {
+			found = append(found, child)
+			continue
+		}
+		found = append(found, child.interactions()...)
+	}
+	return found
+}
+
+type qtiResource struct {
+	Identifier string    `xml:"identifier,attr"`
+	Type       string    `xml:"type,attr"`
+	Href       string    `xml:"href,attr"`
+	Files      []qtiFile `xml:"file"`
+}
+
+type qtiFile struct {
+	Href string `xml:"href,attr"`
+}
+
+type qtiManifest struct {
+	XMLName       xml.Name      `xml:"manifest"`
+	Namespace     string        `xml:"xmlns,attr,omitempty"`
+	Identifier    string        `xml:"identifier,attr,omitempty"`
+	Schema        string        `xml:"metadata>schema,omitempty"`
+	SchemaVersion string        `xml:"metadata>schemaversion,omitempty"`
+	Organizations struct{}      `xml:"organizations"`
+	Resources     []qtiResource `xml:"resources>resource"`
+}
+
+func parseQtiItem(data []byte, file string, problems *importProblems) (PackQuestion, string) {
+	q := PackQuestion{ Value: IMPORT_DEFAULT_VALUE, }
+
+	var item qtiNode
+	err := xml.Unmarshal(data, &item)
+	if err != nil {
+		line := 1
+		if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+			line = syntaxErr.Line
+		}
+		problems.addIn(file, line, "", "could not read the XML: %v", err)
+		return q, ""
+	}
+	if item.XMLName.Local != "assessmentItem" {
+		problems.addIn(file, 1, "", "expected <assessmentItem>, got <%s>", item.XMLName.Local)
+		return q, ""
+	}
+
+	bodies := item.find("itemBody")
+	if len(bodies) == 0 {
+		problems.addIn(file, 1, "", "the item has no itemBody")
+		return q, ""
+	}
+	interactions := bodies[0].interactions()
+	switch {
+	case len(interactions) == 0:
+		return q, "items without interactions can't be expressed in a pack"
+	case len(interactions) > 1:
+		return q, "items with several interactions can't be expressed in a pack"
+	case interactions[0].XMLName.Local != "choiceInteraction":
+		return q, fmt.Sprintf("%s items can't be expressed in a pack", interactions[0].XMLName.Local)
+	}
+	choice := interactions[0]
+
+	title := qtiChoiceRegexp.ReplaceAllString(bodies[0].Content, "")
+	for _, prompt := range choice.find("prompt") {
+		title += "<p>" + prompt.Content + "</p>"
+	}
+	questionFromHtml(&q, title)
+
+	correct := make(map[string]bool)
+	for _, declaration := range item.find("responseDeclaration") {
+		if declaration.attr("identifier") != choice.attr("responseIdentifier") {
+			continue
+		}
+		for _, value := range declaration.find("value") {
+			correct[strings.TrimSpace(value.Content)] = true
+		}
+	}
+
+	for _, outcome := range item.find("outcomeDeclaration") {
+		if outcome.attr("identifier") != "SCORE" || outcome.attr("normalMaximum") == "" {
+			continue
+		}
+		max, err := strconv.ParseFloat(outcome.attr("normalMaximum"), 64)
+		if err != nil || max < 0 {
+			problems.addIn(file, 1, "normalMaximum", "the normal maximum of SCORE must be a number")
+		} else if max > 0 {
+			q.Value = int(math.Round(max * IMPORT_DEFAULT_VALUE))
+		}
+	}
+
+	for _, c := range choice.find("simpleChoice") {
+		q.Answers = append(q.Answers, answerFromHtml(c.Content, correct[c.attr("identifier")]))
+	}
+
+	var feedback []string
+	for _, f := range item.find("modalFeedback") {
+		feedback = append(feedback, f.Content)
+	}
+	q.Explanation, q.Source = explanationFromFeedback(strings.Join(feedback, "<br/>"))
+	return q, ""
+}
+
+// Returns the item files of the zipped content package in their order,
+// which is the one of the manifest if there is one.
+func qtiPackageItems(archive *zip.Reader, problems *importProblems) []*zip.File {
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		files[path.Clean(f.Name)] = f
+	}
+
+	manifest, ok := files[QTI_MANIFEST]
+	if !ok {
+		var items []*zip.File
+		for _, f := range archive.File {
+			if strings.EqualFold(path.Ext(f.Name), ".xml") && !f.FileInfo().IsDir() {
+				items = append(items, f)
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+		return items
+	}
+
+	data, ok := readZipFile(manifest, MAX_IMPORT_SIZE, problems)
+	if !ok {
+		return nil
+	}
+	var m qtiManifest
+	err := xml.Unmarshal(data, &m)
+	if err != nil {
+		problems.addIn(QTI_MANIFEST, 1, "", "could not read the manifest: %v", err)
+		return nil
+	}
+
+	var items []*zip.File
+	for _, resource := range m.Resources {
+		if !strings.HasPrefix(resource.Type, "imsqti_item") {
+			continue
+		}
+		f, ok := files[path.Clean(resource.Href)]
+		if !ok {
+			problems.addIn(QTI_MANIFEST, 1, "", "the item %s is not in the zip", resource.Href)
+			continue
+		}
+		items = append(items, f)
+	}
+	return items
+}
+
+// Reads the file of the zip up to limit bytes. The size the zip claims
+// isn't trusted, the file is cut at the limit anyway.
+func readZipFile(f *zip.File, limit int64, problems *importProblems) ([]byte, bool) {
+	if f.UncompressedSize64 > uint64(limit) {
+		problems.addIn(f.Name, 0, "", "the file can be up to %d KB", limit >> 10)
+		return nil, false
+	}
+	reader, err := f.Open()
+	if err != nil {
+		problems.addIn(f.Name, 0, "", "could not open the file: %v", err)
+		return nil, false
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, limit + 1))
+	if err != nil {
+		problems.addIn(f.Name, 0, "", "could not read the file: %v", err)
+		return nil, false
+	}
+	if int64(len(data)) > limit {
+		problems.addIn(f.Name, 0, "", "the file can be up to %d KB", limit >> 10)
+		return nil, false
+	}
+	return data, true
+}
+
+// Reads the pack from an assessmentItem or from the zip of a content
+// package.
+func parseQti(data []byte) (PackBody, []importSource, importProblems, importProblems) {
+	var problems, unsupported importProblems
+	var sources []importSource
+	body := PackBody{ Questions: []PackQuestion{}, }
+
+	addItem := func(file string, data []byte) {
+		before := len(problems)
+		q, reason := parseQtiItem(data, file, &problems)
+		if reason != "" {
+			unsupported.addIn(file, 1, "", "%s", reason)
+			return
+		}
+		if len(problems) > before {
+			return
+		}
+		checkImportedQuestion(&problems, file, 1, &q)
+		body.Questions = append(body.Questions, q)
+		sources = append(sources, importSource{ File: file, Line: 1, })
+	}
+
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		addItem("", data)
+		return body, sources, problems, unsupported
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		problems.add(0, "", "could not read the zip: %v", err)
+		return body, sources, problems, unsupported
+	}
+	items := qtiPackageItems(archive, &problems)
+	if len(items) > MAX_IMPORT_FILES {
+		problems.add(0, "", "the zip can have up to %d items", MAX_IMPORT_FILES)
+		return body, sources, problems, unsupported
+	}
+
+	for _, f := range items {
+		data, ok := readZipFile(f, MAX_IMPORT_SIZE, &problems)
+		if ok {
+			addItem(f.Name, data)
+		}
+	}
+
+	if len(body.Questions) == 0 && len(problems) == 0 && len(unsupported) == 0 {
+		problems.add(0, "", "the zip has no items")
+	}
+	return body, sources, problems, unsupported
+}
+
+func qtiItem(q *PackQuestion, identifier string) []byte {
+	var b strings.Builder
+	cardinality, maxChoices := "single", 1
+	correct := 0
+	for _, a := range q.Answers {
+		if a.Correct {
+			correct++
+		}
+	}
+	if correct > 1 {
+		cardinality, maxChoices = "multiple", 0
+	}
+
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<assessmentItem xmlns="%s" identifier="%s" title="%s" adaptive="false" timeDependent="false">` + "\n",
+		QTI_NAMESPACE, identifier, html.EscapeString(q.Title))
+
+	fmt.Fprintf(&b, `  <responseDeclaration identifier="RESPONSE" cardinality="%s" baseType="identifier">` + "\n", cardinality)
+	b.WriteString("    <correctResponse>\n")
+	for i, a := range q.Answers {
+		if a.Correct {
+			fmt.Fprintf(&b, "      <value>A%d</value>\n", i + 1)
+		}
+	}
+	b.WriteString("    </correctResponse>\n  </responseDeclaration>\n")
+
+	score := strconv.FormatFloat(float64(q.Value) / IMPORT_DEFAULT_VALUE, 'f', -1, 64)
+	fmt.Fprintf(&b, `  <outcomeDeclaration identifier="SCORE" cardinality="single" baseType="float" normalMaximum="%s">` + "\n", score)
+	b.WriteString("    <defaultValue><value>0</value></defaultValue>\n  </outcomeDeclaration>\n")
+	b.WriteString(`  <outcomeDeclaration identifier="FEEDBACK" cardinality="single" baseType="identifier"/>` + "\n")
+
+	b.WriteString("  <itemBody>\n    " + questionHtml(q, false) + "\n")
+	fmt.Fprintf(&b, `    <choiceInteraction responseIdentifier="RESPONSE" shuffle="false" maxChoices="%d">` + "\n", maxChoices)
+	for i, a := range q.Answers {
+		fmt.Fprintf(&b, `      <simpleChoice identifier="A%d">%s</simpleChoice>` + "\n", i + 1, answerHtml(&a))
+	}
+	b.WriteString("    </choiceInteraction>\n  </itemBody>\n")
+
+	// Scores the correct response and always shows the explanation.
+	fmt.Fprintf(&b, `  <responseProcessing>
+    <responseCondition>
+      <responseIf>
+        <match><variable identifier="RESPONSE"/><correct identifier="RESPONSE"/></match>
+        <setOutcomeValue identifier="SCORE"><baseValue baseType="float">%s</baseValue></setOutcomeValue>
+      </responseIf>
+    </responseCondition>
+    <setOutcomeValue identifier="FEEDBACK"><baseValue baseType="identifier">EXPLANATION</baseValue></setOutcomeValue>
+  </responseProcessing>
+`, score)
+	if feedback := questionFeedback(q); feedback != "" {
+		fmt.Fprintf(&b, `  <modalFeedback outcomeIdentifier="FEEDBACK" showHide="show" identifier="EXPLANATION">%s</modalFeedback>` + "\n", feedback)
+	}
+	b.WriteString("</assessmentItem>\n")
+	return []byte(b.String())
+}
+
+// Returns the zip of the content package with the questions of the pack.
+func writeQti(body *PackBody) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	manifest := qtiManifest{
+		Namespace: "http://www.imsglobal.org/xsd/imscp_v1p1",
+		Identifier: "jgame-pack",
+		Schema: "QTIv2.1 Package",
+		SchemaVersion: "1.0.0",
+	}
+
+	for i, q := range body.Questions {
+		identifier := fmt.Sprintf("item-%03d", i + 1)
+		href := "items/" + identifier + ".xml"
+		manifest.Resources = append(manifest.Resources, qtiResource{
+			Identifier: identifier,
+			Type: QTI_ITEM_TYPE,
+			Href: href,
+			Files: []qtiFile{ { Href: href, }, },
+		})
+
+		f, err := archive.Create(href)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(qtiItem(&q, identifier))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	f, err := archive.Create(QTI_MANIFEST)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(append([]byte(xml.Header), append(data, '\n')...))
+	if err != nil {
+		return nil, err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Returns the zip with the files, in the given order.
+func zipFiles(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		f, err := archive.Create(files[i])
+		if err == nil {
+			_, err = f.Write([]byte(files[i + 1]))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const qtiChoiceItem = `<?xml version="1.0" encoding="UTF-8"?>
+<assessmentItem xmlns="http://www.imsglobal.org/xsd/imsqti_v2p1" identifier="q1" title="Capital">
+  <responseDeclaration identifier="RESPONSE" cardinality="single" baseType="identifier">
+    <correctResponse><value>B</value></correctResponse>
+  </responseDeclaration>
+  <outcomeDeclaration identifier="SCORE" cardinality="single" baseType="float" normalMaximum="3"/>
+  <itemBody>
+    <choiceInteraction responseIdentifier="RESPONSE" maxChoices="1">
+      <prompt>What is the capital of <i>France</i>?</prompt>
+      <simpleChoice identifier="A">London</simpleChoice>
+      <simpleChoice identifier="B">Paris</simpleChoice>
+    </choiceInteraction>
+  </itemBody>
+  <modalFeedback outcomeIdentifier="FEEDBACK" identifier="F" showHide="show">Since 987.</modalFeedback>
+</assessmentItem>`
+
+const qtiTextItem = `<assessmentItem identifier="q2">
+  <itemBody><p>Name it: <textEntryInteraction responseIdentifier="RESPONSE"/></p></itemBody>
+</assessmentItem>`
+
+func TestParseQti(t *testing.T) {
+	capital := PackQuestion{ Title: "What is the capital of France?", Value: 300, Explanation: "Since 987.", Answers: []PackAnswer{
+		{ Text: "London", }, { Text: "Paris", Correct: true, },
+	}, }
+
+	tests := []struct {
+		name        string
+		data        []byte
+		questions   []PackQuestion
+		problems    []ImportProblem
+		unsupported []ImportProblem
+	}{
+		{
+			name: "single item",
+			data: []byte(qtiChoiceItem),
+			questions: []PackQuestion{ capital, },
+		},
+		{
+			name: "zip without manifest",
+			data: zipFiles(t, "b.xml", qtiTextItem, "a.xml", qtiChoiceItem, "readme.txt", "not an item"),
+			questions: []PackQuestion{ capital, },
+			unsupported: []ImportProblem{ { File: "b.xml", Line: 1, Message: "textEntryInteraction items can't be expressed in a pack", }, },
+		},
+		{
+			name: "zip with manifest",
+			data: zipFiles(t,
+				QTI_MANIFEST, `<manifest><resources>
+  <resource identifier="r2" type="imsqti_item_xmlv2p1" href="items/two.xml"/>
+  <resource identifier="r1" type="webcontent" href="items/one.xml"/>
+  <resource identifier="r3" type="imsqti_item_xmlv2p1" href="items/missing.xml"/>
+</resources></manifest>`,
+				"items/one.xml", qtiTextItem,
+				"items/two.xml", qtiChoiceItem),
+			problems: []ImportProblem{ { File: QTI_MANIFEST, Line: 1, Message: "the item items/missing.xml is not in the zip", }, },
+			questions: []PackQuestion{ capital, },
+		},
+		{
+			name: "not an item",
+			data: []byte(`<quiz/>`),
+			problems: []ImportProblem{ { Line: 1, Message: "expected <assessmentItem>, got <quiz>", }, },
+		},
+		{
+			name: "several interactions",
+			data: []byte(`<assessmentItem><itemBody><choiceInteraction/><choiceInteraction/></itemBody></assessmentItem>`),
+			unsupported: []ImportProblem{ { Line: 1, Message: "items with several interactions can't be expressed in a pack", }, },
+		},
+		{
+			name: "zip without items",
+			data: zipFiles(t, "readme.txt", "No items here."),
+			problems: []ImportProblem{ { Message: "the zip has no items", }, },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _, problems, unsupported := parseQti(tt.data)
+			if !reflect.DeepEqual([]ImportProblem(problems), tt.problems) {
+				t.Errorf("problems = %+v, want %+v", problems, tt.problems)
+			}
+			if !reflect.DeepEqual([]ImportProblem(unsupported), tt.unsupported) {
+				t.Errorf("unsupported = %+v, want %+v", unsupported, tt.unsupported)
+			}
+			if tt.questions != nil {
+				checkRoundTrip(t, body.Questions, tt.questions)
+			}
+		})
+	}
+}
+
+func TestQtiRoundTrip(t *testing.T) {
+	pack := formatsPack()
+	data, err := writeQti(&pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, problems, unsupported := parseQti(data)
+	if len(problems) > 0 || len(unsupported) > 0 {
+		t.Fatalf("problems = %+v, unsupported = %+v", problems, unsupported)
+	}
+	checkRoundTrip(t, body.Questions, pack.Questions)
+}
@@ -0,0 +1,406 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Every save of a pack creates a new revision, which never changes
+// afterwards. packs.pack keeps a copy of the latest revision and its
+// number. The edits must tell the number of the revision they were made
+// to, in the If-Match header or the revision field, and fail with a
+// conflict if someone else saved the pack in the meantime. The rooms,
+// challenges and tournaments pin the revision that was the latest when
+// they were created, so editing the pack doesn't change the games played
+// or being played with it. Rolling back saves a copy of an earlier
+// revision as the latest one:
+// packs.revision(
+//   revision_id serial primary int,
+//   pack_id     int (from packs.pack),
+//   number      int (1, 2, ... within the pack),
+//   user_id     int (from users.user, the author),
+//   name        varchar(32),
+//   body        jsonb,
+//   note        varchar(256),
+//   created_at  timestamptz
+// )
+
+const MAX_REVISION_NOTE = 256
+
+type Revision struct {
+	Id        int             `json:"revision_id"`
+	PackId    int             `json:"pack_id"`
+	Number    int             `json:"number"`
+	UserId    *int            `json:"user_id"`
+	Name      string          `json:"name"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	Note      string          `json:"note"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type FieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+const (
+	QUESTION_ADDED   = "added"
+	QUESTION_REMOVED = "removed"
+	QUESTION_CHANGED = "changed"
+)
+
+// The questions are matched by their title. FromIndex and ToIndex are the
+// positions of the question in the two revisions.
+type QuestionChange struct {
+	Change    string        `json:"change"`
+	Title     string        `json:"title"`
+	FromIndex *int          `json:"from_index,omitempty"`
+	ToIndex   *int          `json:"to_index,omitempty"`
+	From      *PackQuestion `json:"from,omitempty"`
+	To        *PackQuestion `json:"to,omitempty"`
+}
+
+type RevisionDiff struct {
+	PackId    int              `json:"pack_id"`
+	From      int              `json:"from"`
+	To        int              `json:"to"`
+	Name      *FieldChange     `json:"name,omitempty"`
+	Title     *FieldChange     `json:"title,omitempty"`
+	Questions []QuestionChange `json:"questions"`
+}
+
+// SQL of the latest revision of the pack given by the parameter `param`.
+func latestRevisionSql(param string) string {
+	return fmt.Sprintf("(SELECT MAX(revision_id) FROM packs.revision WHERE pack_id = %s)", param)
+}
+
+var errRevisionConflict = errors.New("the pack was saved by someone else")
+
+// Saves the name and the body as the new latest revision of the pack and
+// updates the pack. Returns errRevisionConflict if the latest revision is
+// not the expected one, zero expects any, or another revision was saved at
+// the same time.
+func saveRevision(conn *pgx.Conn, packId any, userId int, name string, body json.RawMessage, note string, expected int) (Revision, error) {
+	rev := Revision{ Name: name, Body: body, Note: note, }
+	err := database.QueryRow(conn, "WITH r AS (INSERT INTO packs.revision (pack_id, number, user_id, name, body, note) SELECT $1, COALESCE(MAX(number), 0) + 1, $2::int, $3::varchar, $4::jsonb, $5::varchar FROM packs.revision WHERE pack_id = $1 HAVING $6::int = 0 OR COALESCE(MAX(number), 0) = $6 RETURNING revision_id, pack_id, number, user_id, created_at), p AS (UPDATE packs.pack SET name = $3, body = $4, revision = (SELECT number FROM r) WHERE pack_id = $1 AND EXISTS (SELECT * FROM r)) SELECT * FROM r",
+		packId, userId, name, body, note, expected).Scan(&rev.Id, &rev.PackId, &rev.Number, &rev.UserId, &rev.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rev, errRevisionConflict
+	}
+	if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == database.UniqueViolation {
+		return rev, errRevisionConflict
+	}
+	return rev, err
+}
+
+// Returns the number of the revision the client edited, given by the
+// If-Match header or by the revision field of the body. The edits must say
+// which revision they were made to, so they don't overwrite the ones saved
+// in the meantime. Writes the error response and returns false if the
+// client didn't tell or the header is malformed.
+func expectedRevision(w http.ResponseWriter, r *http.Request, fromBody int) (int, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		if fromBody <= 0 {
+			httputils.SendErrorMessage(w, http.StatusPreconditionRequired, "Precondition required",
+				"Send the ETag of the pack in If-Match or its revision in the body.")
+			return 0, false
+		}
+		return fromBody, true
+	}
+
+	number, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), "\""))
+	if err != nil || number <= 0 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"If-Match must be the ETag of the pack.")
+		return 0, false
+	}
+	return number, true
+}
+
+// Sets the ETag of the pack at the revision.
+func setRevisionETag(w http.ResponseWriter, number int) {
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", number))
+}
+
+func scanRevision(row pgx.Row, rev *Revision) error {
+	return row.Scan(&rev.Id, &rev.PackId, &rev.Number, &rev.UserId, &rev.Name, &rev.Body, &rev.Note, &rev.CreatedAt)
+}
+
+// Gets the revision of the pack with the number. Writes the error response
+// and returns false if there's no such revision.
+func getRevision(w http.ResponseWriter, conn *pgx.Conn, packId string, number string, rev *Revision) bool {
+	err := scanRevision(database.QueryRow(conn, "SELECT * FROM packs.revision WHERE pack_id = $1 AND number = $2", packId, number), rev)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"The pack has no revision with the given number.")
+			return false
+		}
+		fmt.Fprintf(os.Stderr, "Could not get revision %s of pack %s: %v\n", number, packId, err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the revision.")
+		return false
+	}
+	return true
+}
+
+func sendRevisionConflict(w http.ResponseWriter) {
+	httputils.SendErrorMessage(w, http.StatusConflict, "Conflict",
+		"The pack was saved by someone else in the meantime. Reload it and try again.")
+}
+
+// Returns the revisions of the pack from the latest without their bodies.
+func GetRevisions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getViewablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	rows := database.QueryRows(conn, "SELECT revision_id, pack_id, number, user_id, name, note, created_at FROM packs.revision WHERE pack_id = $1 ORDER BY number DESC", id)
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		err := rows.Scan(&rev.Id, &rev.PackId, &rev.Number, &rev.UserId, &rev.Name, &rev.Note, &rev.CreatedAt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read revisions GET /api/packs/id/revisions: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read revisions.")
+			return
+		}
+		revisions = append(revisions, rev)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate revisions GET /api/packs/id/revisions: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate revisions.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(revisions)
+}
+
+func GetRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getViewablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	var rev Revision
+	if !getRevision(w, conn, vars["id"], vars["number"], &rev) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(rev)
+}
+
+// Compares the questions of two revisions by their title. The questions
+// that appear under the same title several times are matched in order.
+func diffQuestions(from []PackQuestion, to []PackQuestion) []QuestionChange {
+	unmatched := make(map[string][]int)
+	for i, q := range from {
+		unmatched[q.Title] = append(unmatched[q.Title], i)
+	}
+
+	changes := []QuestionChange{}
+	for j := range to {
+		toIndex := j
+		indices := unmatched[to[j].Title]
+		if len(indices) == 0 {
+			changes = append(changes, QuestionChange{
+				Change: QUESTION_ADDED,
+				Title: to[j].Title,
+				ToIndex: &toIndex,
+				To: &to[j],
+			})
+			continue
+		}
+
+		fromIndex := indices[0]
+		unmatched[to[j].Title] = indices[1:]
+		if !reflect.DeepEqual(from[fromIndex], to[j]) {
+			changes = append(changes, QuestionChange{
+				Change: QUESTION_CHANGED,
+				Title: to[j].Title,
+				FromIndex: &fromIndex,
+				ToIndex: &toIndex,
+				From: &from[fromIndex],
+				To: &to[j],
+			})
+		}
+	}
+
+	for i := range from {
+		indices := unmatched[from[i].Title]
+		if len(indices) == 0 || indices[0] != i {
+			continue
+		}
+		fromIndex := i
+		unmatched[from[i].Title] = indices[1:]
+		changes = append(changes, QuestionChange{
+			Change: QUESTION_REMOVED,
+			Title: from[i].Title,
+			FromIndex: &fromIndex,
+			From: &from[i],
+		})
+	}
+	return changes
+}
+
+// Compares the revision `from` with the revision `to` of the pack. Requires
+// `from` query parameter, `to` defaults to the latest revision.
+func GetRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	if _, err := strconv.Atoi(query.Get("from")); err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"from must be the number of a revision.")
+		return
+	}
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getViewablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	to := query.Get("to")
+	if to == "" {
+		var latest int
+		err := database.QueryRow(conn, "SELECT COALESCE(MAX(number), 0) FROM packs.revision WHERE pack_id = $1", id).Scan(&latest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get latest revision GET /api/packs/id/diff: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not get the latest revision.")
+			return
+		}
+		to = strconv.Itoa(latest)
+	} else if _, err := strconv.Atoi(to); err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"to must be the number of a revision.")
+		return
+	}
+
+	var fromRev, toRev Revision
+	if !getRevision(w, conn, id, query.Get("from"), &fromRev) || !getRevision(w, conn, id, to, &toRev) {
+		return
+	}
+
+	var fromBody, toBody PackBody
+	err := json.Unmarshal(fromRev.Body, &fromBody)
+	if err == nil {
+		err = json.Unmarshal(toRev.Body, &toBody)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read revision body GET /api/packs/id/diff: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read the revisions.")
+		return
+	}
+
+	diff := RevisionDiff{
+		PackId: fromRev.PackId,
+		From: fromRev.Number,
+		To: toRev.Number,
+		Questions: diffQuestions(fromBody.Questions, toBody.Questions),
+	}
+	if fromRev.Name != toRev.Name {
+		diff.Name = &FieldChange{ From: fromRev.Name, To: toRev.Name, }
+	}
+	if fromBody.Title != toBody.Title {
+		diff.Title = &FieldChange{ From: fromBody.Title, To: toBody.Title, }
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(diff)
+}
+
+// Saves a copy of an earlier revision as the latest revision of the pack.
+func RollbackRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var pack Pack
+	if !getEditablePack(w, r, conn, session, &pack) {
+		return
+	}
+
+	var old Revision
+	if !getRevision(w, conn, id, vars["number"], &old) {
+		return
+	}
+
+	// The old revision was saved under the rules of its time, it must
+	// satisfy the current ones to become the latest revision again.
+	if _, ok := ensureValidPack(w, old.Body); !ok {
+		return
+	}
+	if pack.State == PACK_PUBLISHED && !ensurePublishable(w, conn, old.Body) {
+		return
+	}
+
+	expected, ok := expectedRevision(w, r, 0)
+	if !ok {
+		return
+	}
+
+	rev, err := saveRevision(conn, id, session.UserId, old.Name, old.Body, fmt.Sprintf("Rolled back to revision %d", old.Number), expected)
+	if err != nil {
+		if err == errRevisionConflict {
+			sendRevisionConflict(w)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not save revision POST /api/packs/id/revisions/number/rollback: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not roll back the pack.")
+		return
+	}
+
+	setRevisionETag(w, rev.Number)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(rev)
+}
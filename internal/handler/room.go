@@ -10,31 +10,102 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/detectivekaktus/JGame/internal/config"
 	"github.com/detectivekaktus/JGame/internal/database"
 	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/detectivekaktus/JGame/internal/validation"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5"
 )
 
+// The rooms are stored inside rooms.room PostgreSQL table. Currently the
+// table looks like this, considering all the migrations done in the past:
+// rooms.room(
+//   room_id           primary int,
+//   user_id           int (from users.user),
+//   name              varchar(32),
+//   pack_id           int (from packs.pack),
+//   current_users     int,
+//   password          varchar(32),
+//   settings          jsonb,
+//   state             varchar(16),
+//   created_at        timestamptz,
+//   last_activity     timestamptz,
+//   scheduled_at      timestamptz,
+//   start_on_schedule boolean,
+//   revision_id       int (from packs.revision)
+// )
+//
+// The settings are defined within /api/room_settings_schema.json schema
+// file. They can be changed by the owner only while the room is in the lobby.
+
+type RoomSettings struct {
+	MaxPlayers       int    `json:"max_players"`
+	MinPlayers       int    `json:"min_players"`
+	// Seconds of the countdown that starts the game once everyone is
+	// ready. Zero disables the countdown.
+	AutoStart        int    `json:"auto_start"`
+	GameMode         string `json:"game_mode"`
+	ScoringMode      string `json:"scoring_mode"`
+	// Seconds given to answer a question. Zero means no time limit.
+	QuestionTime     int    `json:"question_time"`
+	ShuffleQuestions bool   `json:"shuffle_questions"`
+	ShuffleAnswers   bool   `json:"shuffle_answers"`
+	AllowSpectators  bool   `json:"allow_spectators"`
+	Visibility       string `json:"visibility"`
+}
+
 type Room struct {
-	Id           int    `json:"room_id"`
-	Name         string `json:"name"`
-	PackId       int    `json:"pack_id"`
-	UserId       int    `json:"user_id"`
-	CurrentUsers int    `json:"current_users"`
-	MaxUsers     int    `json:"max_users"`
-	Password		 string `json:"password"`
+	Id           int          `json:"room_id"`
+	Name         string       `json:"name"`
+	PackId       int          `json:"pack_id"`
+	UserId       int          `json:"user_id"`
+	CurrentUsers int          `json:"current_users"`
+	Password		 string       `json:"password"`
+	Settings     RoomSettings `json:"settings"`
+	State        string       `json:"state"`
+	CreatedAt    time.Time    `json:"created_at"`
+	LastActivity time.Time    `json:"last_activity"`
+	// Set for rooms planned ahead. The lobby opens at this time.
+	ScheduledAt     *time.Time `json:"scheduled_at"`
+	// Whether the game starts by itself shortly after the lobby opens.
+	StartOnSchedule bool       `json:"start_on_schedule"`
+	// The revision of the pack played in the room. Pinned to the latest
+	// revision when the room is created or its pack is changed.
+	RevisionId      *int       `json:"revision_id"`
+}
+
+// The body of POST, PUT and PATCH requests on rooms. The settings are
+// kept raw, so they can be validated against the schema.
+type RoomRequest struct {
+	Id           int             `json:"room_id"`
+	Name         string          `json:"name"`
+	PackId       int             `json:"pack_id"`
+	UserId       int             `json:"user_id"`
+	CurrentUsers int             `json:"current_users"`
+	MaxUsers     int             `json:"max_users"`
+	Password		 string          `json:"password"`
+	Settings     json.RawMessage `json:"settings"`
+	State        string          `json:"state"`
+	ScheduledAt     *time.Time   `json:"scheduled_at"`
+	StartOnSchedule bool         `json:"start_on_schedule"`
 }
 
 // same as the one above, but without Password fields
 type RoomResponse struct {
-	Id           int    `json:"room_id"`
-	Name         string `json:"name"`
-	PackId       int    `json:"pack_id"`
-	UserId       int    `json:"user_id"`
-	CurrentUsers int    `json:"current_users"`
-	MaxUsers     int    `json:"max_users"`
+	Id           int          `json:"room_id"`
+	Name         string       `json:"name"`
+	PackId       int          `json:"pack_id"`
+	UserId       int          `json:"user_id"`
+	CurrentUsers int          `json:"current_users"`
+	MaxUsers     int          `json:"max_users"`
+	Settings     RoomSettings `json:"settings"`
+	State        string       `json:"state"`
+	ScheduledAt     *time.Time `json:"scheduled_at,omitempty"`
+	StartOnSchedule bool       `json:"start_on_schedule"`
+	RevisionId      *int       `json:"revision_id,omitempty"`
 }
 
 type RoomStatusResponse struct {
@@ -42,10 +113,114 @@ type RoomStatusResponse struct {
 }
 
 const (
-	MAX_USERS_IN_ROOM  = 2 << 3
 	MAX_ROOMS_RESPONSE = 2 << 5
+	// How far in the future a room can be scheduled.
+	MAX_SCHEDULE_AHEAD = 30 * 24 * time.Hour
+)
+
+const (
+	ROOM_SCHEDULED = "scheduled"
+	ROOM_LOBBY    = "lobby"
+	ROOM_PLAYING  = "playing"
+	ROOM_FINISHED = "finished"
 )
 
+const (
+	GAME_MODE_CLASSIC       = "classic"
+	GAME_MODE_FIRST_CORRECT = "first_correct"
+
+	SCORING_STANDARD = "standard"
+	SCORING_NEGATIVE = "negative"
+	SCORING_SPEED    = "speed"
+
+	VISIBILITY_PUBLIC   = "public"
+	VISIBILITY_UNLISTED = "unlisted"
+	VISIBILITY_PRIVATE  = "private"
+)
+
+func DefaultRoomSettings() RoomSettings {
+	return RoomSettings{
+		MaxPlayers: config.AppConfig.MaxRoomUsers,
+		MinPlayers: 1,
+		AutoStart: 0,
+		GameMode: GAME_MODE_CLASSIC,
+		ScoringMode: SCORING_STANDARD,
+		QuestionTime: 0,
+		ShuffleQuestions: false,
+		ShuffleAnswers: false,
+		AllowSpectators: false,
+		Visibility: VISIBILITY_PUBLIC,
+	}
+}
+
+// Applies the `raw` settings from the request on top of `settings`. Only
+// the fields present in `raw` are changed. The result is checked against
+// the room settings schema, the server limits and the `players` already in
+// the room, zero for a new one. Returns a message describing the problem
+// or an empty string.
+func applyRoomSettings(settings *RoomSettings, raw json.RawMessage, players int) string {
+	if len(raw) == 0 {
+		return ""
+	}
+
+	if !validation.ValidateAgainstSchema(validation.ROOM_SETTINGS_SCHEMA, raw) {
+		return "The settings parameter does not satisfy the schema."
+	}
+
+	updated := *settings
+	err := json.Unmarshal(raw, &updated)
+	if err != nil {
+		return "Could not process the settings of the room."
+	}
+
+	if updated.MaxPlayers > config.AppConfig.MaxRoomUsers {
+		return fmt.Sprintf("max_players can't be greater than %d.", config.AppConfig.MaxRoomUsers)
+	}
+
+	if updated.MaxPlayers < players {
+		return fmt.Sprintf("max_players can't be less than the %d players already in the room.", players)
+	}
+
+	if updated.MinPlayers > updated.MaxPlayers {
+		return "min_players can't be greater than max_players."
+	}
+
+	*settings = updated
+	return ""
+}
+
+// Inserts the room into rooms.room under a new random id, which is set
+// on `room`. The room plays the latest revision of the pack unless
+// RevisionId is already set.
+func InsertRoom(conn *pgx.Conn, room *Room) error {
+	room.Id = rand.Intn(2 << 15)
+	return database.QueryRow(conn, "INSERT INTO rooms.room (room_id, user_id, name, pack_id, current_users, password, settings, state, scheduled_at, start_on_schedule, revision_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, " + latestRevisionSql("$4") + ")) RETURNING revision_id",
+		room.Id, room.UserId, room.Name, room.PackId, room.CurrentUsers, room.Password, room.Settings, room.State, room.ScheduledAt, room.StartOnSchedule, room.RevisionId).
+		Scan(&room.RevisionId)
+}
+
+// Scans a row of `SELECT * FROM rooms.room` into `room`.
+func scanRoom(row pgx.Row, room *Room) error {
+	room.Settings = DefaultRoomSettings()
+	return row.Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.Password, &room.Settings, &room.State, &room.CreatedAt, &room.LastActivity, &room.ScheduledAt, &room.StartOnSchedule, &room.RevisionId)
+}
+
+func newRoomResponse(room *Room) RoomResponse {
+	return RoomResponse{
+		Id: room.Id,
+		Name: room.Name,
+		PackId: room.PackId,
+		UserId: room.UserId,
+		CurrentUsers: room.CurrentUsers,
+		MaxUsers: room.Settings.MaxPlayers,
+		Settings: room.Settings,
+		State: room.State,
+		ScheduledAt: room.ScheduledAt,
+		StartOnSchedule: room.StartOnSchedule,
+		RevisionId: room.RevisionId,
+	}
+}
+
 func CreateRoom(w http.ResponseWriter, r *http.Request) {
 	conn := r.Context().Value("db_connection").(*pgx.Conn)
 	session := r.Context().Value("session").(*Session)
@@ -65,7 +240,7 @@ func CreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var requestedRoom Room
+	var requestedRoom RoomRequest
 	err = json.NewDecoder(r.Body).Decode(&requestedRoom)
 	if err != nil {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
@@ -74,8 +249,7 @@ func CreateRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var packExists bool
-	err = database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM packs.pack WHERE pack_id = $1)", requestedRoom.PackId).
-		Scan(&packExists)
+	packExists, err = CanPlayPack(conn, requestedRoom.PackId, session.UserId, false)
 	if err != nil {
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 			"Could not retrieve pack associated with the room.")
@@ -84,22 +258,45 @@ func CreateRoom(w http.ResponseWriter, r *http.Request) {
 
 	if !packExists {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
-			"No pack with the given id exists.")
+			"No published pack with the given id exists.")
+		return
+	}
+
+	settings := DefaultRoomSettings()
+	if msg := applyRoomSettings(&settings, requestedRoom.Settings, 0); msg != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
 		return
 	}
 
 	room := &Room{
-		Id: rand.Intn(2 << 15),
 		Name: requestedRoom.Name,
 		PackId: requestedRoom.PackId,
 		UserId: session.UserId,
 		CurrentUsers: 1,
-		MaxUsers: MAX_USERS_IN_ROOM,
 		Password: requestedRoom.Password,
+		Settings: settings,
+		State: ROOM_LOBBY,
+	}
+
+	if requestedRoom.ScheduledAt != nil {
+		now := time.Now()
+		if requestedRoom.ScheduledAt.Before(now) || requestedRoom.ScheduledAt.After(now.Add(MAX_SCHEDULE_AHEAD)) {
+			httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+				"scheduled_at must be in the future, but not more than 30 days ahead.")
+			return
+		}
+
+		scheduledAt := requestedRoom.ScheduledAt.UTC()
+		room.ScheduledAt = &scheduledAt
+		room.StartOnSchedule = requestedRoom.StartOnSchedule
+		room.State = ROOM_SCHEDULED
+	} else if requestedRoom.StartOnSchedule {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"start_on_schedule requires scheduled_at.")
+		return
 	}
 
-	_, err = database.Execute(conn, "INSERT INTO rooms.room (room_id, user_id, name, pack_id, current_users, max_users, password) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		room.Id, room.UserId, room.Name, room.PackId, room.CurrentUsers, room.MaxUsers, room.Password)
+	err = InsertRoom(conn, room)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not create room POST /api/rooms: %v\n", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
@@ -110,21 +307,16 @@ func CreateRoom(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 
-	json.NewEncoder(w).Encode(RoomResponse{
-		Id: room.Id,
-		Name: room.Name,
-		PackId: room.PackId,
-		UserId: room.UserId,
-		CurrentUsers: 0,
-		MaxUsers: room.MaxUsers,
-	})
+	response := newRoomResponse(room)
+	response.CurrentUsers = 0
+	json.NewEncoder(w).Encode(response)
 }
 
 func PutRoom(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var requestedRoom Room
+	var requestedRoom RoomRequest
 	err := json.NewDecoder(r.Body).Decode(&requestedRoom)
 	if err != nil {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
@@ -140,9 +332,10 @@ func PutRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if requestedRoom.UserId != 0 || requestedRoom.Id != 0 ||
-		requestedRoom.CurrentUsers != 0 || requestedRoom.MaxUsers != 0 {
+		requestedRoom.CurrentUsers != 0 || requestedRoom.MaxUsers != 0 || requestedRoom.State != "" ||
+		requestedRoom.ScheduledAt != nil {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Modifying non-editable fields",
-			"user_id, current_users, max_users fields can't be changed via PUT request.")
+			"user_id, current_users, max_users, state, scheduled_at fields can't be changed via PUT request. Use settings.max_players to change the room size.")
 		return
 	}
 
@@ -150,8 +343,7 @@ func PutRoom(w http.ResponseWriter, r *http.Request) {
 	conn := r.Context().Value("db_connection").(*pgx.Conn)
 
 	var room Room
-	err = database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id).
-		Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.MaxUsers, &room.Password)
+	err = scanRoom(database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id), &room)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
@@ -171,8 +363,7 @@ func PutRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var packExists bool
-	err = database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM packs.pack WHERE pack_id = $1)", requestedRoom.PackId).
-		Scan(&packExists)
+	packExists, err = CanPlayPack(conn, requestedRoom.PackId, session.UserId, false)
 	if err != nil {
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 			"Could not retrieve pack associated with the room.")
@@ -181,13 +372,30 @@ func PutRoom(w http.ResponseWriter, r *http.Request) {
 
 	if !packExists {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
-			"No pack with the given id exists.")
+			"No published pack with the given id exists.")
+		return
+	}
+
+	// If the settings are given, PUT replaces them as a whole, so the
+	// fields absent from the request fall back to their default values.
+	settings := room.Settings
+	if len(requestedRoom.Settings) != 0 {
+		if room.State != ROOM_LOBBY && room.State != ROOM_SCHEDULED {
+			httputils.SendErrorMessage(w, http.StatusConflict, "Conflict",
+				"Can't change the settings of a room after the game started.")
+			return
+		}
+		settings = DefaultRoomSettings()
+	}
+	if msg := applyRoomSettings(&settings, requestedRoom.Settings, room.CurrentUsers); msg != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
 		return
 	}
 
-	err = database.QueryRow(conn, "UPDATE rooms.room SET name = $1, pack_id = $2, password = $3 WHERE room_id = $4 RETURNING name, pack_id",
-		requestedRoom.Name, requestedRoom.PackId, requestedRoom.Password, room.Id).
-	Scan(&room.Name, &room.PackId)
+	// The room keeps its revision unless the pack is changed.
+	err = database.QueryRow(conn, "UPDATE rooms.room SET name = $1, pack_id = $2, password = $3, settings = $4, revision_id = CASE WHEN pack_id = $2 THEN revision_id ELSE " + latestRevisionSql("$2") + " END WHERE room_id = $5 RETURNING name, pack_id, settings, revision_id",
+		requestedRoom.Name, requestedRoom.PackId, requestedRoom.Password, settings, room.Id).
+	Scan(&room.Name, &room.PackId, &room.Settings, &room.RevisionId)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not update room from database PUT /api/room/id: %v\n", err)
 		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
@@ -198,21 +406,14 @@ func PutRoom(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(RoomResponse{
-		Id: room.Id,
-		Name: room.Name,
-		PackId: room.PackId,
-		UserId: room.UserId,
-		CurrentUsers: room.CurrentUsers,
-		MaxUsers: room.MaxUsers,
-	})
+	json.NewEncoder(w).Encode(newRoomResponse(&room))
 }
 
 func PatchRoom(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var requestedRoom Room
+	var requestedRoom RoomRequest
 	err := json.NewDecoder(r.Body).Decode(&requestedRoom)
 	if err != nil {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
@@ -221,9 +422,10 @@ func PatchRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if requestedRoom.UserId != 0 || requestedRoom.Id != 0 ||
-		requestedRoom.CurrentUsers != 0 || requestedRoom.MaxUsers != 0 {
+		requestedRoom.CurrentUsers != 0 || requestedRoom.MaxUsers != 0 || requestedRoom.State != "" ||
+		requestedRoom.ScheduledAt != nil {
 		httputils.SendErrorMessage(w, http.StatusBadRequest, "Modifying non-editable fields",
-			"room_id, user_id, current_users, max_users fields can't be changed via PATCH request.")
+			"room_id, user_id, current_users, max_users, state, scheduled_at fields can't be changed via PATCH request. Use settings.max_players to change the room size.")
 		return
 	}
 
@@ -231,8 +433,7 @@ func PatchRoom(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*Session)
 
 	var room Room
-	err = database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id).
-		Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.MaxUsers, &room.Password)
+	err = scanRoom(database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id), &room)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
@@ -262,8 +463,7 @@ func PatchRoom(w http.ResponseWriter, r *http.Request) {
 
 	if requestedRoom.PackId != 0 {
 		var packExists bool
-		err = database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM packs.pack WHERE pack_id = $1)", requestedRoom.PackId).
-			Scan(&packExists)
+		packExists, err = CanPlayPack(conn, requestedRoom.PackId, session.UserId, false)
 		if err != nil {
 			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
 				"Could not retrieve pack associated with the room.")
@@ -272,7 +472,7 @@ func PatchRoom(w http.ResponseWriter, r *http.Request) {
 
 		if !packExists {
 			httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
-				"No pack with the given id exists.")
+				"No published pack with the given id exists.")
 			return
 		}
 
@@ -281,7 +481,8 @@ func PatchRoom(w http.ResponseWriter, r *http.Request) {
 		}
 
 		args = append(args, requestedRoom.PackId)
-		fieldsSb.WriteString(fmt.Sprintf("pack_id = $%d", len(args)))
+		fieldsSb.WriteString(fmt.Sprintf("pack_id = $%d, revision_id = CASE WHEN pack_id = $%d THEN revision_id ELSE %s END",
+			len(args), len(args), latestRevisionSql(fmt.Sprintf("$%d", len(args)))))
 	}
 
 	if strings.ToUpper(strings.TrimSpace(requestedRoom.Password)) != "PASSWORD_UNSET" {
@@ -299,22 +500,42 @@ func PatchRoom(w http.ResponseWriter, r *http.Request) {
 		fieldsSb.WriteString(fmt.Sprintf("password = $%d", len(args)))
 	}
 
+	if len(requestedRoom.Settings) != 0 {
+		if room.State != ROOM_LOBBY && room.State != ROOM_SCHEDULED {
+			httputils.SendErrorMessage(w, http.StatusConflict, "Conflict",
+				"Can't change the settings of a room after the game started.")
+			return
+		}
+
+		settings := room.Settings
+		if msg := applyRoomSettings(&settings, requestedRoom.Settings, room.CurrentUsers); msg != "" {
+			httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
+			return
+		}
+
+		if len(args) != 0 {
+			fieldsSb.WriteString(", ")
+		}
+
+		args = append(args, settings)
+		fieldsSb.WriteString(fmt.Sprintf("settings = $%d", len(args)))
+	}
+
 	args = append(args, id)
-	fieldsSb.WriteString(fmt.Sprintf(" WHERE room_id = $%d RETURNING name, pack_id", len(args)))
+	fieldsSb.WriteString(fmt.Sprintf(" WHERE room_id = $%d RETURNING name, pack_id, settings, revision_id", len(args)))
 	err = database.QueryRow(conn, fieldsSb.String(), args...).
-		Scan(&room.Name, &room.PackId)
+		Scan(&room.Name, &room.PackId, &room.Settings, &room.RevisionId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update room in PATCH /api/rooms/{id}: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal server error",
+			"Could not update room.")
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(RoomResponse{
-		Id: room.Id,
-		Name: room.Name,
-		PackId: room.PackId,
-		UserId: room.UserId,
-		CurrentUsers: room.CurrentUsers,
-		MaxUsers: room.MaxUsers,
-	})
+	json.NewEncoder(w).Encode(newRoomResponse(&room))
 }
 
 func DeleteRoom(w http.ResponseWriter, r *http.Request) {
@@ -325,8 +546,7 @@ func DeleteRoom(w http.ResponseWriter, r *http.Request) {
 	conn := r.Context().Value("db_connection").(*pgx.Conn)
 
 	var room Room
-	err := database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id).
-		Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.MaxUsers, &room.Password)
+	err := scanRoom(database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id), &room)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
@@ -368,12 +588,11 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	conn := database.GetConnection()
-	defer conn.Close(context.Background())
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session, _ := r.Context().Value("session").(*Session)
 
 	var room Room
-	err := database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id).
-		Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.MaxUsers, &room.Password)
+	err := scanRoom(database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id), &room)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
@@ -386,37 +605,55 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userId := 0
+	if session != nil {
+		userId = session.UserId
+	}
+
+	// Private rooms are known only to their owner and the invited players,
+	// who can pass the password of the room in the query.
+	visible, err := CanSeeRoom(conn, room.Id, userId, r.URL.Query().Get("password"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check room GET /api/rooms/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the room with the given id.")
+		return
+	}
+	if !visible {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"No room with given id exists.")
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(RoomResponse{
-		Id: room.Id,
-		Name: room.Name,
-		PackId: room.PackId,
-		UserId: room.UserId,
-		CurrentUsers: room.CurrentUsers,
-		MaxUsers: room.MaxUsers,
-	})
+	json.NewEncoder(w).Encode(newRoomResponse(&room))
 }
 
+// Lists only public rooms. Can apply `name` filter to the result. With
+// `upcoming=true` only scheduled rooms are listed, the soonest first.
 func GetRooms(w http.ResponseWriter, r *http.Request) {
 	name := "%" + strings.ToLower(r.URL.Query().Get("name")) + "%"
+	upcoming := r.URL.Query().Get("upcoming") == "true"
 
 	conn := database.GetConnection()
 	defer conn.Close(context.Background())
 
 	var rows pgx.Rows
-	if name == "" {
-		rows = database.QueryRows(conn, "SELECT * FROM rooms.room LIMIT $1", MAX_PACKS_RESPONSE)
+	if upcoming {
+		rows = database.QueryRows(conn, "SELECT * FROM rooms.room WHERE COALESCE(settings->>'visibility', 'public') = 'public' AND state = $1 AND LOWER(name) ILIKE $2 ORDER BY scheduled_at LIMIT $3", ROOM_SCHEDULED, name, MAX_ROOMS_RESPONSE)
+	} else if name == "" {
+		rows = database.QueryRows(conn, "SELECT * FROM rooms.room WHERE COALESCE(settings->>'visibility', 'public') = 'public' LIMIT $1", MAX_PACKS_RESPONSE)
 	} else {
-		rows = database.QueryRows(conn, "SELECT * FROM rooms.room WHERE LOWER(name) ILIKE $1 LIMIT $2", name, MAX_ROOMS_RESPONSE)
+		rows = database.QueryRows(conn, "SELECT * FROM rooms.room WHERE COALESCE(settings->>'visibility', 'public') = 'public' AND LOWER(name) ILIKE $1 LIMIT $2", name, MAX_ROOMS_RESPONSE)
 	}
 	defer rows.Close()
 
 	var rooms []RoomResponse
 	for rows.Next() {
 		var room Room
-		err := rows.Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.MaxUsers, &room.Password)
+		err := scanRoom(rows, &room)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not read rooms at GET /api/rooms: %v", err)
 			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
@@ -424,14 +661,7 @@ func GetRooms(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		rooms = append(rooms, RoomResponse{
-			Id: room.Id,
-			UserId: room.UserId,
-			Name: room.Name,
-			PackId: room.PackId,
-			CurrentUsers: room.CurrentUsers,
-			MaxUsers: room.MaxUsers,
-		})
+		rooms = append(rooms, newRoomResponse(&room))
 	}
 
 	err := rows.Err()
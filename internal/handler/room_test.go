@@ -0,0 +1,27 @@
+package handler
+
+import "testing"
+
+func TestApplyRoomSettings(t *testing.T) {
+	tests := []struct {
+		raw     string
+		players int
+		ok      bool
+	}{
+		{ ``, 5, true, },
+		{ `{"max_players": 4}`, 0, true, },
+		{ `{"max_players": 4}`, 4, true, },
+		{ `{"max_players": 4}`, 5, false, },
+		{ `{"min_players": 2}`, 5, true, },
+		{ `{"max_players": 17}`, 0, false, },
+		{ `{"max_players": 4, "min_players": 5}`, 0, false, },
+	}
+
+	for _, tt := range tests {
+		settings := DefaultRoomSettings()
+		msg := applyRoomSettings(&settings, []byte(tt.raw), tt.players)
+		if (msg == "") != tt.ok {
+			t.Errorf("applyRoomSettings(%s) with %d players = %q, want ok %v", tt.raw, tt.players, msg, tt.ok)
+		}
+	}
+}
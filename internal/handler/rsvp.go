@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Users can RSVP to the scheduled rooms to get reminded before the lobby
+// opens. The RSVPs are stored inside rooms.rsvp PostgreSQL table:
+// rooms.rsvp(
+//   room_id    int (from rooms.room),
+//   user_id    int (from users.user),
+//   reminded   boolean,
+//   created_at timestamptz
+// )
+
+type RsvpResponse struct {
+	RoomId int  `json:"room_id"`
+	Count  int  `json:"count"`
+	Going  bool `json:"going"`
+}
+
+// Gets the scheduled room the RSVP request is about. The private rooms are
+// known only to the users who can see them, see CanSeeRoom, who can pass
+// the password of the room in the query. Writes the error response and
+// returns false when the room can't be RSVP'd.
+func getScheduledRoom(w http.ResponseWriter, r *http.Request, conn *pgx.Conn, session *Session, id string, room *Room) bool {
+	err := scanRoom(database.QueryRow(conn, "SELECT * FROM rooms.room WHERE room_id = $1", id), room)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No room with given id exists.")
+			return false
+		}
+		fmt.Fprintf(os.Stderr, "Could not get room from database /api/rooms/id/rsvp: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the room with the given id.")
+		return false
+	}
+
+	visible, err := CanSeeRoom(conn, room.Id, session.UserId, r.URL.Query().Get("password"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check room /api/rooms/id/rsvp: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the room with the given id.")
+		return false
+	}
+	if !visible {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"No room with given id exists.")
+		return false
+	}
+
+	if room.State != ROOM_SCHEDULED {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Not scheduled",
+			"Only the rooms that are scheduled for later can be RSVP'd.")
+		return false
+	}
+	return true
+}
+
+func sendRsvpResponse(w http.ResponseWriter, conn *pgx.Conn, roomId int, userId int) {
+	response := RsvpResponse{ RoomId: roomId }
+	err := database.QueryRow(conn, "SELECT COUNT(*), COUNT(*) FILTER (WHERE user_id = $2) > 0 FROM rooms.rsvp WHERE room_id = $1",
+		roomId, userId).Scan(&response.Count, &response.Going)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not count RSVPs /api/rooms/id/rsvp: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not count RSVPs.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetRsvp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	session := r.Context().Value("session").(*Session)
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+
+	var room Room
+	if !getScheduledRoom(w, r, conn, session, id, &room) {
+		return
+	}
+
+	sendRsvpResponse(w, conn, room.Id, session.UserId)
+}
+
+func CreateRsvp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	session := r.Context().Value("session").(*Session)
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+
+	var room Room
+	if !getScheduledRoom(w, r, conn, session, id, &room) {
+		return
+	}
+
+	_, err := database.Execute(conn, "INSERT INTO rooms.rsvp (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		room.Id, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not insert RSVP POST /api/rooms/id/rsvp: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not RSVP to the room.")
+		return
+	}
+
+	sendRsvpResponse(w, conn, room.Id, session.UserId)
+}
+
+func DeleteRsvp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	session := r.Context().Value("session").(*Session)
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+
+	var room Room
+	if !getScheduledRoom(w, r, conn, session, id, &room) {
+		return
+	}
+
+	_, err := database.Execute(conn, "DELETE FROM rooms.rsvp WHERE room_id = $1 AND user_id = $2",
+		room.Id, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not delete RSVP DELETE /api/rooms/id/rsvp: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not cancel the RSVP.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
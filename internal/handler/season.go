@@ -0,0 +1,413 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Seasons are periods of competition defined by the administrators. Next to
+// the lifetime stats of the users, every match finished during a season
+// counts towards the season stats of its players. The season rating starts
+// at SEASON_BASE_RATING and goes up by SEASON_WIN_POINTS for a won match and
+// down by SEASON_LOSS_POINTS for a lost one.
+//
+// Once a season is over, its final standings are archived and the best
+// players get an achievement for it. The seasons can't overlap, so there's
+// at most one current season.
+//
+// The seasons are stored inside the following PostgreSQL tables:
+// users.season(
+//   season_id serial,
+//   name      varchar(32),
+//   starts_at timestamptz,
+//   ends_at   timestamptz,
+//   archived  boolean
+// )
+// users.season_stats(
+//   season_id      int (from users.season),
+//   user_id        int (from users.user),
+//   matches_played int,
+//   matches_won    int,
+//   rating         int
+// )
+// users.season_standing(
+//   season_id      int (from users.season),
+//   user_id        int (from users.user),
+//   rank           int,
+//   matches_played int,
+//   matches_won    int,
+//   rating         int
+// )
+// users.achievement(
+//   achievement_id serial,
+//   user_id        int (from users.user),
+//   kind           varchar(32),
+//   season_id      int (from users.season),
+//   title          text,
+//   created_at     timestamptz
+// )
+
+const (
+	SEASON_BASE_RATING = 1000
+	SEASON_WIN_POINTS = 20
+	SEASON_LOSS_POINTS = 5
+	MAX_STANDINGS_RESPONSE = 2 << 6
+)
+
+const (
+	ACHIEVEMENT_SEASON_CHAMPION = "season_champion"
+	ACHIEVEMENT_SEASON_PODIUM   = "season_podium"
+	ACHIEVEMENT_SEASON_TOP_TEN  = "season_top_ten"
+)
+
+type Season struct {
+	Id       int       `json:"season_id"`
+	Name     string    `json:"name"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Archived bool      `json:"archived"`
+}
+
+type SeasonRequest struct {
+	Name     string     `json:"name"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+}
+
+type SeasonStanding struct {
+	Rank          int    `json:"rank"`
+	UserId        int    `json:"user_id"`
+	Name          string `json:"name"`
+	MatchesPlayed int    `json:"matches_played"`
+	MatchesWon    int    `json:"matches_won"`
+	Rating        int    `json:"rating"`
+}
+
+type SeasonResponse struct {
+	Season
+	Standings []SeasonStanding `json:"standings"`
+}
+
+type Achievement struct {
+	Id        int       `json:"achievement_id"`
+	Kind      string    `json:"kind"`
+	SeasonId  *int      `json:"season_id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func scanSeason(row pgx.Row, season *Season) error {
+	return row.Scan(&season.Id, &season.Name, &season.StartsAt, &season.EndsAt, &season.Archived)
+}
+
+// Returns the id of the season going on right now, or zero if there's none.
+func CurrentSeasonId(conn *pgx.Conn) (int, error) {
+	var id int
+	err := database.QueryRow(conn, "SELECT season_id FROM users.season WHERE starts_at <= NOW() AND ends_at > NOW()").
+		Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Returns the achievement a player gets for finishing a season at `rank`.
+func seasonAchievement(rank int) (string, string) {
+	switch {
+	case rank == 1:
+		return ACHIEVEMENT_SEASON_CHAMPION, "Season champion"
+	case rank <= 3:
+		return ACHIEVEMENT_SEASON_PODIUM, "Season podium"
+	case rank <= 10:
+		return ACHIEVEMENT_SEASON_TOP_TEN, "Season top ten"
+	}
+	return "", ""
+}
+
+// Archives the final standings of the seasons that are over and records
+// the achievements of their best players.
+func ArchiveEndedSeasons(conn *pgx.Conn) {
+	rows := database.QueryRows(conn, "SELECT season_id, name FROM users.season WHERE ends_at <= NOW() AND NOT archived")
+	type ended struct {
+		id   int
+		name string
+	}
+	var seasons []ended
+	for rows.Next() {
+		var s ended
+		if err := rows.Scan(&s.id, &s.name); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read ended seasons: %v\n", err)
+			break
+		}
+		seasons = append(seasons, s)
+	}
+	rows.Close()
+
+	for _, s := range seasons {
+		_, err := database.Execute(conn, "INSERT INTO users.season_standing (season_id, user_id, rank, matches_played, matches_won, rating) SELECT season_id, user_id, ROW_NUMBER() OVER (ORDER BY rating DESC, matches_won DESC, user_id), matches_played, matches_won, rating FROM users.season_stats WHERE season_id = $1 ON CONFLICT DO NOTHING",
+			s.id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not archive season %d: %v\n", s.id, err)
+			continue
+		}
+
+		rows := database.QueryRows(conn, "SELECT user_id, rank FROM users.season_standing WHERE season_id = $1 AND rank <= 10", s.id)
+		type placed struct {
+			userId int
+			rank   int
+		}
+		var best []placed
+		for rows.Next() {
+			var p placed
+			if err := rows.Scan(&p.userId, &p.rank); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not read standings of season %d: %v\n", s.id, err)
+				break
+			}
+			best = append(best, p)
+		}
+		rows.Close()
+
+		for _, p := range best {
+			kind, title := seasonAchievement(p.rank)
+			_, err = database.Execute(conn, "INSERT INTO users.achievement (user_id, kind, season_id, title) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+				p.userId, kind, s.id, fmt.Sprintf("%s of %s", title, s.name))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not record achievement of user %d: %v\n", p.userId, err)
+			}
+		}
+
+		_, err = database.Execute(conn, "UPDATE users.season SET archived = TRUE WHERE season_id = $1", s.id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not archive season %d: %v\n", s.id, err)
+		}
+	}
+}
+
+func CreateSeason(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+
+	var request SeasonRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 32 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"name must be from 1 to 32 characters long.")
+		return
+	}
+
+	if request.StartsAt == nil || request.EndsAt == nil || !request.EndsAt.After(*request.StartsAt) {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"starts_at and ends_at must be given and ends_at must come after starts_at.")
+		return
+	}
+
+	if request.EndsAt.Before(time.Now()) {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Can't create a season that is already over.")
+		return
+	}
+
+	var overlaps bool
+	err = database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM users.season WHERE starts_at < $2 AND ends_at > $1)",
+		request.StartsAt, request.EndsAt).Scan(&overlaps)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check seasons POST /api/seasons: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not check the other seasons.")
+		return
+	}
+
+	if overlaps {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Overlapping seasons",
+			"The season overlaps with another season.")
+		return
+	}
+
+	var season Season
+	err = scanSeason(database.QueryRow(conn, "INSERT INTO users.season (name, starts_at, ends_at) VALUES ($1, $2, $3) RETURNING *",
+		request.Name, request.StartsAt.UTC(), request.EndsAt.UTC()), &season)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create season POST /api/seasons: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not create season.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(season)
+}
+
+func GetSeasons(w http.ResponseWriter, r *http.Request) {
+	conn := database.GetConnection()
+	defer conn.Close(context.Background())
+
+	rows := database.QueryRows(conn, "SELECT * FROM users.season ORDER BY starts_at DESC")
+	defer rows.Close()
+
+	seasons := []Season{}
+	for rows.Next() {
+		var season Season
+		err := scanSeason(rows, &season)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read seasons at GET /api/seasons: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read seasons")
+			return
+		}
+		seasons = append(seasons, season)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate seasons at GET /api/seasons: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate seasons")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(seasons)
+}
+
+// Sends the season with its standings: the archived ones for the seasons
+// that are over, the live ones otherwise. Returns max MAX_STANDINGS_RESPONSE
+// standings.
+func sendSeason(w http.ResponseWriter, conn *pgx.Conn, season Season) {
+	var rows pgx.Rows
+	if season.Archived {
+		rows = database.QueryRows(conn, "SELECT s.rank, s.user_id, u.name, s.matches_played, s.matches_won, s.rating FROM users.season_standing s JOIN users.\"user\" u ON s.user_id = u.user_id WHERE s.season_id = $1 ORDER BY s.rank LIMIT $2",
+			season.Id, MAX_STANDINGS_RESPONSE)
+	} else {
+		rows = database.QueryRows(conn, "SELECT ROW_NUMBER() OVER (ORDER BY s.rating DESC, s.matches_won DESC, s.user_id), s.user_id, u.name, s.matches_played, s.matches_won, s.rating FROM users.season_stats s JOIN users.\"user\" u ON s.user_id = u.user_id WHERE s.season_id = $1 ORDER BY s.rating DESC, s.matches_won DESC, s.user_id LIMIT $2",
+			season.Id, MAX_STANDINGS_RESPONSE)
+	}
+	defer rows.Close()
+
+	response := SeasonResponse{ Season: season, Standings: []SeasonStanding{} }
+	for rows.Next() {
+		var standing SeasonStanding
+		err := rows.Scan(&standing.Rank, &standing.UserId, &standing.Name, &standing.MatchesPlayed, &standing.MatchesWon, &standing.Rating)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read standings of season %d: %v\n", season.Id, err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read standings")
+			return
+		}
+		response.Standings = append(response.Standings, standing)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate standings of season %d: %v\n", season.Id, err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate standings")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetSeason(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conn := database.GetConnection()
+	defer conn.Close(context.Background())
+
+	var season Season
+	err := scanSeason(database.QueryRow(conn, "SELECT * FROM users.season WHERE season_id = $1", id), &season)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No season with given id exists.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not get season GET /api/seasons/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the season with the given id.")
+		return
+	}
+
+	sendSeason(w, conn, season)
+}
+
+func GetCurrentSeason(w http.ResponseWriter, r *http.Request) {
+	conn := database.GetConnection()
+	defer conn.Close(context.Background())
+
+	var season Season
+	err := scanSeason(database.QueryRow(conn, "SELECT * FROM users.season WHERE starts_at <= NOW() AND ends_at > NOW()"), &season)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No season is going on right now.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not get season GET /api/seasons/current: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the current season.")
+		return
+	}
+
+	sendSeason(w, conn, season)
+}
+
+func GetUserAchievements(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conn := database.GetConnection()
+	defer conn.Close(context.Background())
+
+	rows := database.QueryRows(conn, "SELECT achievement_id, kind, season_id, title, created_at FROM users.achievement WHERE user_id = $1 ORDER BY created_at DESC", id)
+	defer rows.Close()
+
+	achievements := []Achievement{}
+	for rows.Next() {
+		var achievement Achievement
+		err := rows.Scan(&achievement.Id, &achievement.Kind, &achievement.SeasonId, &achievement.Title, &achievement.CreatedAt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read achievements at GET /api/users/id/achievements: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read achievements")
+			return
+		}
+		achievements = append(achievements, achievement)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate achievements at GET /api/users/id/achievements: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate achievements")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(achievements)
+}
@@ -0,0 +1,403 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The study queue schedules the questions of the packs the user subscribed
+// to with a SM-2 style algorithm. Every question the user has seen is a
+// card that remembers how well it's known and when it's due again. After
+// reviewing a card the user grades their recall from 0 (blackout) to 5
+// (perfect); grades below 3 start the card over.
+//
+// The cards are stored in the following PostgreSQL tables. Unsubscribing
+// from a pack forgets its cards.
+// users.study_subscription(
+//   user_id    int (from users.user),
+//   pack_id    int (from packs.pack),
+//   created_at timestamptz
+// )
+// users.study_card(
+//   user_id       int (from users.study_subscription),
+//   pack_id       int (from users.study_subscription),
+//   question      text,
+//   repetitions   int,
+//   interval_days int,
+//   ease          real,
+//   due_at        timestamptz,
+//   reviewed_at   timestamptz
+// )
+
+const (
+	STUDY_DEFAULT_LIMIT = 10
+	STUDY_MAX_LIMIT = 2 << 5
+	STUDY_MAX_GRADE = 5
+	STUDY_PASSING_GRADE = 3
+	STUDY_DEFAULT_EASE = 2.5
+	STUDY_MIN_EASE = 1.3
+)
+
+type StudyCard struct {
+	Repetitions  int       `json:"repetitions"`
+	IntervalDays int       `json:"interval_days"`
+	Ease         float64   `json:"ease"`
+	DueAt        time.Time `json:"due_at"`
+}
+
+type StudyItem struct {
+	PackId   int          `json:"pack_id"`
+	Question PackQuestion `json:"question"`
+	// Nil for the questions that were never reviewed.
+	Card     *StudyCard   `json:"card"`
+}
+
+type StudyReviewRequest struct {
+	PackId   int    `json:"pack_id"`
+	Question string `json:"question"`
+	Grade    *int   `json:"grade"`
+}
+
+type StudySubscription struct {
+	PackId    int       `json:"pack_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Due       int       `json:"due"`
+}
+
+// Returns the card after a review with `grade`, as the SM-2 algorithm does.
+func reviewCard(card StudyCard, grade int, now time.Time) StudyCard {
+	if grade < STUDY_PASSING_GRADE {
+		card.Repetitions = 0
+		card.IntervalDays = 1
+	} else {
+		switch card.Repetitions {
+		case 0:
+			card.IntervalDays = 1
+		case 1:
+			card.IntervalDays = 6
+		default:
+			card.IntervalDays = int(math.Round(float64(card.IntervalDays) * card.Ease))
+		}
+		card.Repetitions++
+	}
+
+	q := float64(STUDY_MAX_GRADE - grade)
+	card.Ease = max(card.Ease + 0.1 - q * (0.08 + q * 0.02), STUDY_MIN_EASE)
+	card.DueAt = now.AddDate(0, 0, card.IntervalDays)
+	return card
+}
+
+// Loads the body of the pack if the user can still see it, the pack may
+// have been hidden since they subscribed.
+func loadPackBody(conn *pgx.Conn, packId int, userId int) (PackBody, error) {
+	var body PackBody
+	var raw json.RawMessage
+	err := database.QueryRow(conn, "SELECT p.body FROM packs.pack p WHERE p.pack_id = $1 AND " + viewablePackSql("p", "$2"), packId, userId).Scan(&raw)
+	if err != nil {
+		return body, err
+	}
+	err = json.Unmarshal(raw, &body)
+	return body, err
+}
+
+// Returns up to `limit` questions to study: the due cards first, the most
+// overdue ones first, and then the questions never reviewed. Can apply
+// `limit` query parameter, max STUDY_MAX_LIMIT.
+func GetStudyNext(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	limit := STUDY_DEFAULT_LIMIT
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > STUDY_MAX_LIMIT {
+			httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+				"limit must be a positive number not greater than 64.")
+			return
+		}
+	}
+
+	type cardKey struct {
+		packId   int
+		question string
+	}
+	// Every question of the subscribed packs that has a card, due or not.
+	reviewed := make(map[cardKey]bool)
+	due := make(map[cardKey]StudyCard)
+	var dueOrder []cardKey
+
+	rows := database.QueryRows(conn, "SELECT pack_id, question, repetitions, interval_days, ease, due_at FROM users.study_card WHERE user_id = $1 ORDER BY due_at",
+		session.UserId)
+	for rows.Next() {
+		var key cardKey
+		var card StudyCard
+		err := rows.Scan(&key.packId, &key.question, &card.Repetitions, &card.IntervalDays, &card.Ease, &card.DueAt)
+		if err != nil {
+			break
+		}
+		reviewed[key] = true
+		if !card.DueAt.After(time.Now()) {
+			due[key] = card
+			dueOrder = append(dueOrder, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read study cards GET /api/study/next: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read study cards.")
+		return
+	}
+
+	var packIds []int
+	rows = database.QueryRows(conn, "SELECT s.pack_id FROM users.study_subscription s JOIN packs.pack p ON s.pack_id = p.pack_id WHERE s.user_id = $1 AND " + viewablePackSql("p", "$1") + " ORDER BY s.created_at", session.UserId)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			break
+		}
+		packIds = append(packIds, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read subscriptions GET /api/study/next: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read subscriptions.")
+		return
+	}
+
+	questions := make(map[cardKey]PackQuestion)
+	var fresh []cardKey
+	for _, id := range packIds {
+		body, err := loadPackBody(conn, id, session.UserId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load pack %d GET /api/study/next: %v\n", id, err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not load the subscribed packs.")
+			return
+		}
+		for _, q := range body.Questions {
+			key := cardKey{ id, q.Title }
+			questions[key] = q
+			if !reviewed[key] {
+				fresh = append(fresh, key)
+			}
+		}
+	}
+
+	items := []StudyItem{}
+	// The cards of the questions that are gone from their pack are skipped.
+	for _, key := range dueOrder {
+		if len(items) == limit {
+			break
+		}
+		q, ok := questions[key]
+		if !ok {
+			continue
+		}
+		card := due[key]
+		items = append(items, StudyItem{ PackId: key.packId, Question: q, Card: &card })
+	}
+	for _, key := range fresh {
+		if len(items) == limit {
+			break
+		}
+		items = append(items, StudyItem{ PackId: key.packId, Question: questions[key] })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(items)
+}
+
+// Records the recall grade of a question and schedules its next review.
+func PostStudyReview(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var request StudyReviewRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	if request.Grade == nil || *request.Grade < 0 || *request.Grade > STUDY_MAX_GRADE {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"grade must be a number from 0 to 5.")
+		return
+	}
+
+	var subscribed bool
+	err = database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM users.study_subscription WHERE user_id = $1 AND pack_id = $2)",
+		session.UserId, request.PackId).Scan(&subscribed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check subscription POST /api/study/next: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not check the subscription.")
+		return
+	}
+	if !subscribed {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"Not subscribed to the pack.")
+		return
+	}
+
+	body, err := loadPackBody(conn, request.PackId, session.UserId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"The pack is no longer shared with you.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not load pack POST /api/study/next: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not load the pack.")
+		return
+	}
+
+	found := false
+	for _, q := range body.Questions {
+		if q.Title == request.Question {
+			found = true
+			break
+		}
+	}
+	if !found {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"No question with the given title exists in the pack.")
+		return
+	}
+
+	card := StudyCard{ Ease: STUDY_DEFAULT_EASE }
+	err = database.QueryRow(conn, "SELECT repetitions, interval_days, ease, due_at FROM users.study_card WHERE user_id = $1 AND pack_id = $2 AND question = $3",
+		session.UserId, request.PackId, request.Question).Scan(&card.Repetitions, &card.IntervalDays, &card.Ease, &card.DueAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "Could not get study card POST /api/study/next: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the study card.")
+		return
+	}
+
+	card = reviewCard(card, *request.Grade, time.Now())
+	_, err = database.Execute(conn, "INSERT INTO users.study_card (user_id, pack_id, question, repetitions, interval_days, ease, due_at) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (user_id, pack_id, question) DO UPDATE SET repetitions = $4, interval_days = $5, ease = $6, due_at = $7, reviewed_at = NOW()",
+		session.UserId, request.PackId, request.Question, card.Repetitions, card.IntervalDays, card.Ease, card.DueAt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not save study card POST /api/study/next: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not save the study card.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(card)
+}
+
+// Lists the packs the user is subscribed to with the number of due cards.
+func GetStudySubscriptions(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	rows := database.QueryRows(conn, "SELECT s.pack_id, p.name, s.created_at, (SELECT COUNT(*) FROM users.study_card c WHERE c.user_id = s.user_id AND c.pack_id = s.pack_id AND c.due_at <= NOW()) FROM users.study_subscription s JOIN packs.pack p ON s.pack_id = p.pack_id WHERE s.user_id = $1 AND " + viewablePackSql("p", "$1") + " ORDER BY s.created_at",
+		session.UserId)
+	defer rows.Close()
+
+	subscriptions := []StudySubscription{}
+	for rows.Next() {
+		var subscription StudySubscription
+		err := rows.Scan(&subscription.PackId, &subscription.Name, &subscription.CreatedAt, &subscription.Due)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read subscriptions GET /api/study/packs: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read subscriptions.")
+			return
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate subscriptions GET /api/study/packs: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate subscriptions.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+func SubscribeStudyPack(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	playable, err := CanPlayPack(conn, id, session.UserId, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check pack POST /api/study/packs/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the pack.")
+		return
+	}
+	if !playable {
+		httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+			"No pack with given id exists.")
+		return
+	}
+
+	_, err = database.Execute(conn, "INSERT INTO users.study_subscription (user_id, pack_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		session.UserId, id)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == database.ForeignKeyViolation {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No pack with given id exists.")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Could not subscribe POST /api/study/packs/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not subscribe to the pack.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UnsubscribeStudyPack(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	_, err := database.Execute(conn, "DELETE FROM users.study_subscription WHERE user_id = $1 AND pack_id = $2",
+		session.UserId, id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not unsubscribe DELETE /api/study/packs/id: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not unsubscribe from the pack.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
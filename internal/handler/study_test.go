@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReviewCard(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		card  StudyCard
+		grade int
+		want  StudyCard
+	}{
+		{
+			name: "first perfect review",
+			card: StudyCard{ Ease: STUDY_DEFAULT_EASE, },
+			grade: 5,
+			want: StudyCard{ Repetitions: 1, IntervalDays: 1, Ease: 2.6, },
+		},
+		{
+			name: "second review",
+			card: StudyCard{ Repetitions: 1, IntervalDays: 1, Ease: 2.6, },
+			grade: 4,
+			want: StudyCard{ Repetitions: 2, IntervalDays: 6, Ease: 2.6, },
+		},
+		{
+			name: "the interval grows by the ease",
+			card: StudyCard{ Repetitions: 2, IntervalDays: 6, Ease: 2.6, },
+			grade: 3,
+			want: StudyCard{ Repetitions: 3, IntervalDays: 16, Ease: 2.46, },
+		},
+		{
+			name: "a failed review starts over",
+			card: StudyCard{ Repetitions: 5, IntervalDays: 30, Ease: 2, },
+			grade: 2,
+			want: StudyCard{ Repetitions: 0, IntervalDays: 1, Ease: 1.68, },
+		},
+		{
+			name: "the ease has a floor",
+			card: StudyCard{ Repetitions: 3, IntervalDays: 10, Ease: 1.4, },
+			grade: 0,
+			want: StudyCard{ Repetitions: 0, IntervalDays: 1, Ease: STUDY_MIN_EASE, },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			card := reviewCard(tt.card, tt.grade, now)
+			if card.Repetitions != tt.want.Repetitions || card.IntervalDays != tt.want.IntervalDays ||
+				math.Abs(card.Ease - tt.want.Ease) > 1e-9 {
+				t.Errorf("reviewCard(%+v, %d) = %+v, want %+v", tt.card, tt.grade, card, tt.want)
+			}
+			if due := now.AddDate(0, 0, tt.want.IntervalDays); !card.DueAt.Equal(due) {
+				t.Errorf("the card is due at %v, want %v", card.DueAt, due)
+			}
+		})
+	}
+}
@@ -0,0 +1,648 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/detectivekaktus/JGame/internal/notification"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Tournaments are played in rounds across multiple rooms. The players
+// register while the tournament is open, and every time the owner starts a
+// round the remaining players are seeded into rooms of room_size players
+// at most. The top `advance` players of each room advance to the next
+// round, and the round played in a single room is the final, whose winner
+// wins the tournament. The rooms report their rankings back once the game
+// is over (see websocket.reportTournamentMatch).
+//
+// The first round is seeded by the rating of the players, the next ones by
+// the score they made in the previous round. The seeds are snaked across
+// the rooms, so every room gets a fair share of strong players. A player
+// left alone in a room advances without playing.
+//
+// A round can't start before every match of the previous one is finished.
+// The matches whose room was closed before the game was over are abandoned
+// and nobody advances from them.
+//
+// The tournaments are stored inside the following PostgreSQL tables:
+// rooms.tournament(
+//   tournament_id serial,
+//   user_id       int (from users.user),
+//   name          varchar(32),
+//   pack_id       int (from packs.pack),
+//   settings      jsonb,
+//   room_size     int,
+//   advance       int,
+//   state         varchar(16),
+//   current_round int,
+//   winner_id     int (from users.user),
+//   created_at    timestamptz,
+//   revision_id   int (from packs.revision)
+// )
+// rooms.tournament_player(
+//   tournament_id int (from rooms.tournament),
+//   user_id       int (from users.user),
+//   registered_at timestamptz
+// )
+// rooms.tournament_match(
+//   tournament_id int (from rooms.tournament),
+//   round         int,
+//   slot          int,
+//   room_id       int,
+//   state         varchar(16)
+// )
+// rooms.tournament_entry(
+//   tournament_id int (from rooms.tournament_match),
+//   round         int (from rooms.tournament_match),
+//   slot          int (from rooms.tournament_match),
+//   user_id       int (from users.user),
+//   score         int,
+//   rank          int,
+//   advanced      boolean
+// )
+
+const (
+	MAX_TOURNAMENTS_RESPONSE = 2 << 5
+)
+
+const (
+	TOURNAMENT_REGISTRATION = "registration"
+	TOURNAMENT_RUNNING      = "running"
+	TOURNAMENT_FINISHED     = "finished"
+)
+
+const (
+	MATCH_PLAYING   = "playing"
+	MATCH_FINISHED  = "finished"
+	MATCH_ABANDONED = "abandoned"
+)
+
+type Tournament struct {
+	Id           int          `json:"tournament_id"`
+	UserId       int          `json:"user_id"`
+	Name         string       `json:"name"`
+	PackId       int          `json:"pack_id"`
+	Settings     RoomSettings `json:"settings"`
+	RoomSize     int          `json:"room_size"`
+	Advance      int          `json:"advance"`
+	State        string       `json:"state"`
+	CurrentRound int          `json:"current_round"`
+	WinnerId     *int         `json:"winner_id"`
+	CreatedAt    time.Time    `json:"created_at"`
+	// The revision of the pack played in every round.
+	RevisionId   *int         `json:"revision_id"`
+}
+
+type TournamentRequest struct {
+	Name     string          `json:"name"`
+	PackId   int             `json:"pack_id"`
+	Settings json.RawMessage `json:"settings"`
+	RoomSize int             `json:"room_size"`
+	Advance  int             `json:"advance"`
+}
+
+type TournamentEntry struct {
+	UserId   int    `json:"user_id"`
+	Name     string `json:"name"`
+	Score    *int   `json:"score"`
+	Rank     *int   `json:"rank"`
+	Advanced bool   `json:"advanced"`
+}
+
+type TournamentMatch struct {
+	Slot    int               `json:"slot"`
+	RoomId  *int              `json:"room_id"`
+	State   string            `json:"state"`
+	Entries []TournamentEntry `json:"entries"`
+}
+
+type TournamentRound struct {
+	Round   int               `json:"round"`
+	Matches []TournamentMatch `json:"matches"`
+}
+
+type BracketResponse struct {
+	Tournament
+	Players []int             `json:"players"`
+	Rounds  []TournamentRound `json:"rounds"`
+}
+
+// The columns scanned by scanTournament.
+const TOURNAMENT_COLUMNS = "tournament_id, user_id, name, pack_id, settings, room_size, advance, state, current_round, winner_id, created_at, revision_id"
+
+func scanTournament(row pgx.Row, t *Tournament) error {
+	return row.Scan(&t.Id, &t.UserId, &t.Name, &t.PackId, &t.Settings, &t.RoomSize, &t.Advance,
+		&t.State, &t.CurrentRound, &t.WinnerId, &t.CreatedAt, &t.RevisionId)
+}
+
+// Gets the tournament with the id from the path of the request. Writes the
+// error response and returns false if there's no such tournament.
+func getTournament(w http.ResponseWriter, r *http.Request, conn *pgx.Conn, t *Tournament) bool {
+	id := mux.Vars(r)["id"]
+
+	err := scanTournament(database.QueryRow(conn, "SELECT " + TOURNAMENT_COLUMNS + " FROM rooms.tournament WHERE tournament_id = $1", id), t)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			httputils.SendErrorMessage(w, http.StatusNotFound, "Not found",
+				"No tournament with given id exists.")
+			return false
+		}
+		fmt.Fprintf(os.Stderr, "Could not get tournament %s: %v\n", r.URL.Path, err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the tournament with the given id.")
+		return false
+	}
+	return true
+}
+
+func CreateTournament(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var request TournamentRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"Could not process the body of the request.")
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 32 {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"name must be from 1 to 32 characters long.")
+		return
+	}
+
+	if request.RoomSize < 2 || request.RoomSize > config.AppConfig.MaxRoomUsers {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"room_size must be between 2 and the max players allowed by the server.")
+		return
+	}
+
+	if request.Advance < 1 || request.Advance >= request.RoomSize {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"advance must be at least 1 and less than room_size.")
+		return
+	}
+
+	var packExists bool
+	packExists, err = CanPlayPack(conn, request.PackId, session.UserId, false)
+	if err != nil {
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not retrieve pack associated with the tournament.")
+		return
+	}
+
+	if !packExists {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request",
+			"No published pack with the given id exists.")
+		return
+	}
+
+	settings := DefaultRoomSettings()
+	if msg := applyRoomSettings(&settings, request.Settings, 0); msg != "" {
+		httputils.SendErrorMessage(w, http.StatusBadRequest, "Malformatted request", msg)
+		return
+	}
+
+	var t Tournament
+	err = scanTournament(database.QueryRow(conn, "INSERT INTO rooms.tournament (user_id, name, pack_id, settings, room_size, advance, revision_id) VALUES ($1, $2, $3, $4, $5, $6, " + latestRevisionSql("$3") + ") RETURNING " + TOURNAMENT_COLUMNS,
+		session.UserId, request.Name, request.PackId, settings, request.RoomSize, request.Advance), &t)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create tournament POST /api/tournaments: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not create tournament.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(t)
+}
+
+// Lists the latest tournaments. Returns max MAX_TOURNAMENTS_RESPONSE
+// tournaments.
+func GetTournaments(w http.ResponseWriter, r *http.Request) {
+	conn := database.GetConnection()
+	defer conn.Close(context.Background())
+
+	rows := database.QueryRows(conn, "SELECT " + TOURNAMENT_COLUMNS + " FROM rooms.tournament ORDER BY created_at DESC LIMIT $1", MAX_TOURNAMENTS_RESPONSE)
+	defer rows.Close()
+
+	tournaments := []Tournament{}
+	for rows.Next() {
+		var t Tournament
+		err := scanTournament(rows, &t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read tournaments at GET /api/tournaments: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not read tournaments")
+			return
+		}
+		tournaments = append(tournaments, t)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not iterate tournaments at GET /api/tournaments: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not iterate tournaments")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(tournaments)
+}
+
+func sendBracket(w http.ResponseWriter, conn *pgx.Conn, t Tournament, status int) {
+	bracket := BracketResponse{
+		Tournament: t,
+		Players: []int{},
+		Rounds: []TournamentRound{},
+	}
+
+	rows := database.QueryRows(conn, "SELECT user_id FROM rooms.tournament_player WHERE tournament_id = $1 ORDER BY registered_at", t.Id)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			break
+		}
+		bracket.Players = append(bracket.Players, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read tournament players: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read the players of the tournament.")
+		return
+	}
+
+	rows = database.QueryRows(conn, "SELECT round, slot, room_id, state FROM rooms.tournament_match WHERE tournament_id = $1 ORDER BY round, slot", t.Id)
+	for rows.Next() {
+		var round int
+		var match TournamentMatch
+		if err := rows.Scan(&round, &match.Slot, &match.RoomId, &match.State); err != nil {
+			break
+		}
+		match.Entries = []TournamentEntry{}
+		if len(bracket.Rounds) == 0 || bracket.Rounds[len(bracket.Rounds) - 1].Round != round {
+			bracket.Rounds = append(bracket.Rounds, TournamentRound{ Round: round })
+		}
+		last := &bracket.Rounds[len(bracket.Rounds) - 1]
+		last.Matches = append(last.Matches, match)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read tournament matches: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read the matches of the tournament.")
+		return
+	}
+
+	rows = database.QueryRows(conn, "SELECT e.round, e.slot, e.user_id, u.name, e.score, e.rank, e.advanced FROM rooms.tournament_entry e JOIN users.\"user\" u ON e.user_id = u.user_id WHERE e.tournament_id = $1 ORDER BY e.round, e.slot, e.rank NULLS LAST",
+		t.Id)
+	for rows.Next() {
+		var round, slot int
+		var entry TournamentEntry
+		if err := rows.Scan(&round, &slot, &entry.UserId, &entry.Name, &entry.Score, &entry.Rank, &entry.Advanced); err != nil {
+			break
+		}
+		for i := range bracket.Rounds {
+			if bracket.Rounds[i].Round != round {
+				continue
+			}
+			for j := range bracket.Rounds[i].Matches {
+				match := &bracket.Rounds[i].Matches[j]
+				if match.Slot == slot {
+					match.Entries = append(match.Entries, entry)
+				}
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read tournament entries: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not read the entries of the tournament.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(bracket)
+}
+
+// Returns the tournament with its players and every round played so far.
+func GetTournament(w http.ResponseWriter, r *http.Request) {
+	conn := database.GetConnection()
+	defer conn.Close(context.Background())
+
+	var t Tournament
+	if !getTournament(w, r, conn, &t) {
+		return
+	}
+
+	sendBracket(w, conn, t, http.StatusOK)
+}
+
+func RegisterTournamentPlayer(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var t Tournament
+	if !getTournament(w, r, conn, &t) {
+		return
+	}
+
+	if t.State != TOURNAMENT_REGISTRATION {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Registration closed",
+			"The tournament has already started.")
+		return
+	}
+
+	_, err := database.Execute(conn, "INSERT INTO rooms.tournament_player (tournament_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		t.Id, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not register player POST /api/tournaments/id/players: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not register to the tournament.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UnregisterTournamentPlayer(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var t Tournament
+	if !getTournament(w, r, conn, &t) {
+		return
+	}
+
+	if t.State != TOURNAMENT_REGISTRATION {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Registration closed",
+			"The tournament has already started.")
+		return
+	}
+
+	_, err := database.Execute(conn, "DELETE FROM rooms.tournament_player WHERE tournament_id = $1 AND user_id = $2",
+		t.Id, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not unregister player DELETE /api/tournaments/id/players: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not unregister from the tournament.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the players of the next round in the order of their seeds.
+func nextRoundPlayers(conn *pgx.Conn, t Tournament) ([]int, error) {
+	var rows pgx.Rows
+	if t.CurrentRound == 0 {
+		rows = database.QueryRows(conn, "SELECT p.user_id FROM rooms.tournament_player p JOIN users.\"user\" u ON p.user_id = u.user_id WHERE p.tournament_id = $1 ORDER BY CASE WHEN u.matches_played > 0 THEN u.matches_won * 100 / u.matches_played ELSE 0 END DESC, p.registered_at",
+			t.Id)
+	} else {
+		rows = database.QueryRows(conn, "SELECT user_id FROM rooms.tournament_entry WHERE tournament_id = $1 AND round = $2 AND advanced ORDER BY score DESC NULLS LAST, rank",
+			t.Id, t.CurrentRound)
+	}
+	defer rows.Close()
+
+	var players []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		players = append(players, id)
+	}
+	return players, rows.Err()
+}
+
+// Distributes the seeded players over `n` rooms, snaking the seeds so the
+// strongest players end up in different rooms.
+func seedRooms(players []int, n int) [][]int {
+	slots := make([][]int, n)
+	for i, p := range players {
+		s := i % (2 * n)
+		if s >= n {
+			s = 2 * n - 1 - s
+		}
+		slots[s] = append(slots[s], p)
+	}
+	return slots
+}
+
+// Marks the matches of the current round whose rooms are gone as abandoned
+// and returns whether every match of the round is over.
+func roundFinished(conn *pgx.Conn, t Tournament) (bool, error) {
+	_, err := database.Execute(conn, "UPDATE rooms.tournament_match m SET state = $1 WHERE m.tournament_id = $2 AND m.round = $3 AND m.state = $4 AND NOT EXISTS (SELECT * FROM rooms.room r WHERE r.room_id = m.room_id)",
+		MATCH_ABANDONED, t.Id, t.CurrentRound, MATCH_PLAYING)
+	if err != nil {
+		return false, err
+	}
+
+	var playing bool
+	err = database.QueryRow(conn, "SELECT EXISTS (SELECT * FROM rooms.tournament_match WHERE tournament_id = $1 AND round = $2 AND state = $3)",
+		t.Id, t.CurrentRound, MATCH_PLAYING).Scan(&playing)
+	return !playing, err
+}
+
+// Creates the match of `slot` in the current round of the tournament.
+// Returns the id of its room, or 0 if the only player advances without
+// playing.
+//
+// The room is owned by the first seed, who can start the game. The owner
+// leaving doesn't close the room of a match, the next player becomes its
+// owner instead (see websocket.passOwnership).
+func createTournamentMatch(conn *pgx.Conn, t Tournament, slot int, players []int) (int, error) {
+	if len(players) == 1 {
+		_, err := database.Execute(conn, "INSERT INTO rooms.tournament_match (tournament_id, round, slot, state) VALUES ($1, $2, $3, $4)",
+			t.Id, t.CurrentRound, slot, MATCH_FINISHED)
+		if err != nil {
+			return 0, err
+		}
+		_, err = database.Execute(conn, "INSERT INTO rooms.tournament_entry (tournament_id, round, slot, user_id, rank, advanced) VALUES ($1, $2, $3, $4, 1, TRUE)",
+			t.Id, t.CurrentRound, slot, players[0])
+		return 0, err
+	}
+
+	settings := t.Settings
+	settings.MaxPlayers = len(players)
+	settings.MinPlayers = 2
+	settings.Visibility = VISIBILITY_UNLISTED
+
+	room := Room{
+		Name: t.Name,
+		PackId: t.PackId,
+		UserId: players[0],
+		Settings: settings,
+		State: ROOM_LOBBY,
+		RevisionId: t.RevisionId,
+	}
+	err := InsertRoom(conn, &room)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = database.Execute(conn, "INSERT INTO rooms.tournament_match (tournament_id, round, slot, room_id) VALUES ($1, $2, $3, $4)",
+		t.Id, t.CurrentRound, slot, room.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range players {
+		_, err = database.Execute(conn, "INSERT INTO rooms.tournament_entry (tournament_id, round, slot, user_id) VALUES ($1, $2, $3, $4)",
+			t.Id, t.CurrentRound, slot, p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return room.Id, nil
+}
+
+// Tells the players of a match which room to join.
+func notifyTournamentMatch(t Tournament, roomId int, players []int) {
+	for _, p := range players {
+		err := notification.Send(notification.Notification{
+			UserId: p,
+			Title: "Your tournament match is ready",
+			Body: fmt.Sprintf("Round %d of %q is played in room %d. Join now!", t.CurrentRound, t.Name, roomId),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not notify user %d: %v\n", p, err)
+		}
+	}
+}
+
+// Starts the next round of the tournament. Only the owner can start rounds.
+func StartTournamentRound(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value("db_connection").(*pgx.Conn)
+	session := r.Context().Value("session").(*Session)
+
+	var t Tournament
+	if !getTournament(w, r, conn, &t) {
+		return
+	}
+
+	if t.UserId != session.UserId {
+		httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+			"Can't start rounds of a tournament that is not owned by themselves.")
+		return
+	}
+
+	if t.State == TOURNAMENT_FINISHED {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Tournament finished",
+			"The tournament is already over.")
+		return
+	}
+
+	if t.CurrentRound > 0 {
+		finished, err := roundFinished(conn, t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not check round POST /api/tournaments/id/rounds: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not check the current round.")
+			return
+		}
+		if !finished {
+			httputils.SendErrorMessage(w, http.StatusConflict, "Round not finished",
+				"Every match of the current round must be over first.")
+			return
+		}
+	}
+
+	players, err := nextRoundPlayers(conn, t)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get players POST /api/tournaments/id/rounds: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the players of the next round.")
+		return
+	}
+
+	if t.CurrentRound == 0 && len(players) < 2 {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Not enough players",
+			"At least 2 players must be registered.")
+		return
+	}
+
+	// The final was abandoned or left a single player standing.
+	if len(players) < 2 {
+		var winner *int
+		if len(players) == 1 {
+			winner = &players[0]
+		}
+		err = scanTournament(database.QueryRow(conn, "UPDATE rooms.tournament SET state = $1, winner_id = $2 WHERE tournament_id = $3 RETURNING " + TOURNAMENT_COLUMNS,
+			TOURNAMENT_FINISHED, winner, t.Id), &t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not finish tournament POST /api/tournaments/id/rounds: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not finish the tournament.")
+			return
+		}
+		sendBracket(w, conn, t, http.StatusOK)
+		return
+	}
+
+	// The round is started as a whole, a failed match must not leave
+	// its players out of a round that counts as started. The round is
+	// checked again, so a concurrent request can't start it twice.
+	round := t.CurrentRound
+	n := (len(players) + t.RoomSize - 1) / t.RoomSize
+	groups := seedRooms(players, n)
+	roomIds := make([]int, n)
+	err = database.Transaction(conn, func() error {
+		err := scanTournament(database.QueryRow(conn, "UPDATE rooms.tournament SET state = $1, current_round = current_round + 1 WHERE tournament_id = $2 AND current_round = $3 RETURNING " + TOURNAMENT_COLUMNS,
+			TOURNAMENT_RUNNING, t.Id, round), &t)
+		if err != nil {
+			return err
+		}
+
+		for slot, group := range groups {
+			roomIds[slot], err = createTournamentMatch(conn, t, slot + 1, group)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		httputils.SendErrorMessage(w, http.StatusConflict, "Round already started",
+			"The round was started by another request.")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not start round POST /api/tournaments/id/rounds: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not start the round.")
+		return
+	}
+
+	for slot, group := range groups {
+		if roomIds[slot] != 0 {
+			notifyTournamentMatch(t, roomIds[slot], group)
+		}
+	}
+
+	sendBracket(w, conn, t, http.StatusCreated)
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeedRooms(t *testing.T) {
+	tests := []struct {
+		name    string
+		players []int
+		n       int
+		rooms   [][]int
+	}{
+		{
+			name: "snake",
+			players: []int{ 1, 2, 3, 4, 5, 6, 7, },
+			n: 3,
+			rooms: [][]int{ { 1, 6, 7, }, { 2, 5, }, { 3, 4, }, },
+		},
+		{
+			name: "one room",
+			players: []int{ 1, 2, 3, },
+			n: 1,
+			rooms: [][]int{ { 1, 2, 3, }, },
+		},
+		{
+			name: "pairs",
+			players: []int{ 1, 2, 3, 4, },
+			n: 2,
+			rooms: [][]int{ { 1, 4, }, { 2, 3, }, },
+		},
+		{
+			name: "more rooms than players",
+			players: []int{ 1, 2, },
+			n: 3,
+			rooms: [][]int{ { 1, }, { 2, }, nil, },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rooms := seedRooms(tt.players, tt.n); !reflect.DeepEqual(rooms, tt.rooms) {
+				t.Errorf("seedRooms(%v, %d) = %v, want %v", tt.players, tt.n, rooms, tt.rooms)
+			}
+		})
+	}
+}
@@ -8,8 +8,11 @@ package handler
 //   email          unique varchar(255),
 //   password       text
 //   matches_played int,
-//   matches_won    int
+//   matches_won    int,
+//   is_admin       boolean
 // )
+//
+// Administrators are appointed directly in the database.
 
 import (
 	"context"
@@ -132,6 +135,18 @@ func DeleteCurrentUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The media rows go with the user, but the files must be removed
+	// from the storage by hand.
+	var keys []*string
+	err = database.QueryRow(conn, "SELECT COALESCE(array_agg(k), '{}') FROM users.media, LATERAL (VALUES (storage_key), (thumbnail_key)) v(k) WHERE user_id = $1 AND k IS NOT NULL",
+		session.UserId).Scan(&keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get user media DELETE /api/users/me: %v\n", err)
+		httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+			"Could not get the media of the user.")
+		return
+	}
+
 	_, err = database.Execute(conn, "DELETE FROM users.\"user\" WHERE user_id = $1", session.UserId)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not delete user DELETE /api/users/me: %v\n", err)
@@ -139,6 +154,7 @@ func DeleteCurrentUser(w http.ResponseWriter, r *http.Request) {
 			"Could not delete user with the given id.")
 		return
 	}
+	deleteMediaFiles(keys...)
 
 	http.SetCookie(w, cookie)
 	w.WriteHeader(http.StatusNoContent)
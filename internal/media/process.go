@@ -0,0 +1,305 @@
+package media
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+)
+
+// Uploads are recognized by their content, not by the name or the type
+// the client claims. The images are decoded and encoded again, which
+// drops EXIF and any other metadata, like the location the photo was
+// taken at, and gets a thumbnail. The audio and video files are stored
+// as they are.
+
+const (
+	MAX_IMAGE_SIZE = 5 << 20
+	MAX_AUDIO_SIZE = 10 << 20
+	MAX_VIDEO_SIZE = 50 << 20
+	MAX_UPLOAD_SIZE = MAX_VIDEO_SIZE
+
+	// Decoding an image takes memory proportional to its dimensions, so
+	// the small files of huge dimensions are rejected before decoding.
+	MAX_IMAGE_PIXELS = 4096 * 4096
+	// Every frame of an animation is decoded, so the frames are limited
+	// too, both in number and in the pixels of all of them.
+	MAX_GIF_FRAMES = 500
+	MAX_GIF_PIXELS = 4 * MAX_IMAGE_PIXELS
+
+	THUMBNAIL_SIZE = 320
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported media type")
+	ErrTooLarge        = errors.New("media too large")
+)
+
+type mediaType struct {
+	Ext     string
+	MaxSize int
+}
+
+// The content types http.DetectContentType recognizes that can be uploaded.
+var mediaTypes = map[string]mediaType{
+	"image/jpeg": { Ext: "jpg", MaxSize: MAX_IMAGE_SIZE, },
+	"image/png": { Ext: "png", MaxSize: MAX_IMAGE_SIZE, },
+	"image/gif": { Ext: "gif", MaxSize: MAX_IMAGE_SIZE, },
+	"audio/mpeg": { Ext: "mp3", MaxSize: MAX_AUDIO_SIZE, },
+	"audio/wave": { Ext: "wav", MaxSize: MAX_AUDIO_SIZE, },
+	"application/ogg": { Ext: "ogg", MaxSize: MAX_AUDIO_SIZE, },
+	"video/mp4": { Ext: "mp4", MaxSize: MAX_VIDEO_SIZE, },
+	"video/webm": { Ext: "webm", MaxSize: MAX_VIDEO_SIZE, },
+}
+
+// Returns the content type of the stored file with the key.
+func ContentType(key string) string {
+	ext := key[strings.LastIndexByte(key, '.') + 1:]
+	for contentType, t := range mediaTypes {
+		if t.Ext == ext {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+type File struct {
+	Key         string
+	ContentType string
+	Data        []byte
+}
+
+// The processed upload ready to be stored. Thumbnail is nil for anything
+// but images.
+type Asset struct {
+	File
+	Thumbnail *File
+}
+
+func (a *Asset) Size() int64 {
+	size := int64(len(a.Data))
+	if a.Thumbnail != nil {
+		size += int64(len(a.Thumbnail.Data))
+	}
+	return size
+}
+
+func newKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Checks the type and the size of the upload and prepares it for storing.
+// Returns ErrUnsupportedType or ErrTooLarge if the upload is rejected.
+func Process(data []byte) (*Asset, error) {
+	contentType := http.DetectContentType(data)
+	t, ok := mediaTypes[contentType]
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	if len(data) > t.MaxSize {
+		return nil, ErrTooLarge
+	}
+
+	key := newKey()
+	asset := &Asset{
+		File: File{
+			Key: key + "." + t.Ext,
+			ContentType: contentType,
+			Data: data,
+		},
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return asset, nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	if cfg.Width * cfg.Height > MAX_IMAGE_PIXELS {
+		return nil, ErrTooLarge
+	}
+
+	if contentType == "image/gif" {
+		frames, pixels, err := gifFrames(data)
+		if err != nil {
+			return nil, ErrUnsupportedType
+		}
+		if frames > MAX_GIF_FRAMES || pixels > MAX_GIF_PIXELS {
+			return nil, ErrTooLarge
+		}
+	}
+
+	img, clean, err := reencode(contentType, data)
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	asset.Data = clean
+
+	// The thumbnails of the photos stay photos, everything else may have
+	// transparency.
+	var thumb bytes.Buffer
+	thumbFile := &File{ Key: key + "-thumb.png", ContentType: "image/png", }
+	if contentType == "image/jpeg" {
+		thumbFile.Key = key + "-thumb.jpg"
+		thumbFile.ContentType = "image/jpeg"
+		err = jpeg.Encode(&thumb, thumbnail(img), &jpeg.Options{ Quality: 85, })
+	} else {
+		err = png.Encode(&thumb, thumbnail(img))
+	}
+	if err != nil {
+		return nil, err
+	}
+	thumbFile.Data = thumb.Bytes()
+	asset.Thumbnail = thumbFile
+
+	return asset, nil
+}
+
+var errBadGif = errors.New("malformed gif")
+
+// Returns the number of frames of the GIF and the pixels of all of them
+// together, walking the blocks of the file without decoding the frames.
+func gifFrames(data []byte) (int, int, error) {
+	// The header and the logical screen descriptor, which may be followed
+	// by the global color table.
+	if len(data) < 13 {
+		return 0, 0, errBadGif
+	}
+	i := 13
+	if data[10] & 0x80 != 0 {
+		i += 3 << (data[10] & 0x07 + 1)
+	}
+
+	// Skips the data sub-blocks starting at i, up to the block terminator.
+	skipSubBlocks := func(i int) (int, error) {
+		for i < len(data) {
+			n := int(data[i])
+			i++
+			if n == 0 {
+				return i, nil
+			}
+			i += n
+		}
+		return 0, errBadGif
+	}
+
+	frames, pixels := 0, 0
+	for i < len(data) {
+		var err error
+		switch data[i] {
+		case 0x21: // An extension: the label and the sub-blocks.
+			i, err = skipSubBlocks(i + 2)
+		case 0x2c: // A frame: the descriptor, the local color table and the image data.
+			if i + 10 > len(data) {
+				return 0, 0, errBadGif
+			}
+			width := int(data[i + 5]) | int(data[i + 6]) << 8
+			height := int(data[i + 7]) | int(data[i + 8]) << 8
+			frames++
+			pixels += width * height
+
+			flags := data[i + 9]
+			i += 10
+			if flags & 0x80 != 0 {
+				i += 3 << (flags & 0x07 + 1)
+			}
+			i, err = skipSubBlocks(i + 1)
+		case 0x3b: // The trailer.
+			return frames, pixels, nil
+		default:
+			return 0, 0, errBadGif
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, errBadGif
+}
+
+// Decodes the image and encodes it again without the metadata. Returns the
+// decoded image (the first frame for animations) and the new file.
+func reencode(contentType string, data []byte) (image.Image, []byte, error) {
+	var buf bytes.Buffer
+	switch contentType {
+	case "image/gif":
+		// The frames are kept, only the comments and the application
+		// extensions are gone.
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		err = gif.EncodeAll(&buf, g)
+		if err != nil {
+			return nil, nil, err
+		}
+		return g.Image[0], buf.Bytes(), nil
+
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		err = png.Encode(&buf, img)
+		return img, buf.Bytes(), err
+
+	default:
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{ Quality: 90, })
+		return img, buf.Bytes(), err
+	}
+}
+
+// Scales the image down to fit THUMBNAIL_SIZE x THUMBNAIL_SIZE by
+// averaging the pixels. The images that fit already are only copied.
+func thumbnail(img image.Image) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > THUMBNAIL_SIZE || h > THUMBNAIL_SIZE {
+		longest := max(w, h)
+		tw = max(1, w * THUMBNAIL_SIZE / longest)
+		th = max(1, h * THUMBNAIL_SIZE / longest)
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0 := b.Min.Y + y * h / th
+		y1 := max(y0 + 1, b.Min.Y + (y + 1) * h / th)
+		for x := 0; x < tw; x++ {
+			x0 := b.Min.X + x * w / tw
+			x1 := max(x0 + 1, b.Min.X + (x + 1) * w / tw)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
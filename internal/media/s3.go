@@ -0,0 +1,137 @@
+package media
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Keeps the files in a bucket of an S3-compatible service. The requests
+// are path-style (`endpoint/bucket/key`), which every implementation
+// supports, and signed with AWS Signature Version 4.
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	client    *http.Client
+}
+
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey string) *S3Storage {
+	return &S3Storage{
+		Endpoint: endpoint,
+		Region: region,
+		Bucket: bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		client: &http.Client{ Timeout: time.Minute, },
+	}
+}
+
+func (s *S3Storage) Put(key string, contentType string, data []byte) error {
+	res, err := s.do(http.MethodPut, key, contentType, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, "", nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Sends the signed request for the object with the key. Returns ErrNotFound
+// if the object doesn't exist and an error for any other unsuccessful
+// status.
+func (s *S3Storage) do(method, key, contentType string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/%s/%s", s.Endpoint, url.PathEscape(s.Bucket), url.PathEscape(key)))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, res.Status, msg)
+	}
+	return res, nil
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Adds the AWS Signature Version 4 headers to the request. Only the host,
+// the payload hash and the date are signed.
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := fmt.Sprintf("%s\n%s\n\nhost:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n\n%s\n%s",
+		req.Method, req.URL.EscapedPath(), req.URL.Host, payloadHash, amzDate, signedHeaders, payloadHash)
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", amzDate, scope, sha256Hex([]byte(canonicalRequest)))
+
+	key := hmacSha256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSha256(key, s.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,88 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+)
+
+// The media uploaded by the users (see Process) is kept in a storage by
+// key. The keys are random and the stored files never change, so the urls
+// to them are stable and can be cached forever. The storage is picked by
+// MEDIA_STORAGE: the local file system by default, or any S3-compatible
+// service, e.g. MinIO running next to the server.
+
+var ErrNotFound = errors.New("media not found")
+
+type Storage interface {
+	Put(key string, contentType string, data []byte) error
+	// Returns ErrNotFound if there's no file with the key. The caller must
+	// close the returned reader.
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// Keeps the files in a directory of the local file system.
+type LocalStorage struct {
+	Dir string
+}
+
+func (s LocalStorage) Put(key string, contentType string, data []byte) error {
+	err := os.MkdirAll(s.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// The file is written under a temporary name first, so a half-written
+	// file is never served.
+	key = filepath.Base(key)
+	tmp := filepath.Join(s.Dir, "."+key+".tmp")
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, key))
+}
+
+// The returned reader is an *os.File, so it can be seeked.
+func (s LocalStorage) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.Dir, filepath.Base(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s LocalStorage) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.Dir, filepath.Base(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// The storage of the media, nil until Load is called.
+var Default Storage
+
+// Opens the storage the config asks for. Must be called after the config
+// is loaded.
+func Load() {
+	Default = load()
+}
+
+func load() Storage {
+	c := config.AppConfig
+	if c.MediaStorage == "s3" {
+		return NewS3Storage(c.S3Endpoint, c.S3Region, c.S3Bucket, c.S3AccessKey, c.S3SecretKey)
+	}
+	return LocalStorage{ Dir: c.MediaDir, }
+}
+
+// Returns the url the file with the key is served at.
+func Url(key string) string {
+	return fmt.Sprintf("%s/media/%s", config.AppConfig.MediaBaseUrl, key)
+}
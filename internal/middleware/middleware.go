@@ -11,6 +11,7 @@ import (
 	"github.com/detectivekaktus/JGame/internal/database"
 	"github.com/detectivekaktus/JGame/internal/handler"
 	"github.com/detectivekaktus/JGame/internal/httputils"
+	"github.com/jackc/pgx/v5"
 )
 
 // Establishes a connection to the database passed with the request via
@@ -52,6 +53,48 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// Same as AuthMiddleware, but lets the anonymous users through too. The
+// session is passed only if the user is logged in, the connection always.
+func OptionalAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn := database.GetConnection()
+		defer conn.Close(context.Background())
+
+		session, err := handler.GetUserSession(conn, r)
+		if err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), "session", session))
+		}
+		r = r.WithContext(context.WithValue(r.Context(), "db_connection", conn))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Lets through only the users with the admin flag. Must come after
+// AuthMiddleware, which provides the session and the connection.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := r.Context().Value("session").(*handler.Session)
+		conn := r.Context().Value("db_connection").(*pgx.Conn)
+
+		var isAdmin bool
+		err := database.QueryRow(conn, "SELECT is_admin FROM users.\"user\" WHERE user_id = $1", session.UserId).
+			Scan(&isAdmin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "AdminMiddleware error: %v\n", err)
+			httputils.SendErrorMessage(w, http.StatusInternalServerError, "Internal error",
+				"Could not verify the user.")
+			return
+		}
+
+		if !isAdmin {
+			httputils.SendErrorMessage(w, http.StatusForbidden, "Forbidden",
+				"Only administrators can perform this action.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // The requests with this middleware will not be allowed if they have body.
 func RejectBodyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -89,10 +132,14 @@ func RequireJsonContentMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-var AllowedCorsOrigins = map[string]bool {
-	"https://127.0.0.1:5173": true,
-	"https://localhost:5173": true,
-	"https://" + config.AppConfig.LocalIp + ":5173": true,
+// Returns whether the requests from the origin are accepted: only the ones
+// of the frontend are.
+func IsAllowedCorsOrigin(origin string) bool {
+	switch origin {
+	case "https://127.0.0.1:5173", "https://localhost:5173", "https://" + config.AppConfig.LocalIp + ":5173":
+		return true
+	}
+	return false
 }
 
 // Sets up Cross-Origin Resource Sharing mechanism workarounds to accept requests
@@ -100,11 +147,12 @@ var AllowedCorsOrigins = map[string]bool {
 func CorsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
-		if AllowedCorsOrigins[origin] {
+		if IsAllowedCorsOrigin(origin) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
@@ -0,0 +1,35 @@
+package notification
+
+import (
+	"fmt"
+)
+
+// Notifications are messages for the users that are delivered outside of
+// the game, e.g. reminders about scheduled rooms. There's no delivery
+// service yet, so the default notifier only logs them. A real one can be
+// plugged in by replacing Default.
+
+type Notification struct {
+	UserId int
+	Title  string
+	Body   string
+}
+
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// Writes the notifications to the standard output.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(n Notification) error {
+	fmt.Printf("Notification for user %d: %s. %s\n", n.UserId, n.Title, n.Body)
+	return nil
+}
+
+var Default Notifier = LogNotifier{}
+
+// Sends the notification with the default notifier.
+func Send(n Notification) error {
+	return Default.Notify(n)
+}
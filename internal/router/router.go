@@ -58,11 +58,19 @@ func NewRouter() *mux.Router {
 		chainMiddlewares(http.HandlerFunc(handler.DeleteCurrentUser),
 			middleware.RejectBodyMiddleware)).
 		Methods("DELETE", "OPTIONS")
+	users.Handle("/me/practice",
+		chainMiddlewares(http.HandlerFunc(handler.GetPracticeStats),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
 	// Available without auth
 	api.Handle("/users/{id:[0-9]+}",
 		chainMiddlewares(http.HandlerFunc(handler.GetUser),
 			middleware.RejectBodyMiddleware)).
 		Methods("GET")
+	api.Handle("/users/{id:[0-9]+}/achievements",
+		chainMiddlewares(http.HandlerFunc(handler.GetUserAchievements),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
 
 	packs := api.PathPrefix("/packs").Subrouter()
 	packs.Use(middleware.AuthMiddleware)
@@ -85,13 +93,117 @@ func NewRouter() *mux.Router {
 		chainMiddlewares(http.HandlerFunc(handler.DeletePack),
 			middleware.RejectBodyMiddleware)).
 		Methods("DELETE", "OPTIONS")
-	// Available without auth
+	packs.Handle("/{id:[0-9]+}/revisions/{number:[0-9]+}/rollback",
+		chainMiddlewares(http.HandlerFunc(handler.RollbackRevision),
+			middleware.RejectBodyMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/publish",
+		chainMiddlewares(http.HandlerFunc(handler.PublishPack),
+			middleware.RejectBodyMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/archive",
+		chainMiddlewares(http.HandlerFunc(handler.ArchivePack),
+			middleware.RejectBodyMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/visibility",
+		chainMiddlewares(http.HandlerFunc(handler.SetPackVisibility),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+		Methods("PUT", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/access",
+		chainMiddlewares(http.HandlerFunc(handler.GetPackAccess),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/access",
+		chainMiddlewares(http.HandlerFunc(handler.PutPackAccess),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+		Methods("PUT", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/access/{access_id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.DeletePackAccess),
+			middleware.RejectBodyMiddleware)).
+		Methods("DELETE", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/authors",
+		chainMiddlewares(http.HandlerFunc(handler.GetPackAuthors),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/authors",
+		chainMiddlewares(http.HandlerFunc(handler.InvitePackAuthor),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/authors/{user_id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.RemovePackAuthor),
+			middleware.RejectBodyMiddleware)).
+		Methods("DELETE", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/bundle",
+		chainMiddlewares(http.HandlerFunc(handler.ExportPackBundle),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET", "OPTIONS")
+	packs.Handle("/{id:[0-9]+}/fork",
+		chainMiddlewares(http.HandlerFunc(handler.ForkPack),
+			middleware.RejectBodyMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/lint",
+		chainMiddlewares(http.HandlerFunc(handler.LintPack),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/import",
+		chainMiddlewares(http.HandlerFunc(handler.ImportPack),
+			middleware.RequireBodyMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/import/bundle",
+		chainMiddlewares(http.HandlerFunc(handler.ImportPackBundle),
+			middleware.RequireBodyMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/invites",
+		chainMiddlewares(http.HandlerFunc(handler.GetAuthorInvites),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET", "OPTIONS")
+	packs.Handle("/invites/{invite_id:[0-9]+}/accept",
+		chainMiddlewares(http.HandlerFunc(handler.AcceptAuthorInvite),
+			middleware.RejectBodyMiddleware)).
+		Methods("POST", "OPTIONS")
+	packs.Handle("/invites/{invite_id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.DeleteAuthorInvite),
+			middleware.RejectBodyMiddleware)).
+		Methods("DELETE", "OPTIONS")
+	// Available without auth, the packs are shown to the users who can see
+	// them only
 	api.Handle("/packs",
 		chainMiddlewares(http.HandlerFunc(handler.GetPacks),
+			middleware.OptionalAuthMiddleware,
 			middleware.RejectBodyMiddleware)).
 		Methods("GET")
 	api.Handle("/packs/{id:[0-9]+}",
 		chainMiddlewares(http.HandlerFunc(handler.GetPack),
+			middleware.OptionalAuthMiddleware,
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/packs/{id:[0-9]+}/forks",
+		chainMiddlewares(http.HandlerFunc(handler.GetPackForks),
+			middleware.OptionalAuthMiddleware,
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/packs/{id:[0-9]+}/export",
+		chainMiddlewares(http.HandlerFunc(handler.ExportPack),
+			middleware.OptionalAuthMiddleware,
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/packs/{id:[0-9]+}/revisions",
+		chainMiddlewares(http.HandlerFunc(handler.GetRevisions),
+			middleware.OptionalAuthMiddleware,
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/packs/{id:[0-9]+}/revisions/{number:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.GetRevision),
+			middleware.OptionalAuthMiddleware,
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/packs/{id:[0-9]+}/diff",
+		chainMiddlewares(http.HandlerFunc(handler.GetRevisionDiff),
+			middleware.OptionalAuthMiddleware,
 			middleware.RejectBodyMiddleware)).
 		Methods("GET")
 
@@ -116,6 +228,18 @@ func NewRouter() *mux.Router {
 		chainMiddlewares(http.HandlerFunc(handler.DeleteRoom),
 			middleware.RejectBodyMiddleware)).
 	Methods("DELETE", "OPTIONS")
+	rooms.Handle("/{id:[0-9]+}/rsvp",
+		chainMiddlewares(http.HandlerFunc(handler.GetRsvp),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+	rooms.Handle("/{id:[0-9]+}/rsvp",
+		chainMiddlewares(http.HandlerFunc(handler.CreateRsvp),
+			middleware.RejectBodyMiddleware)).
+	Methods("POST", "OPTIONS")
+	rooms.Handle("/{id:[0-9]+}/rsvp",
+		chainMiddlewares(http.HandlerFunc(handler.DeleteRsvp),
+			middleware.RejectBodyMiddleware)).
+	Methods("DELETE", "OPTIONS")
 	// Available without auth
 	api.Handle("/rooms",
 		chainMiddlewares(http.HandlerFunc(handler.GetRooms),
@@ -123,9 +247,149 @@ func NewRouter() *mux.Router {
 		Methods("GET")
 	api.Handle("/rooms/{id:[0-9]+}",
 		chainMiddlewares(http.HandlerFunc(handler.GetRoom),
+			middleware.OptionalAuthMiddleware,
 			middleware.RejectBodyMiddleware)).
 		Methods("GET")
 
+	challenges := api.PathPrefix("/challenges").Subrouter()
+	challenges.Use(middleware.AuthMiddleware)
+	challenges.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.CreateChallenge),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+	Methods("POST", "OPTIONS")
+	challenges.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.GetChallenges),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+	challenges.Handle("/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.GetChallenge),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+
+	tournaments := api.PathPrefix("/tournaments").Subrouter()
+	tournaments.Use(middleware.AuthMiddleware)
+	tournaments.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.CreateTournament),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+	Methods("POST", "OPTIONS")
+	tournaments.Handle("/{id:[0-9]+}/players",
+		chainMiddlewares(http.HandlerFunc(handler.RegisterTournamentPlayer),
+			middleware.RejectBodyMiddleware)).
+	Methods("POST", "OPTIONS")
+	tournaments.Handle("/{id:[0-9]+}/players",
+		chainMiddlewares(http.HandlerFunc(handler.UnregisterTournamentPlayer),
+			middleware.RejectBodyMiddleware)).
+	Methods("DELETE", "OPTIONS")
+	tournaments.Handle("/{id:[0-9]+}/rounds",
+		chainMiddlewares(http.HandlerFunc(handler.StartTournamentRound),
+			middleware.RejectBodyMiddleware)).
+	Methods("POST", "OPTIONS")
+	// Available without auth
+	api.Handle("/tournaments",
+		chainMiddlewares(http.HandlerFunc(handler.GetTournaments),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/tournaments/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.GetTournament),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+
+	seasons := api.PathPrefix("/seasons").Subrouter()
+	seasons.Use(middleware.AuthMiddleware)
+	seasons.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.CreateSeason),
+			middleware.AdminMiddleware,
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+	Methods("POST", "OPTIONS")
+	// Available without auth
+	api.Handle("/seasons",
+		chainMiddlewares(http.HandlerFunc(handler.GetSeasons),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/seasons/current",
+		chainMiddlewares(http.HandlerFunc(handler.GetCurrentSeason),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+	api.Handle("/seasons/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.GetSeason),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET")
+
+	study := api.PathPrefix("/study").Subrouter()
+	study.Use(middleware.AuthMiddleware)
+	study.Handle("/next",
+		chainMiddlewares(http.HandlerFunc(handler.GetStudyNext),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+	study.Handle("/next",
+		chainMiddlewares(http.HandlerFunc(handler.PostStudyReview),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+	Methods("POST", "OPTIONS")
+	study.Handle("/packs",
+		chainMiddlewares(http.HandlerFunc(handler.GetStudySubscriptions),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+	study.Handle("/packs/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.SubscribeStudyPack),
+			middleware.RejectBodyMiddleware)).
+	Methods("POST", "OPTIONS")
+	study.Handle("/packs/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.UnsubscribeStudyPack),
+			middleware.RejectBodyMiddleware)).
+	Methods("DELETE", "OPTIONS")
+
+	groups := api.PathPrefix("/groups").Subrouter()
+	groups.Use(middleware.AuthMiddleware)
+	groups.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.CreateGroup),
+			middleware.RequireBodyMiddleware,
+			middleware.RequireJsonContentMiddleware)).
+	Methods("POST", "OPTIONS")
+	groups.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.GetGroups),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+	groups.Handle("/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.GetGroup),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+	groups.Handle("/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.DeleteGroup),
+			middleware.RejectBodyMiddleware)).
+	Methods("DELETE", "OPTIONS")
+	groups.Handle("/{id:[0-9]+}/members/{user_id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.AddGroupMember),
+			middleware.RejectBodyMiddleware)).
+	Methods("PUT", "OPTIONS")
+	groups.Handle("/{id:[0-9]+}/members/{user_id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.RemoveGroupMember),
+			middleware.RejectBodyMiddleware)).
+	Methods("DELETE", "OPTIONS")
+
+	mediaRouter := api.PathPrefix("/media").Subrouter()
+	mediaRouter.Use(middleware.AuthMiddleware)
+	mediaRouter.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.UploadMedia),
+			middleware.RequireBodyMiddleware)).
+	Methods("POST", "OPTIONS")
+	mediaRouter.Handle("",
+		chainMiddlewares(http.HandlerFunc(handler.GetMedia),
+			middleware.RejectBodyMiddleware)).
+	Methods("GET", "OPTIONS")
+	mediaRouter.Handle("/{id:[0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.DeleteMedia),
+			middleware.RejectBodyMiddleware)).
+	Methods("DELETE", "OPTIONS")
+	// Available without auth
+	root.Handle("/media/{key:[0-9a-f]{32}(?:-thumb)?\\.[a-z0-9]+}",
+		chainMiddlewares(http.HandlerFunc(handler.ServeMedia),
+			middleware.RejectBodyMiddleware)).
+		Methods("GET", "HEAD")
+
 	ws := root.PathPrefix("/ws").Subrouter()
 	ws.Use(middleware.AuthMiddleware)
 	ws.Handle("",
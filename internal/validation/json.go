@@ -3,25 +3,152 @@ package validation
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
+	"strings"
 
 	"github.com/xeipuuv/gojsonschema"
 )
 
 const (
-	PACK_SCHEMA = "file://api/pack_schema.json"
+	PACK_SCHEMA          = "file://api/pack_schema.json"
+	ROOM_SETTINGS_SCHEMA = "file://api/room_settings_schema.json"
 )
 
-func ValidateAgainstSchema(schemaPath string, validatee json.RawMessage) bool {
-	schemaLoader := gojsonschema.NewReferenceLoader(schemaPath)
-	validateeLoader := gojsonschema.NewBytesLoader(validatee)
-	res, err := gojsonschema.Validate(schemaLoader, validateeLoader)
+// The schemas are compiled once, when the server starts, right after the
+// config is loaded. A missing or broken schema stops the server.
+var schemas map[string]*gojsonschema.Schema
+
+// Compiles the schemas. The paths of the schemas are relative to the root
+// of the project, where the server runs.
+func LoadSchemas() {
+	schemas = map[string]*gojsonschema.Schema{
+		PACK_SCHEMA: compile(PACK_SCHEMA),
+		ROOM_SETTINGS_SCHEMA: compile(ROOM_SETTINGS_SCHEMA),
+	}
+}
+
+func compile(schemaPath string) *gojsonschema.Schema {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader(schemaPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load the schema %s: %v\n", schemaPath, err)
+		os.Exit(1)
+	}
+	return schema
+}
+
+// A value that breaks a rule of the schema.
+type SchemaError struct {
+	// The JSON pointer to the value, empty for the whole document.
+	Pointer string `json:"pointer"`
+	// The keyword of the schema that is broken, e.g. minItems.
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e SchemaError) String() string {
+	pointer := e.Pointer
+	if pointer == "" {
+		pointer = "/"
+	}
+	return pointer + ": " + e.Message
+}
+
+// The keywords of the schema the gojsonschema error types stand for.
+var schemaRules = map[string]string{
+	"required": "required",
+	"invalid_type": "type",
+	"enum": "enum",
+	"const": "const",
+	"pattern": "pattern",
+	"format": "format",
+	"additional_property_not_allowed": "additionalProperties",
+	"array_min_items": "minItems",
+	"array_max_items": "maxItems",
+	"unique": "uniqueItems",
+	"string_gte": "minLength",
+	"string_lte": "maxLength",
+	"number_gte": "minimum",
+	"number_lte": "maximum",
+	"number_gt": "exclusiveMinimum",
+	"number_lt": "exclusiveMaximum",
+	"multiple_of": "multipleOf",
+}
+
+// Turns the dotted field of gojsonschema, e.g. `questions.3.answers`, into
+// a JSON pointer.
+func jsonPointer(field string) string {
+	if field == gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+		return ""
+	}
+	var b strings.Builder
+	for _, token := range strings.Split(field, ".") {
+		token = strings.ReplaceAll(token, "~", "~0")
+		token = strings.ReplaceAll(token, "/", "~1")
+		b.WriteString("/" + token)
+	}
+	return b.String()
+}
+
+func schemaError(e gojsonschema.ResultError) SchemaError {
+	details := e.Details()
+	err := SchemaError{ Pointer: jsonPointer(e.Field()), Rule: e.Type(), }
+	if rule, ok := schemaRules[e.Type()]; ok {
+		err.Rule = rule
+	}
+
+	switch e.Type() {
+	case "required":
+		err.Pointer += jsonPointer(fmt.Sprint(details["property"]))
+		err.Message = "is required"
+	case "additional_property_not_allowed":
+		err.Pointer += jsonPointer(fmt.Sprint(details["property"]))
+		err.Message = "is not allowed"
+	case "invalid_type":
+		err.Message = fmt.Sprintf("must be %v, got %v", details["expected"], details["given"])
+	case "enum":
+		err.Message = fmt.Sprintf("must be one of %v", details["allowed"])
+	case "pattern":
+		err.Message = fmt.Sprintf("must match %v", details["pattern"])
+	case "format":
+		err.Message = fmt.Sprintf("must be a valid %v", details["format"])
+	case "array_min_items":
+		err.Message = fmt.Sprintf("must have at least %v items", details["min"])
+	case "array_max_items":
+		err.Message = fmt.Sprintf("must have at most %v items", details["max"])
+	case "string_gte":
+		err.Message = fmt.Sprintf("must be at least %v characters long", details["min"])
+	case "string_lte":
+		err.Message = fmt.Sprintf("must be at most %v characters long", details["max"])
+	case "number_gte":
+		err.Message = fmt.Sprintf("must be at least %v", details["min"])
+	case "number_lte":
+		err.Message = fmt.Sprintf("must be at most %v", details["max"])
+	default:
+		description := e.Description()
+		err.Message = strings.ToLower(description[:1]) + description[1:]
+	}
+	return err
+}
+
+// Checks the JSON against the schema. Returns the broken rules, none if
+// the JSON is valid.
+func Validate(schemaPath string, validatee json.RawMessage) []SchemaError {
+	if len(validatee) == 0 {
+		return []SchemaError{ { Rule: "json", Message: "is missing", }, }
+	}
+
+	res, err := schemas[schemaPath].Validate(gojsonschema.NewBytesLoader(validatee))
 	if err != nil {
-		if err != io.EOF {
-			fmt.Fprintf(os.Stderr, "Validating json against schema went wrong: %v", err)
-		}
-		return false
+		return []SchemaError{ { Rule: "json", Message: "is not valid JSON", }, }
+	}
+
+	var errs []SchemaError
+	for _, e := range res.Errors() {
+		errs = append(errs, schemaError(e))
 	}
-	return res.Valid()
+	return errs
+}
+
+func ValidateAgainstSchema(schemaPath string, validatee json.RawMessage) bool {
+	return len(Validate(schemaPath, validatee)) == 0
 }
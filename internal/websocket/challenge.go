@@ -0,0 +1,236 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The invitees of a challenge (see handler.Challenge) play its pack solo.
+// CHALLENGE_START begins the game, after which CHALLENGE_NEXT serves the
+// questions the same way NEXT_QUESTION does in the rooms and
+// CHALLENGE_ANSWER answers the current one. The questions are timed and
+// scored with the settings of the challenge.
+//
+// Every user has one attempt per challenge. The result is stored after
+// each answer, so leaving midway keeps the score made so far on the
+// scoreboard, but it's not marked as finished.
+
+type SoloGame struct {
+	ChallengeId    int
+	UserId         int
+	Settings       handler.RoomSettings
+	Deadline       time.Time
+	Pack           Pack
+	QuestionServed time.Time
+	// Set while waiting for MEDIA_READY. QuestionServed is then the latest
+	// time the question starts at.
+	MediaPending   bool
+	Answered       bool
+	Score          int
+	Correct        int
+}
+
+// Solo games by the connection playing them. Guarded by roomsMu.
+var soloGames = make(map[*websocket.Conn]*SoloGame)
+
+func startChallenge(conn *websocket.Conn, dbConn *pgx.Conn, session *handler.Session, msg WSMessage) error {
+	if _, ok := soloGames[conn]; ok {
+		return sendError(conn, 409, "already playing a challenge")
+	}
+
+	idFloat, ok := msg.Payload["challenge_id"].(float64)
+	if !ok {
+		return sendError(conn, 400, "missing challenge_id")
+	}
+
+	var challenge handler.Challenge
+	err := handler.ScanChallenge(database.QueryRow(dbConn, "SELECT * FROM rooms.challenge WHERE challenge_id = $1", int(idFloat)), &challenge)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return sendError(conn, 404, "no challenge with this id exists")
+		}
+		fmt.Fprintf(os.Stderr, "Could not get the challenge: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+
+	invited, err := handler.IsInvited(dbConn, challenge.Id, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check the challenge invite: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+	if !invited {
+		return sendError(conn, 404, "no challenge with this id exists")
+	}
+
+	if time.Now().After(challenge.Deadline) {
+		return sendError(conn, 409, "the challenge is over")
+	}
+
+	viewable, err := handler.CanViewPack(dbConn, challenge.PackId, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check the pack of the challenge: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+	if !viewable {
+		return sendError(conn, 403, "the pack of the challenge is not shared with you")
+	}
+
+	pack, err := loadRevision(dbConn, challenge.PackId, challenge.RevisionId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load the pack of the challenge: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+	shufflePack(&pack, challenge.Settings)
+
+	_, err = database.Execute(dbConn, "INSERT INTO rooms.challenge_result (challenge_id, user_id) VALUES ($1, $2)",
+		challenge.Id, session.UserId)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == database.UniqueViolation {
+			return sendError(conn, 409, "already played this challenge")
+		}
+		fmt.Fprintf(os.Stderr, "Could not insert the challenge result: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+
+	soloGames[conn] = &SoloGame{
+		ChallengeId: challenge.Id,
+		UserId: session.UserId,
+		Settings: challenge.Settings,
+		Deadline: challenge.Deadline,
+		Pack: pack,
+	}
+
+	return sendMessage(conn, WSMessage{
+		Type: CHALLENGE_STARTED,
+		Payload: map[string]any{
+			"challenge_id": challenge.Id,
+			"questions": len(pack.Questions),
+			"settings": challenge.Settings,
+		},
+	})
+}
+
+// Stores the score of the game. The game is marked as finished if
+// `finished` is set.
+func saveSoloGame(dbConn *pgx.Conn, game *SoloGame, finished bool) {
+	query := "UPDATE rooms.challenge_result SET score = $1, correct = $2 WHERE challenge_id = $3 AND user_id = $4"
+	if finished {
+		query = "UPDATE rooms.challenge_result SET score = $1, correct = $2, finished_at = NOW() WHERE challenge_id = $3 AND user_id = $4"
+	}
+	_, err := database.Execute(dbConn, query, game.Score, game.Correct, game.ChallengeId, game.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not save the result of challenge %d: %v\n", game.ChallengeId, err)
+	}
+}
+
+func finishChallenge(conn *websocket.Conn, dbConn *pgx.Conn, game *SoloGame) error {
+	saveSoloGame(dbConn, game, true)
+	delete(soloGames, conn)
+	return sendMessage(conn, WSMessage{
+		Type: CHALLENGE_FINISHED,
+		Payload: map[string]any{
+			"challenge_id": game.ChallengeId,
+			"score": game.Score,
+			"correct": game.Correct,
+			"questions": len(game.Pack.Questions),
+		},
+	})
+}
+
+// Handles the CHALLENGE_START, CHALLENGE_NEXT, CHALLENGE_ANSWER actions and
+// the MEDIA_READY action sent without a room_id.
+// Returns the error of writing to the connection.
+func handleChallengeMessage(conn *websocket.Conn, dbConn *pgx.Conn, session *handler.Session, msg WSMessage) error {
+	if msg.Type == CHALLENGE_START {
+		return startChallenge(conn, dbConn, session, msg)
+	}
+
+	game, ok := soloGames[conn]
+	if !ok {
+		return sendError(conn, 409, "not playing a challenge")
+	}
+
+	// The answers given after the deadline don't count.
+	if time.Now().After(game.Deadline) {
+		return finishChallenge(conn, dbConn, game)
+	}
+
+	switch msg.Type {
+	case CHALLENGE_NEXT:
+		if game.Pack.CurrentQuestion >= len(game.Pack.Questions) {
+			return finishChallenge(conn, dbConn, game)
+		}
+
+		question := game.Pack.Questions[game.Pack.CurrentQuestion]
+		game.Pack.CurrentQuestion++
+		game.Answered = false
+		game.QuestionServed = time.Now()
+		game.MediaPending = questionHasMedia(question)
+		if game.MediaPending {
+			game.QuestionServed = game.QuestionServed.Add(MEDIA_READY_TIMEOUT)
+		}
+		return sendMessage(conn, questionMessage(question, game.Settings))
+
+	case MEDIA_READY:
+		if !game.MediaPending {
+			return nil
+		}
+		game.MediaPending = false
+		if now := time.Now(); now.Before(game.QuestionServed) {
+			game.QuestionServed = now
+		}
+		return sendMessage(conn, WSMessage{ Type: QUESTION_STARTED, })
+
+	case CHALLENGE_ANSWER:
+		floatAnswer, ok := msg.Payload["answer"].(float64)
+		if !ok {
+			return sendError(conn, 400, "expected answer to be given.")
+		}
+
+		if game.Pack.CurrentQuestion == 0 {
+			return sendError(conn, 400, "no question has been served yet.")
+		}
+		if game.Answered {
+			return sendError(conn, 409, "already answered this question")
+		}
+
+		if game.MediaPending && time.Now().Before(game.QuestionServed) {
+			return sendError(conn, 409, "the question has not started yet")
+		}
+
+		elapsed := time.Since(game.QuestionServed)
+		if questionExpired(game.Settings, elapsed) {
+			return sendError(conn, 409, "time is up")
+		}
+		game.Answered = true
+
+		question := game.Pack.Questions[game.Pack.CurrentQuestion - 1]
+		points, correct := scoreAnswer(game.Settings, question, int(floatAnswer), elapsed)
+		game.Score += points
+		if correct {
+			game.Correct++
+		}
+		saveSoloGame(dbConn, game, false)
+
+		// The question is over for the player once answered, so it's
+		// revealed right away.
+		payload := revealPayload(question)
+		payload["correct"] = correct
+		payload["points"] = points
+		payload["score"] = game.Score
+		return sendMessage(conn, WSMessage{
+			Type: CHALLENGE_ANSWERED,
+			Payload: payload,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Players can talk to each other inside of the room with chat messages
+// and emoji reactions. Both are broadcast to every connection of the room
+// and count against the same per-user rate limit. The owner can mute a
+// player and can disable the chat for players while a question is being
+// played. The last CHAT_HISTORY_SIZE messages are kept in the room and sent
+// to players when they (re)join.
+
+const (
+	CHAT_MAX_LENGTH   = 200
+	CHAT_HISTORY_SIZE = 50
+	// At most CHAT_RATE_LIMIT messages and reactions in CHAT_RATE_WINDOW.
+	CHAT_RATE_LIMIT   = 5
+	CHAT_RATE_WINDOW  = 10 * time.Second
+)
+
+var allowedReactions = map[string]bool{
+	"👍": true,
+	"👎": true,
+	"😂": true,
+	"😮": true,
+	"🔥": true,
+	"👏": true,
+	"🎉": true,
+	"🤔": true,
+}
+
+type ChatMessage struct {
+	UserId int       `json:"user_id"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+type Chat struct {
+	History         []ChatMessage
+	Muted           map[int]bool
+	// When set, only the owner can write while a question is being played.
+	QuietQuestions  bool
+
+	sent            map[int][]time.Time
+}
+
+func newChat() Chat {
+	return Chat{
+		Muted: make(map[int]bool),
+		sent: make(map[int][]time.Time),
+	}
+}
+
+// Returns an empty string if the user can post in the chat of the room,
+// otherwise returns the reason why they can't. Allowed posts are recorded
+// for the rate limit.
+func checkCanChat(room *Room, userId int) string {
+	user, ok := room.Users[userId]
+	if !ok {
+		return "not in the room"
+	}
+
+	if user.Role != OWNER {
+		if room.Chat.Muted[userId] {
+			return "muted by the room owner"
+		}
+		if room.Chat.QuietQuestions && room.Started && !room.Finished && room.Pack.CurrentQuestion > 0 {
+			return "chat is disabled during questions"
+		}
+	}
+
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range room.Chat.sent[userId] {
+		if now.Sub(t) < CHAT_RATE_WINDOW {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= CHAT_RATE_LIMIT {
+		room.Chat.sent[userId] = recent
+		return "too many messages, slow down"
+	}
+	room.Chat.sent[userId] = append(recent, now)
+	return ""
+}
+
+// Validates the text of a chat message. Returns the trimmed text and an
+// empty string, or the reason why the text can't be sent.
+func checkChatText(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", "empty message"
+	}
+	if utf8.RuneCountInString(text) > CHAT_MAX_LENGTH {
+		return "", "message is too long"
+	}
+	return text, ""
+}
+
+func postChatMessage(room *Room, userId int, text string) {
+	chatMsg := ChatMessage{
+		UserId: userId,
+		Text: text,
+		SentAt: time.Now().UTC(),
+	}
+
+	room.Chat.History = append(room.Chat.History, chatMsg)
+	if len(room.Chat.History) > CHAT_HISTORY_SIZE {
+		room.Chat.History = room.Chat.History[len(room.Chat.History) - CHAT_HISTORY_SIZE:]
+	}
+
+	broadcast(room, WSMessage{
+		Type: CHAT_MESSAGE,
+		Payload: map[string]any{
+			"message": chatMsg,
+		},
+	})
+}
+
+func sendChatState(room *Room) {
+	muted := []int{}
+	for id, m := range room.Chat.Muted {
+		if m {
+			muted = append(muted, id)
+		}
+	}
+
+	broadcast(room, WSMessage{
+		Type: CHAT_SETTINGS,
+		Payload: map[string]any{
+			"muted": muted,
+			"quiet_questions": room.Chat.QuietQuestions,
+		},
+	})
+}
+
+func chatHistoryMessage(room *Room) WSMessage {
+	history := room.Chat.History
+	if history == nil {
+		history = []ChatMessage{}
+	}
+	return WSMessage{
+		Type: CHAT_HISTORY,
+		Payload: map[string]any{
+			"messages": history,
+		},
+	}
+}
@@ -0,0 +1,209 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/jackc/pgx/v5"
+)
+
+// Records the state of the room in rooms.room, so the REST handlers know
+// whether the room can still be configured.
+func setRoomState(dbConn *pgx.Conn, roomId int, state string) {
+	_, err := database.Execute(dbConn, "UPDATE rooms.room SET state = $1 WHERE room_id = $2", state, roomId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update state of room %d: %v\n", roomId, err)
+	}
+}
+
+// Reads the body of the latest revision of the pack from the database.
+func loadPack(dbConn *pgx.Conn, packId int) (Pack, error) {
+	return scanPack(database.QueryRow(dbConn, "SELECT revision_id, body FROM packs.revision WHERE pack_id = $1 ORDER BY number DESC LIMIT 1", packId))
+}
+
+// Reads the body of the pinned revision (see handler.Revision) from the
+// database. Falls back to the latest revision of the pack if there's no
+// revision pinned.
+func loadRevision(dbConn *pgx.Conn, packId int, revisionId *int) (Pack, error) {
+	if revisionId == nil {
+		return loadPack(dbConn, packId)
+	}
+	return scanPack(database.QueryRow(dbConn, "SELECT revision_id, body FROM packs.revision WHERE revision_id = $1", *revisionId))
+}
+
+func scanPack(row pgx.Row) (Pack, error) {
+	var pack Pack
+	var rawPackBody json.RawMessage
+	err := row.Scan(&pack.RevisionId, &rawPackBody)
+	if err != nil {
+		return pack, err
+	}
+
+	err = json.Unmarshal(rawPackBody, &pack)
+	pack.CurrentQuestion = 0
+	return pack, err
+}
+
+// Shuffles the questions and the answers of the pack according to the
+// settings. Must be called before the first question is served.
+func shufflePack(pack *Pack, settings handler.RoomSettings) {
+	if settings.ShuffleQuestions {
+		rand.Shuffle(len(pack.Questions), func(i, j int) {
+			pack.Questions[i], pack.Questions[j] = pack.Questions[j], pack.Questions[i]
+		})
+	}
+
+	if settings.ShuffleAnswers {
+		for _, q := range pack.Questions {
+			rand.Shuffle(len(q.Answers), func(i, j int) {
+				q.Answers[i], q.Answers[j] = q.Answers[j], q.Answers[i]
+			})
+		}
+	}
+}
+
+// The question as the players see it while it's open. Which answers are
+// correct and the explanation are kept on the server until the question
+// is revealed.
+type ServedQuestion struct {
+	Title   string             `json:"title"`
+	ImgUrl  string             `json:"image_url"`
+	Value   int                `json:"value"`
+	Answers []ServedAnswer     `json:"answers"`
+	Media   *handler.PackMedia `json:"media,omitempty"`
+}
+
+type ServedAnswer struct {
+	Text   string `json:"text"`
+	ImgUrl string `json:"image_url,omitempty"`
+}
+
+func serveQuestion(question handler.PackQuestion) ServedQuestion {
+	served := ServedQuestion{
+		Title: question.Title,
+		ImgUrl: question.ImgUrl,
+		Value: question.Value,
+		Media: question.Media,
+	}
+	for _, a := range question.Answers {
+		served.Answers = append(served.Answers, ServedAnswer{ Text: a.Text, ImgUrl: a.ImgUrl })
+	}
+	return served
+}
+
+// Builds the message serving `question` to the players.
+func questionMessage(question handler.PackQuestion, settings handler.RoomSettings) WSMessage {
+	return WSMessage{
+		Type: QUESTION,
+		Payload: map[string]any{
+			"question": serveQuestion(question),
+			"time": settings.QuestionTime,
+		},
+	}
+}
+
+// Returns the indices of the correct answers with the explanation and the
+// source of `question`.
+func revealPayload(question handler.PackQuestion) map[string]any {
+	answers := []int{}
+	for i, a := range question.Answers {
+		if a.Correct {
+			answers = append(answers, i)
+		}
+	}
+	return map[string]any{
+		"answers": answers,
+		"explanation": question.Explanation,
+		"source": question.Source,
+	}
+}
+
+// Reveals the current question of the room to everyone unless it was
+// revealed already. A question is revealed once every player answered it,
+// its time is up or the next question is served. Must be called with
+// roomsMu held.
+func revealQuestion(room *Room) {
+	if room.revealTimer != nil {
+		room.revealTimer.Stop()
+		room.revealTimer = nil
+	}
+	if room.Revealed || room.Pack.CurrentQuestion == 0 {
+		return
+	}
+	room.Revealed = true
+
+	broadcast(room, WSMessage{
+		Type: REVEAL,
+		Payload: revealPayload(room.Pack.Questions[room.Pack.CurrentQuestion - 1]),
+	})
+}
+
+// Reveals the current question of the room once its time is up. Does
+// nothing for the questions without a time limit.
+func scheduleReveal(room *Room) {
+	if room.Settings.QuestionTime == 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(room.Settings.QuestionTime) * time.Second, func() {
+		roomsMu.Lock()
+		defer roomsMu.Unlock()
+
+		// The question could have been revealed or the room closed
+		// while this function was waiting for the lock.
+		if room.revealTimer != timer || rooms[room.Id] != room {
+			return
+		}
+		room.revealTimer = nil
+		revealQuestion(room)
+	})
+	room.revealTimer = timer
+}
+
+// Returns true if the time given to answer the question is over.
+func questionExpired(settings handler.RoomSettings, elapsed time.Duration) bool {
+	return settings.QuestionTime != 0 && elapsed > time.Duration(settings.QuestionTime) * time.Second
+}
+
+// Returns the points `answer` is worth for `question` answered after
+// `elapsed` time, and whether the answer is correct.
+//
+// With the standard scoring a correct answer is worth the value of the
+// question. The negative scoring also takes the value away for a wrong
+// answer. The speed scoring gives at least half of the value for a correct
+// answer and the rest proportionally to the time left; without a question
+// time it behaves like the standard one.
+func scoreAnswer(settings handler.RoomSettings, question handler.PackQuestion, answer int, elapsed time.Duration) (int, bool) {
+	correct := answer >= 0 && answer < len(question.Answers) && question.Answers[answer].Correct
+
+	switch settings.ScoringMode {
+	case handler.SCORING_NEGATIVE:
+		if !correct {
+			return -question.Value, false
+		}
+		return question.Value, true
+
+	case handler.SCORING_SPEED:
+		if !correct {
+			return 0, false
+		}
+		if settings.QuestionTime == 0 {
+			return question.Value, true
+		}
+		total := time.Duration(settings.QuestionTime) * time.Second
+		left := max(total - elapsed, 0)
+		return question.Value / 2 + int(float64(question.Value - question.Value / 2) * float64(left) / float64(total)), true
+
+	default:
+		if !correct {
+			return 0, false
+		}
+		return question.Value, true
+	}
+}
@@ -0,0 +1,226 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+// Rooms don't live forever. The reaper periodically closes the rooms that
+// had no activity, had nobody connected or finished the game long enough
+// ago (see config.Config for the timeouts). Rooms in the database that are
+// not loaded in memory are closed once they were idle for the empty room
+// timeout, since nobody has ever joined them since the last activity.
+//
+// The in-memory state does not survive a restart, so on startup the
+// database is reconciled with it by ReconcileRooms.
+
+const (
+	CLOSE_REASON_IDLE       = "idle"
+	CLOSE_REASON_EMPTY      = "empty"
+	CLOSE_REASON_FINISHED   = "finished"
+	CLOSE_REASON_SHUTDOWN   = "shutdown"
+	CLOSE_REASON_OWNER_LEFT = "owner_left"
+)
+
+// Deletes the room with its players from the database.
+func deleteRoomRows(dbConn *pgx.Conn, roomId int) error {
+	_, err := database.Execute(dbConn, "DELETE FROM rooms.player WHERE room_id = $1", roomId)
+	if err != nil {
+		return err
+	}
+	_, err = database.Execute(dbConn, "DELETE FROM rooms.room WHERE room_id = $1", roomId)
+	return err
+}
+
+// Removes the room from the database and memory, notifies every connection
+// of the room with `reason` and closes them. Must be called with roomsMu held.
+func closeRoom(dbConn *pgx.Conn, room *Room, reason string) {
+	err := deleteRoomRows(dbConn, room.Id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not close room %d: %v\n", room.Id, err)
+		return
+	}
+
+	if room.countdown != nil {
+		room.countdown.Stop()
+		room.countdown = nil
+	}
+	if room.rematch != nil {
+		room.rematch.timer.Stop()
+		room.rematch = nil
+	}
+	if room.revealTimer != nil {
+		room.revealTimer.Stop()
+		room.revealTimer = nil
+	}
+	if room.mediaTimer != nil {
+		room.mediaTimer.Stop()
+		room.mediaTimer = nil
+	}
+	room.mediaPending = nil
+
+	for _, c := range room.Connections {
+		sendMessage(c, WSMessage{
+			Type: ROOM_CLOSED,
+			Payload: map[string]any{
+				"room_id": room.Id,
+				"reason": reason,
+			},
+		})
+		c.Close()
+	}
+	delete(rooms, room.Id)
+}
+
+// Forgets `conn` in every room, the matchmaking queue and the solo game or
+// practice it was part of. Called once the connection is gone, so the room can tell
+// whether anyone is still connected.
+func dropConnection(conn *websocket.Conn) {
+	delete(soloGames, conn)
+	delete(practiceSessions, conn)
+
+	for _, t := range queue {
+		if t.conn == conn {
+			removeTicket(t)
+			break
+		}
+	}
+
+	for _, room := range rooms {
+		for id, c := range room.Connections {
+			if c == conn {
+				delete(room.Connections, id)
+			}
+		}
+		if len(room.Connections) == 0 && room.EmptySince.IsZero() {
+			room.EmptySince = time.Now()
+		}
+	}
+}
+
+// Returns the reason to close the room or an empty string if the room
+// should stay open.
+func reapReason(room *Room, now time.Time) string {
+	if room.rematch != nil {
+		return ""
+	}
+	if room.Finished && now.Sub(room.FinishedAt) > config.AppConfig.RoomFinishedTimeout {
+		return CLOSE_REASON_FINISHED
+	}
+	if len(room.Connections) == 0 && !room.EmptySince.IsZero() &&
+		now.Sub(room.EmptySince) > config.AppConfig.RoomEmptyTimeout {
+		return CLOSE_REASON_EMPTY
+	}
+	if now.Sub(room.LastActivity) > config.AppConfig.RoomIdleTimeout {
+		return CLOSE_REASON_IDLE
+	}
+	return ""
+}
+
+func reapRooms() {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	dbConn := database.GetConnection()
+	defer dbConn.Close(context.Background())
+
+	now := time.Now()
+	for _, room := range rooms {
+		if reason := reapReason(room, now); reason != "" {
+			closeRoom(dbConn, room, reason)
+		}
+	}
+
+	// Nobody has joined the rooms that are only in the database. The rooms
+	// of the tournament matches wait longer, their players are only told
+	// about them.
+	rows := database.QueryRows(dbConn, "SELECT r.room_id FROM rooms.room r WHERE r.state = $1 AND r.last_activity < (CASE WHEN EXISTS (SELECT * FROM rooms.tournament_match m WHERE m.room_id = r.room_id AND m.state = $4) THEN $3 ELSE $2 END)",
+		handler.ROOM_LOBBY, now.Add(-config.AppConfig.RoomEmptyTimeout), now.Add(-config.AppConfig.TournamentMatchTimeout), handler.MATCH_PLAYING)
+	var stale []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read stale rooms: %v\n", err)
+			break
+		}
+		if _, ok := rooms[id]; !ok {
+			stale = append(stale, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range stale {
+		err := deleteRoomRows(dbConn, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not close room %d: %v\n", id, err)
+		}
+	}
+}
+
+// Starts the background reaper of rooms.
+func StartReaper() {
+	go func() {
+		ticker := time.NewTicker(config.AppConfig.RoomReapInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reapRooms()
+		}
+	}()
+}
+
+// Brings the database in line with the in-memory state on startup. Nobody
+// is connected yet, so there are no players in any room and the games that
+// were being played are lost. Rooms waiting in the lobby or scheduled for
+// later are kept, so their owners can get back to them.
+func ReconcileRooms() {
+	dbConn := database.GetConnection()
+	defer dbConn.Close(context.Background())
+
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	_, err := database.Execute(dbConn, "DELETE FROM rooms.player WHERE NOT (room_id = ANY($1))", loadedRoomIds())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not reconcile the players of the rooms: %v\n", err)
+		return
+	}
+	_, err = database.Execute(dbConn, "DELETE FROM rooms.room WHERE NOT (state = ANY($1)) AND NOT (room_id = ANY($2))",
+		[]string{handler.ROOM_LOBBY, handler.ROOM_SCHEDULED}, loadedRoomIds())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not delete the rooms left over from the last run: %v\n", err)
+		return
+	}
+	_, err = database.Execute(dbConn, "UPDATE rooms.room SET current_users = 0 WHERE NOT (room_id = ANY($1))", loadedRoomIds())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not reset the users of the rooms: %v\n", err)
+	}
+}
+
+// Closes every room in memory. Used when the server is shutting down.
+func CloseAllRooms() {
+	dbConn := database.GetConnection()
+	defer dbConn.Close(context.Background())
+
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	for _, room := range rooms {
+		closeRoom(dbConn, room, CLOSE_REASON_SHUTDOWN)
+	}
+}
+
+func loadedRoomIds() []int {
+	ids := []int{}
+	for id := range rooms {
+		ids = append(ids, id)
+	}
+	return ids
+}
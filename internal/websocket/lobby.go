@@ -0,0 +1,193 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/jackc/pgx/v5"
+)
+
+// Before the game starts the room is in the lobby. Every player toggles
+// the ready flag and the owner can start the game only once the room has
+// at least min_players players and all of them are ready. The owner starting
+// the game counts as being ready.
+//
+// If the room has auto_start set, a countdown of auto_start seconds begins
+// as soon as everyone, the owner included, is ready. The countdown is
+// cancelled when someone becomes unready, leaves or joins the room.
+
+// Sends `msg` to every connection of the room ignoring the failed ones.
+func broadcast(room *Room, msg WSMessage) {
+	for _, c := range room.Connections {
+		sendMessage(c, msg)
+	}
+}
+
+// Returns the users of the room with their names and in-game state.
+func listUsers(dbConn *pgx.Conn, room *Room) ([]User, error) {
+	rows := database.QueryRows(dbConn, "SELECT u.user_id, u.name FROM rooms.player p JOIN users.\"user\" u ON p.user_id = u.user_id WHERE p.room_id = $1", room.Id)
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.Id, &user.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if u, ok := room.Users[user.Id]; ok {
+			user.Role = u.Role
+			user.Score = u.Score
+			user.Ready = u.Ready
+		}
+		user.RoomId = room.Id
+
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func readyUsers(room *Room) int {
+	ready := 0
+	for _, user := range room.Users {
+		if user.Ready {
+			ready++
+		}
+	}
+	return ready
+}
+
+// Returns an empty string if the owner can start the game, otherwise
+// returns the reason why the game can't be started.
+func checkCanStart(room *Room) string {
+	if room.Started {
+		return "game already started"
+	}
+	if len(room.Users) < room.Settings.MinPlayers {
+		return "not enough players"
+	}
+	for _, user := range room.Users {
+		if user.Role != OWNER && !user.Ready {
+			return "not all players are ready"
+		}
+	}
+	return ""
+}
+
+func sendLobbyState(room *Room) {
+	broadcast(room, WSMessage{
+		Type: LOBBY_STATE,
+		Payload: map[string]any{
+			"ready": readyUsers(room),
+			"total": len(room.Users),
+			"min_players": room.Settings.MinPlayers,
+			"can_start": checkCanStart(room) == "",
+			"countdown": room.countdown != nil,
+		},
+	})
+}
+
+func cancelCountdown(room *Room) {
+	if room.countdown == nil {
+		return
+	}
+	room.countdown.Stop()
+	room.countdown = nil
+	broadcast(room, WSMessage{ Type: COUNTDOWN_CANCELLED, })
+}
+
+// Starts or cancels the auto-start countdown depending on the state of the
+// lobby. Must be called with roomsMu held after any change to the users
+// of the room or to their ready flags.
+func updateCountdown(room *Room) {
+	everyoneReady := checkCanStart(room) == "" && readyUsers(room) == len(room.Users)
+	if room.Settings.AutoStart == 0 || !everyoneReady {
+		cancelCountdown(room)
+		return
+	}
+	if room.countdown != nil {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(room.Settings.AutoStart) * time.Second, func() {
+		roomsMu.Lock()
+		defer roomsMu.Unlock()
+
+		// The countdown could have been cancelled or replaced while
+		// this function was waiting for the lock.
+		if room.countdown != timer || rooms[room.Id] != room {
+			return
+		}
+		room.countdown = nil
+		if checkCanStart(room) == "" {
+			dbConn := database.GetConnection()
+			defer dbConn.Close(context.Background())
+			startGame(dbConn, room)
+		}
+	})
+	room.countdown = timer
+
+	broadcast(room, WSMessage{
+		Type: COUNTDOWN_STARTED,
+		Payload: map[string]any{
+			"seconds": room.Settings.AutoStart,
+		},
+	})
+}
+
+// Reloads the name, the settings and the pack of the room, which can be
+// changed through the REST API while the lobby is open. The pack is loaded
+// again only when the room was switched to another pack or revision.
+func reloadRoom(dbConn *pgx.Conn, room *Room) error {
+	settings := handler.DefaultRoomSettings()
+	var name string
+	var packId int
+	var revisionId *int
+	err := database.QueryRow(dbConn, "SELECT name, pack_id, settings, revision_id FROM rooms.room WHERE room_id = $1", room.Id).
+		Scan(&name, &packId, &settings, &revisionId)
+	if err != nil {
+		return err
+	}
+
+	samePack := packId == room.PackId &&
+		(revisionId == nil) == (room.RevisionId == nil) &&
+		(revisionId == nil || *revisionId == *room.RevisionId)
+	if !samePack {
+		pack, err := loadRevision(dbConn, packId, revisionId)
+		if err != nil {
+			return err
+		}
+		room.Pack = pack
+		room.PackId = packId
+		room.RevisionId = revisionId
+	}
+	room.Name = name
+	room.Settings = settings
+	return nil
+}
+
+func startGame(dbConn *pgx.Conn, room *Room) {
+	if room.countdown != nil {
+		room.countdown.Stop()
+		room.countdown = nil
+	}
+	err := reloadRoom(dbConn, room)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not reload the room %d, starting with the old settings: %v\n", room.Id, err)
+	}
+	shufflePack(&room.Pack, room.Settings)
+	room.Started = true
+	setRoomState(dbConn, room.Id, handler.ROOM_PLAYING)
+	broadcast(room, WSMessage{
+		Type: GAME_STARTED,
+		Payload: map[string]any{
+			"media": packMedia(room.Pack),
+		},
+	})
+}
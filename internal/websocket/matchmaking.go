@@ -0,0 +1,267 @@
+package websocket
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+// Players who want to play with strangers join the matchmaking queue. They
+// can ask for a specific pack or a category of packs from the pool of the
+// server (rooms.matchmaking_pack) and for opponents with a rating close to
+// theirs. As soon as config.MatchmakingPlayers compatible players are
+// waiting, a room is created for them with a pack from the pool and each
+// one of them gets a MATCH_FOUND message with the room to join. Players
+// leave the queue after config.MatchmakingTimeout.
+//
+// The queue is guarded by roomsMu like the rooms themselves, since both of
+// them write to the same connections.
+
+type Ticket struct {
+	UserId     int
+	// Zero for any pack.
+	PackId     int
+	// Empty for any category.
+	Category   string
+	Rating     int
+	// The largest rating difference accepted. Zero accepts anybody.
+	RatingBand int
+	QueuedAt   time.Time
+
+	conn       *websocket.Conn
+	timer      *time.Timer
+}
+
+var queue []*Ticket
+
+// The rating of a player is the percentage of the matches they won.
+func playerRating(dbConn *pgx.Conn, userId int) (int, error) {
+	var played, won int
+	err := database.QueryRow(dbConn, "SELECT matches_played, matches_won FROM users.\"user\" WHERE user_id = $1", userId).
+		Scan(&played, &won)
+	if err != nil || played == 0 {
+		return 0, err
+	}
+	return won * 100 / played, nil
+}
+
+func ticketsCompatible(a, b *Ticket) bool {
+	if a.PackId != 0 && b.PackId != 0 && a.PackId != b.PackId {
+		return false
+	}
+	if a.Category != "" && b.Category != "" && a.Category != b.Category {
+		return false
+	}
+
+	diff := a.Rating - b.Rating
+	if diff < 0 {
+		diff = -diff
+	}
+	if a.RatingBand != 0 && diff > a.RatingBand {
+		return false
+	}
+	if b.RatingBand != 0 && diff > b.RatingBand {
+		return false
+	}
+	return true
+}
+
+func findTicket(userId int) int {
+	for i, t := range queue {
+		if t.UserId == userId {
+			return i
+		}
+	}
+	return -1
+}
+
+// Removes the ticket from the queue. Returns false if it wasn't queued.
+func removeTicket(ticket *Ticket) bool {
+	for i, t := range queue {
+		if t == ticket {
+			ticket.timer.Stop()
+			queue = append(queue[:i], queue[i + 1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Puts the ticket in the queue and tries to find a match for it.
+func enqueue(dbConn *pgx.Conn, ticket *Ticket) {
+	ticket.QueuedAt = time.Now()
+	ticket.timer = time.AfterFunc(config.AppConfig.MatchmakingTimeout, func() {
+		roomsMu.Lock()
+		defer roomsMu.Unlock()
+
+		if removeTicket(ticket) {
+			sendMessage(ticket.conn, WSMessage{ Type: QUEUE_TIMEOUT, })
+		}
+	})
+	queue = append(queue, ticket)
+
+	sendMessage(ticket.conn, WSMessage{
+		Type: QUEUED,
+		Payload: map[string]any{
+			"rating": ticket.Rating,
+			"timeout": int(config.AppConfig.MatchmakingTimeout.Seconds()),
+		},
+	})
+
+	group := []*Ticket{ ticket }
+	for _, t := range queue {
+		if len(group) == config.AppConfig.MatchmakingPlayers {
+			break
+		}
+		if t == ticket {
+			continue
+		}
+
+		compatible := true
+		for _, g := range group {
+			if !ticketsCompatible(t, g) {
+				compatible = false
+				break
+			}
+		}
+		if compatible {
+			group = append(group, t)
+		}
+	}
+
+	if len(group) == config.AppConfig.MatchmakingPlayers {
+		createMatch(dbConn, group)
+	}
+}
+
+// Creates a room for the group with a pack from the pool that satisfies
+// the preferences of everyone and tells the players to join it. The player
+// who waited the longest owns the room.
+func createMatch(dbConn *pgx.Conn, group []*Ticket) {
+	packId, category := 0, ""
+	for _, t := range group {
+		if t.PackId != 0 {
+			packId = t.PackId
+		}
+		if t.Category != "" {
+			category = t.Category
+		}
+	}
+
+	err := database.QueryRow(dbConn, "SELECT m.pack_id FROM rooms.matchmaking_pack m JOIN packs.pack p ON m.pack_id = p.pack_id WHERE ($1 = 0 OR m.pack_id = $1) AND ($2 = '' OR m.category = $2) AND p.state = $3 AND p.visibility = $4 ORDER BY random() LIMIT 1",
+		packId, category, handler.PACK_PUBLISHED, handler.VISIBILITY_PUBLIC).
+		Scan(&packId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not pick a matchmaking pack: %v\n", err)
+		return
+	}
+
+	sort.Slice(group, func(i, j int) bool {
+		return group[i].QueuedAt.Before(group[j].QueuedAt)
+	})
+
+	settings := handler.DefaultRoomSettings()
+	settings.MaxPlayers = len(group)
+	settings.MinPlayers = 2
+	settings.Visibility = handler.VISIBILITY_UNLISTED
+
+	room := handler.Room{
+		Name: "Quick match",
+		PackId: packId,
+		UserId: group[0].UserId,
+		Settings: settings,
+		State: handler.ROOM_LOBBY,
+	}
+	err = handler.InsertRoom(dbConn, &room)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create a matchmaking room: %v\n", err)
+		return
+	}
+
+	players := []int{}
+	for _, t := range group {
+		players = append(players, t.UserId)
+	}
+
+	for _, t := range group {
+		removeTicket(t)
+		sendMessage(t.conn, WSMessage{
+			Type: MATCH_FOUND,
+			Payload: map[string]any{
+				"room_id": room.Id,
+				"pack_id": room.PackId,
+				"players": players,
+			},
+		})
+	}
+}
+
+// Handles the QUEUE_JOIN and QUEUE_LEAVE actions. Returns the error of
+// writing to the connection.
+func handleQueueMessage(conn *websocket.Conn, dbConn *pgx.Conn, session *handler.Session, msg WSMessage) error {
+	if msg.Type == QUEUE_LEAVE {
+		i := findTicket(session.UserId)
+		if i == -1 {
+			return sendError(conn, 409, "not in the queue")
+		}
+		removeTicket(queue[i])
+		return sendMessage(conn, WSMessage{ Type: QUEUE_LEFT, })
+	}
+
+	if findTicket(session.UserId) != -1 {
+		return sendError(conn, 409, "already in the queue")
+	}
+
+	var inGame bool
+	err := database.QueryRow(dbConn, "SELECT EXISTS (SELECT * FROM rooms.player WHERE user_id = $1)", session.UserId).
+		Scan(&inGame)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check user game status: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+	if inGame {
+		return sendError(conn, 400, "already in game")
+	}
+
+	ticket := &Ticket{
+		UserId: session.UserId,
+		conn: conn,
+	}
+
+	if packIdFloat, ok := msg.Payload["pack_id"].(float64); ok {
+		ticket.PackId = int(packIdFloat)
+		err = database.QueryRow(dbConn, "SELECT category FROM rooms.matchmaking_pack WHERE pack_id = $1", ticket.PackId).
+			Scan(&ticket.Category)
+		if err != nil {
+			return sendError(conn, 404, "the pack is not available for matchmaking")
+		}
+	} else if category, ok := msg.Payload["category"].(string); ok && category != "" {
+		var exists bool
+		err = database.QueryRow(dbConn, "SELECT EXISTS (SELECT * FROM rooms.matchmaking_pack WHERE category = $1)", category).
+			Scan(&exists)
+		if err != nil || !exists {
+			return sendError(conn, 404, "no packs with this category are available for matchmaking")
+		}
+		ticket.Category = category
+	}
+
+	if band, ok := msg.Payload["rating_band"].(float64); ok && band > 0 {
+		ticket.RatingBand = int(band)
+	}
+
+	ticket.Rating, err = playerRating(dbConn, session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get the rating of the user: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+
+	enqueue(dbConn, ticket)
+	return nil
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/handler"
+)
+
+// Questions can come with pictures and clips (see handler.PackMedia), and
+// answers with pictures. Every media of the pack is listed in GAME_STARTED,
+// so the clients can start loading it right away.
+//
+// The time to answer a question with media starts only once every player
+// reported with MEDIA_READY that they have buffered it, so nobody loses
+// time on a slow connection. Until then the question can't be answered.
+// A player that doesn't report within MEDIA_READY_TIMEOUT is not waited
+// for anymore. QUESTION_STARTED tells the players the time is running.
+
+const MEDIA_READY_TIMEOUT = 10 * time.Second
+
+// Returns the urls of every picture and clip of the pack.
+func packMedia(pack Pack) []string {
+	media := []string{}
+	seen := make(map[string]bool)
+	add := func(url string) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			media = append(media, url)
+		}
+	}
+
+	for _, q := range pack.Questions {
+		add(q.ImgUrl)
+		if q.Media != nil {
+			add(q.Media.Url)
+		}
+		for _, a := range q.Answers {
+			add(a.ImgUrl)
+		}
+	}
+	return media
+}
+
+// Returns true if the players must load something before the question
+// can be answered.
+func questionHasMedia(question handler.PackQuestion) bool {
+	if question.Media != nil {
+		return true
+	}
+	for _, a := range question.Answers {
+		if a.ImgUrl != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Starts the time to answer the current question of the room.
+func startQuestionClock(room *Room) {
+	if room.mediaTimer != nil {
+		room.mediaTimer.Stop()
+		room.mediaTimer = nil
+	}
+	room.mediaPending = nil
+	room.QuestionServed = time.Now()
+	scheduleReveal(room)
+}
+
+// Waits for the connected players to load the media of the current
+// question before starting its time. Must be called with roomsMu held.
+func waitForMedia(room *Room) {
+	room.mediaPending = make(map[int]bool)
+	for id := range room.Users {
+		if _, ok := room.Connections[id]; ok {
+			room.mediaPending[id] = true
+		}
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(MEDIA_READY_TIMEOUT, func() {
+		roomsMu.Lock()
+		defer roomsMu.Unlock()
+
+		if room.mediaTimer != timer || rooms[room.Id] != room {
+			return
+		}
+		room.mediaTimer = nil
+		startQuestionClock(room)
+		broadcast(room, WSMessage{ Type: QUESTION_STARTED, })
+	})
+	room.mediaTimer = timer
+}
+
+// Records that the user has loaded the media of the current question and
+// starts its time once everyone has. Must be called with roomsMu held.
+func mediaReady(room *Room, userId int) {
+	if room.mediaPending == nil {
+		return
+	}
+	delete(room.mediaPending, userId)
+	if len(room.mediaPending) == 0 {
+		startQuestionClock(room)
+		broadcast(room, WSMessage{ Type: QUESTION_STARTED, })
+	}
+}
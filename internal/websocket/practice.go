@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+// Any pack can be practiced alone (see handler.GetPracticeStats). Practice
+// doesn't create a room and doesn't count as a match. PRACTICE_START begins
+// the practice of a pack, PRACTICE_NEXT serves the questions one at a time
+// in random order and PRACTICE_ANSWER answers the current one, getting the
+// correct answers with the explanation right away. There's no time limit.
+//
+// The questions answered wrong are remembered as mistakes of the user, and
+// forgotten once answered right. PRACTICE_START with `mistakes` set serves
+// only the mistakes made in the pack.
+
+type Practice struct {
+	UserId   int
+	PackId   int
+	Pack     Pack
+	Answered bool
+	Correct  int
+}
+
+// Practices by the connection playing them. Guarded by roomsMu.
+var practiceSessions = make(map[*websocket.Conn]*Practice)
+
+// Settings of the practice questions: no time limit and random order.
+var practiceSettings = handler.RoomSettings{ ShuffleQuestions: true }
+
+// Keeps only the questions of the pack the user made a mistake in.
+func filterMistakes(dbConn *pgx.Conn, userId int, packId int, pack *Pack) error {
+	rows := database.QueryRows(dbConn, "SELECT question FROM users.practice_mistake WHERE user_id = $1 AND pack_id = $2",
+		userId, packId)
+	defer rows.Close()
+
+	mistakes := make(map[string]bool)
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return err
+		}
+		mistakes[title] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var questions []handler.PackQuestion
+	for _, q := range pack.Questions {
+		if mistakes[q.Title] {
+			questions = append(questions, q)
+		}
+	}
+	pack.Questions = questions
+	return nil
+}
+
+func startPractice(conn *websocket.Conn, dbConn *pgx.Conn, session *handler.Session, msg WSMessage) error {
+	if _, ok := practiceSessions[conn]; ok {
+		return sendError(conn, 409, "already practicing")
+	}
+
+	packIdFloat, ok := msg.Payload["pack_id"].(float64)
+	if !ok {
+		return sendError(conn, 400, "missing pack_id")
+	}
+	packId := int(packIdFloat)
+
+	playable, err := handler.CanPlayPack(dbConn, packId, session.UserId, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check the pack to practice: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+	if !playable {
+		return sendError(conn, 404, "no pack with this id exists")
+	}
+
+	pack, err := loadPack(dbConn, packId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return sendError(conn, 404, "no pack with this id exists")
+		}
+		fmt.Fprintf(os.Stderr, "Could not load the pack to practice: %v\n", err)
+		return sendError(conn, 500, "internal server error")
+	}
+
+	if mistakes, _ := msg.Payload["mistakes"].(bool); mistakes {
+		err = filterMistakes(dbConn, session.UserId, packId, &pack)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get the practice mistakes: %v\n", err)
+			return sendError(conn, 500, "internal server error")
+		}
+	}
+
+	if len(pack.Questions) == 0 {
+		return sendError(conn, 409, "no questions to practice")
+	}
+	shufflePack(&pack, practiceSettings)
+
+	_, err = database.Execute(dbConn, "INSERT INTO users.practice_stats (user_id, sessions_played) VALUES ($1, 1) ON CONFLICT (user_id) DO UPDATE SET sessions_played = practice_stats.sessions_played + 1",
+		session.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update practice stats: %v\n", err)
+	}
+
+	practiceSessions[conn] = &Practice{
+		UserId: session.UserId,
+		PackId: packId,
+		Pack: pack,
+	}
+
+	return sendMessage(conn, WSMessage{
+		Type: PRACTICE_STARTED,
+		Payload: map[string]any{
+			"pack_id": packId,
+			"questions": len(pack.Questions),
+		},
+	})
+}
+
+// Records the answer in the practice stats and the mistakes of the user.
+func recordPracticeAnswer(dbConn *pgx.Conn, practice *Practice, question handler.PackQuestion, correct bool) {
+	correctAnswers := 0
+	if correct {
+		correctAnswers = 1
+	}
+	_, err := database.Execute(dbConn, "UPDATE users.practice_stats SET questions_answered = questions_answered + 1, correct_answers = correct_answers + $1 WHERE user_id = $2",
+		correctAnswers, practice.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update practice stats: %v\n", err)
+	}
+
+	if correct {
+		_, err = database.Execute(dbConn, "DELETE FROM users.practice_mistake WHERE user_id = $1 AND pack_id = $2 AND question = $3",
+			practice.UserId, practice.PackId, question.Title)
+	} else {
+		_, err = database.Execute(dbConn, "INSERT INTO users.practice_mistake (user_id, pack_id, question) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			practice.UserId, practice.PackId, question.Title)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update practice mistakes: %v\n", err)
+	}
+}
+
+// Handles the PRACTICE_START, PRACTICE_NEXT and PRACTICE_ANSWER actions.
+// Returns the error of writing to the connection.
+func handlePracticeMessage(conn *websocket.Conn, dbConn *pgx.Conn, session *handler.Session, msg WSMessage) error {
+	if msg.Type == PRACTICE_START {
+		return startPractice(conn, dbConn, session, msg)
+	}
+
+	practice, ok := practiceSessions[conn]
+	if !ok {
+		return sendError(conn, 409, "not practicing")
+	}
+
+	switch msg.Type {
+	case PRACTICE_NEXT:
+		if practice.Pack.CurrentQuestion >= len(practice.Pack.Questions) {
+			delete(practiceSessions, conn)
+			return sendMessage(conn, WSMessage{
+				Type: PRACTICE_FINISHED,
+				Payload: map[string]any{
+					"pack_id": practice.PackId,
+					"correct": practice.Correct,
+					"questions": len(practice.Pack.Questions),
+				},
+			})
+		}
+
+		question := practice.Pack.Questions[practice.Pack.CurrentQuestion]
+		practice.Pack.CurrentQuestion++
+		practice.Answered = false
+		return sendMessage(conn, questionMessage(question, practiceSettings))
+
+	case PRACTICE_ANSWER:
+		floatAnswer, ok := msg.Payload["answer"].(float64)
+		if !ok {
+			return sendError(conn, 400, "expected answer to be given.")
+		}
+
+		if practice.Pack.CurrentQuestion == 0 {
+			return sendError(conn, 400, "no question has been served yet.")
+		}
+		if practice.Answered {
+			return sendError(conn, 409, "already answered this question")
+		}
+		practice.Answered = true
+
+		question := practice.Pack.Questions[practice.Pack.CurrentQuestion - 1]
+		_, correct := scoreAnswer(practiceSettings, question, int(floatAnswer), 0)
+		if correct {
+			practice.Correct++
+		}
+		recordPracticeAnswer(dbConn, practice, question, correct)
+
+		payload := revealPayload(question)
+		payload["correct"] = correct
+		return sendMessage(conn, WSMessage{
+			Type: PRACTICE_ANSWERED,
+			Payload: payload,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/jackc/pgx/v5"
+)
+
+// Once the game is finished the owner can offer a rematch, optionally with
+// a different pack. The players have REMATCH_WINDOW to opt in. When everyone
+// accepted or the window is over, the players who didn't accept are removed
+// from the room and the rest go back to the lobby with their scores reset.
+
+const REMATCH_WINDOW = 30 * time.Second
+
+type Rematch struct {
+	PackId   int
+	// The body of the new pack. Unused if the pack doesn't change.
+	Pack     Pack
+	Accepted map[int]bool
+
+	timer    *time.Timer
+}
+
+func rematchPayload(room *Room) map[string]any {
+	accepted := []int{}
+	for id := range room.rematch.Accepted {
+		accepted = append(accepted, id)
+	}
+	return map[string]any{
+		"pack_id": room.rematch.PackId,
+		"seconds": int(REMATCH_WINDOW.Seconds()),
+		"accepted": accepted,
+	}
+}
+
+// Offers the rematch to the players of the room. The owner accepts it
+// implicitly.
+func offerRematch(room *Room, packId int, pack Pack) {
+	rematch := &Rematch{
+		PackId: packId,
+		Pack: pack,
+		Accepted: map[int]bool{ room.UserId: true },
+	}
+	rematch.timer = time.AfterFunc(REMATCH_WINDOW, func() {
+		roomsMu.Lock()
+		defer roomsMu.Unlock()
+
+		if room.rematch != rematch || rooms[room.Id] != room {
+			return
+		}
+
+		dbConn := database.GetConnection()
+		defer dbConn.Close(context.Background())
+		startRematch(dbConn, room)
+	})
+	room.rematch = rematch
+
+	broadcast(room, WSMessage{
+		Type: REMATCH_OFFERED,
+		Payload: rematchPayload(room),
+	})
+}
+
+// Removes the players who didn't accept the rematch and brings the room
+// back to the lobby. The room stays finished if it can't be brought back.
+// Must be called with roomsMu held.
+func startRematch(dbConn *pgx.Conn, room *Room) {
+	rematch := room.rematch
+	rematch.timer.Stop()
+	room.rematch = nil
+
+	packId, revisionId := room.PackId, room.RevisionId
+	if rematch.PackId != room.PackId {
+		packId, revisionId = rematch.PackId, &rematch.Pack.RevisionId
+	}
+	players := 0
+	for id := range room.Users {
+		if rematch.Accepted[id] {
+			players++
+		}
+	}
+
+	_, err := database.Execute(dbConn, "UPDATE rooms.room SET pack_id = $1, revision_id = $2, current_users = $3, state = $4, last_activity = NOW() WHERE room_id = $5",
+		packId, revisionId, players, handler.ROOM_LOBBY, room.Id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not bring room %d back to the lobby: %v\n", room.Id, err)
+		for _, c := range room.Connections {
+			sendError(c, 500, "could not start the rematch")
+		}
+		return
+	}
+
+	for id := range room.Users {
+		if rematch.Accepted[id] {
+			continue
+		}
+
+		_, err = database.Execute(dbConn, "DELETE FROM rooms.player WHERE user_id = $1", id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not remove user %d from room %d: %v\n", id, room.Id, err)
+		}
+		delete(room.Users, id)
+		if c, ok := room.Connections[id]; ok {
+			sendMessage(c, WSMessage{
+				Type: REMOVED_FROM_ROOM,
+				Payload: map[string]any{
+					"room_id": room.Id,
+					"reason": "rematch declined",
+				},
+			})
+			delete(room.Connections, id)
+		}
+	}
+
+	if rematch.PackId != room.PackId {
+		room.PackId = rematch.PackId
+		room.Pack = rematch.Pack
+		room.RevisionId = &room.Pack.RevisionId
+	}
+	room.Pack.CurrentQuestion = 0
+
+	for _, user := range room.Users {
+		user.Score = 0
+		user.Ready = false
+	}
+	room.Started = false
+	room.Finished = false
+	room.FinishedAt = time.Time{}
+	room.Answered = make(map[int]bool)
+	room.QuestionWon = false
+	room.Revealed = false
+	if room.revealTimer != nil {
+		room.revealTimer.Stop()
+		room.revealTimer = nil
+	}
+	if room.mediaTimer != nil {
+		room.mediaTimer.Stop()
+		room.mediaTimer = nil
+	}
+	room.mediaPending = nil
+
+	broadcast(room, WSMessage{
+		Type: REMATCH_STARTED,
+		Payload: map[string]any{
+			"pack_id": room.PackId,
+		},
+	})
+
+	users, err := listUsers(dbConn, room)
+	if err == nil {
+		broadcast(room, WSMessage{
+			Type: USERS_LIST,
+			Payload: map[string]any{
+				"users": users,
+			},
+		})
+	}
+	sendLobbyState(room)
+}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/detectivekaktus/JGame/internal/database"
 	"github.com/detectivekaktus/JGame/internal/handler"
@@ -21,8 +23,9 @@ type ActionType string
 type UserRole   string
 
 const (
-	OWNER  UserRole = "owner"
-	PLAYER UserRole = "player"
+	OWNER     UserRole = "owner"
+	PLAYER    UserRole = "player"
+	SPECTATOR UserRole = "spectator"
 )
 
 const (
@@ -32,6 +35,12 @@ const (
 	LEAVE_ROOM     ActionType = "leave_room"
 	LEFT_ROOM      ActionType = "left_room"
 	ROOM_DELETED   ActionType = "room_deleted"
+	ROOM_CLOSED    ActionType = "room_closed"
+
+	SET_READY           ActionType = "set_ready"
+	LOBBY_STATE         ActionType = "lobby_state"
+	COUNTDOWN_STARTED   ActionType = "countdown_started"
+	COUNTDOWN_CANCELLED ActionType = "countdown_cancelled"
 
 	START_GAME     ActionType = "start_game"
 	GAME_STARTED   ActionType = "game_started"
@@ -45,9 +54,47 @@ const (
 	NEXT_QUESTION  ActionType = "next_question"
 	QUESTION       ActionType = "question"
 	QUESTIONS_DONE ActionType = "questions_done"
+	REVEAL         ActionType = "reveal"
+
+	MEDIA_READY      ActionType = "media_ready"
+	QUESTION_STARTED ActionType = "question_started"
 
 	ANSWER         ActionType = "answer"
 
+	REMATCH           ActionType = "rematch"
+	REMATCH_OFFERED   ActionType = "rematch_offered"
+	REMATCH_ACCEPT    ActionType = "rematch_accept"
+	REMATCH_STARTED   ActionType = "rematch_started"
+	REMOVED_FROM_ROOM ActionType = "removed_from_room"
+
+	CHAT_MESSAGE   ActionType = "chat_message"
+	REACTION       ActionType = "reaction"
+	CHAT_HISTORY   ActionType = "chat_history"
+	MUTE_USER      ActionType = "mute_user"
+	SET_CHAT       ActionType = "set_chat"
+	CHAT_SETTINGS  ActionType = "chat_settings"
+
+	QUEUE_JOIN     ActionType = "queue_join"
+	QUEUED         ActionType = "queued"
+	QUEUE_LEAVE    ActionType = "queue_leave"
+	QUEUE_LEFT     ActionType = "queue_left"
+	QUEUE_TIMEOUT  ActionType = "queue_timeout"
+	MATCH_FOUND    ActionType = "match_found"
+
+	CHALLENGE_START    ActionType = "challenge_start"
+	CHALLENGE_STARTED  ActionType = "challenge_started"
+	CHALLENGE_NEXT     ActionType = "challenge_next"
+	CHALLENGE_ANSWER   ActionType = "challenge_answer"
+	CHALLENGE_ANSWERED ActionType = "challenge_answered"
+	CHALLENGE_FINISHED ActionType = "challenge_finished"
+
+	PRACTICE_START    ActionType = "practice_start"
+	PRACTICE_STARTED  ActionType = "practice_started"
+	PRACTICE_NEXT     ActionType = "practice_next"
+	PRACTICE_ANSWER   ActionType = "practice_answer"
+	PRACTICE_ANSWERED ActionType = "practice_answered"
+	PRACTICE_FINISHED ActionType = "practice_finished"
+
 	ERROR          ActionType = "error"
 )
 
@@ -61,25 +108,14 @@ type User struct {
 	Name   string   `json:"name"`
 	Role   UserRole `json:"role"`
 	Score  int      `json:"score"`
+	Ready  bool     `json:"ready"`
 
 	RoomId int      `json:"room_id"`
 }
 
-type PackQuestion struct {
-	Title   string       `json:"title"`
-	ImgUrl  string       `json:"image_url"`
-	Value   int          `json:"value"`
-	Answers []PackAnswer `json:"answers"`
-}
-
-type PackAnswer struct {
-	Text    string `json:"text"`
-	Correct bool   `json:"correct"`
-}
-
 type Pack struct {
-	Title           string         `json:"title"`
-	Questions       []PackQuestion `json:"questions"`
+	handler.PackBody
+	RevisionId      int
 	CurrentQuestion int
 }
 
@@ -89,30 +125,67 @@ type Room struct {
 	Finished        bool
 	Users           map[int]*User
 	BannedUsers     map[int]*User
+	// Spectators only watch the game. They are not players of the room.
+	Spectators      map[int]bool
 
 	Pack            Pack
+	// Users who answered the current question and when it was served.
+	Answered        map[int]bool
+	QuestionServed  time.Time
+	// Set once somebody answered the current question correctly.
+	QuestionWon     bool
+	// Set once the correct answers of the current question were revealed.
+	Revealed        bool
 
 	Connections     map[int]*websocket.Conn
+
+	Chat            Chat
+
+	rematch         *Rematch
+
+	LastActivity    time.Time
+	// When the last connection of the room went away. Zero while someone
+	// is connected.
+	EmptySince      time.Time
+	FinishedAt      time.Time
+
+	countdown       *time.Timer
+	revealTimer     *time.Timer
+	// Players who haven't loaded the media of the current question yet.
+	// Nil when the time of the question is running.
+	mediaPending    map[int]bool
+	mediaTimer      *time.Timer
 }
 
 var rooms map[int]*Room = make(map[int]*Room)
 
+// Guards rooms and everything inside of them. Websocket handlers hold it
+// while processing a message, timers hold it while they fire.
+var roomsMu sync.Mutex
+
 var upgrader websocket.Upgrader = websocket.Upgrader{
 	ReadBufferSize: 2 << 9,
 	WriteBufferSize: 2 << 9,
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
-		return middleware.AllowedCorsOrigins[origin]
+		return middleware.IsAllowedCorsOrigin(origin)
 	},
 }
 
+// The messages are written with roomsMu held, so a client that stops
+// reading can't keep the other rooms waiting for longer than WRITE_TIMEOUT.
+// Its connection is closed then, which makes its handler drop it.
+const WRITE_TIMEOUT = 2 * time.Second
+
 func sendMessage(conn *websocket.Conn, msg WSMessage) error {
 	out, _ := json.Marshal(msg)
+	conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
 	err := conn.WriteMessage(websocket.TextMessage, out)
 	if err != nil {
 		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 			fmt.Fprintf(os.Stderr, "Writing websocket message went wrong: %v\n", err)
 		}
+		conn.Close()
 		return err
 	}
 	return nil
@@ -138,7 +211,25 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	defer func() {
+		roomsMu.Lock()
+		dropConnection(conn)
+		roomsMu.Unlock()
+	}()
+
+	locked := false
+	defer func() {
+		if locked {
+			roomsMu.Unlock()
+		}
+	}()
+
 	for {
+		if locked {
+			roomsMu.Unlock()
+			locked = false
+		}
+
 		_, raw, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
@@ -149,6 +240,49 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 		var msg WSMessage
 		json.Unmarshal(raw, &msg)
 		fmt.Println(msg)
+
+		roomsMu.Lock()
+		locked = true
+
+		// The actions below are not bound to a room.
+		switch msg.Type {
+		case QUEUE_JOIN, QUEUE_LEAVE:
+			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+			session := r.Context().Value("session").(*handler.Session)
+			err = handleQueueMessage(conn, dbConn, session, msg)
+			if err != nil {
+				return
+			}
+			continue
+		case CHALLENGE_START, CHALLENGE_NEXT, CHALLENGE_ANSWER:
+			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+			session := r.Context().Value("session").(*handler.Session)
+			err = handleChallengeMessage(conn, dbConn, session, msg)
+			if err != nil {
+				return
+			}
+			continue
+		case MEDIA_READY:
+			// Solo challenges report the media without a room.
+			if _, ok := msg.Payload["room_id"]; !ok {
+				dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+				session := r.Context().Value("session").(*handler.Session)
+				err = handleChallengeMessage(conn, dbConn, session, msg)
+				if err != nil {
+					return
+				}
+				continue
+			}
+		case PRACTICE_START, PRACTICE_NEXT, PRACTICE_ANSWER:
+			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+			session := r.Context().Value("session").(*handler.Session)
+			err = handlePracticeMessage(conn, dbConn, session, msg)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
 		roomIdFloat, ok := msg.Payload["room_id"].(float64)
 		if !ok {
 			err = sendError(conn, 400, "missing room_id")
@@ -159,6 +293,10 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		roomId := int(roomIdFloat)
 
+		if room, ok := rooms[roomId]; ok {
+			room.LastActivity = time.Now()
+		}
+
 		switch msg.Type {
 		case JOIN_ROOM: {
 			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
@@ -188,11 +326,57 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			var viewable bool
+			viewable, err = handler.CanViewRoomPack(dbConn, roomId, session.UserId)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not check the pack of the room: %v\n", err)
+				err = sendError(conn, 500, "internal server error")
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if !viewable {
+				err = sendError(conn, 403, "the pack of the room is not shared with you")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			password, _ := msg.Payload["password"].(string)
+			var visible bool
+			visible, err = handler.CanSeeRoom(dbConn, roomId, session.UserId, password)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not check the visibility of the room: %v\n", err)
+				err = sendError(conn, 500, "internal server error")
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if !visible {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
 			room, ok := rooms[roomId]
 			if !ok {
+				if spectate, _ := msg.Payload["spectate"].(bool); spectate {
+					err = sendError(conn, 409, "the room is not open yet")
+					if err != nil {
+						return
+					}
+					continue
+				}
+
 				var room Room
-				err = database.QueryRow(dbConn, "SELECT room_id, user_id, name, pack_id, current_users, max_users FROM rooms.room WHERE room_id = $1", roomId).
-					Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.MaxUsers)
+				room.Settings = handler.DefaultRoomSettings()
+				err = database.QueryRow(dbConn, "SELECT room_id, user_id, name, pack_id, current_users, settings, state, revision_id FROM rooms.room WHERE room_id = $1", roomId).
+					Scan(&room.Id, &room.UserId, &room.Name, &room.PackId, &room.CurrentUsers, &room.Settings, &room.State, &room.RevisionId)
 				if err != nil {
 					if err == sql.ErrNoRows {
 						err = sendError(conn, 404, "no room with this id exists.")
@@ -211,6 +395,32 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
+				if room.State == handler.ROOM_SCHEDULED {
+					err = sendError(conn, 409, "the room is not open yet")
+					if err != nil {
+						return
+					}
+					continue
+				}
+
+				var allowed bool
+				allowed, err = canTakeSeat(dbConn, roomId, session.UserId)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Could not check the seat of the user: %v\n", err)
+					err = sendError(conn, 500, "internal server error")
+					if err != nil {
+						return
+					}
+					continue
+				}
+				if !allowed {
+					err = sendError(conn, 403, "the room is reserved for the players of a tournament match")
+					if err != nil {
+						return
+					}
+					continue
+				}
+
 				_, err = database.Execute(dbConn, "INSERT INTO rooms.player (user_id, room_id) VALUES ($1, $2)", session.UserId, roomId)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Could not insert into the player table: %v\n", err)
@@ -222,30 +432,46 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
-				var rawPackBody json.RawMessage
-				err = database.QueryRow(dbConn, "SELECT body FROM packs.pack WHERE pack_id = $1", room.PackId).
-					Scan(&rawPackBody)
+				room.Pack, err = loadRevision(dbConn, room.PackId, room.RevisionId)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Could not load the pack of the room: %v\n", err)
+					err = sendError(conn, 500, "internal server error")
+					if err != nil {
+						return
+					}
+					conn.Close()
+					return
+				}
 
-				json.Unmarshal(rawPackBody, &room.Pack)
-				room.Pack.CurrentQuestion = 0
+				// Rooms created by the server, e.g. by matchmaking, may be
+				// entered by a player before their owner.
+				role := PLAYER
+				if session.UserId == room.UserId {
+					role = OWNER
+				}
 
 				room.Users = make(map[int]*User)
 				room.Users[session.UserId] = &User{
 					RoomId: roomId,
 					Id: session.UserId,
-					Role: OWNER,
+					Role: role,
 				}
 
 				room.Connections = make(map[int]*websocket.Conn)
 				room.Connections[session.UserId] = conn
 
 				room.Finished = false
+				room.LastActivity = time.Now()
 
 				room.BannedUsers = make(map[int]*User)
+				room.Spectators = make(map[int]bool)
+				room.Answered = make(map[int]bool)
+
+				room.Chat = newChat()
 
 				rooms[roomId] = &room
 
-				_, err = database.Execute(dbConn, "UPDATE rooms.room SET current_users = $1", len(room.Users))
+				_, err = database.Execute(dbConn, "UPDATE rooms.room SET current_users = $1, last_activity = NOW() WHERE room_id = $2", len(room.Users), roomId)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Could not update room: %v\n", err)
 					err = sendError(conn, 500, "internal server error")
@@ -260,7 +486,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 					Type: JOINED_ROOM,
 					Payload: map[string]any{
 						"user_id": session.UserId,
-						"role": OWNER,
+						"role": role,
 					},
 				})
 				if err != nil {
@@ -280,6 +506,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
 					user.Role = room.Users[user.Id].Role
 					user.Score = room.Users[user.Id].Score
+					user.Ready = room.Users[user.Id].Ready
 					user.RoomId = roomId
 
 					users = append(users, user)
@@ -293,20 +520,79 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 						},
 					})
 				}
+				sendLobbyState(&room)
 			} else {
-				oldConn, ok := room.Connections[session.UserId]
-				if ok {
-					oldConn.Close()
+				// The lobby can be changed through the REST API, so the new
+				// players get the current settings.
+				if !room.Started {
+					err = reloadRoom(dbConn, room)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Could not reload the room %d: %v\n", room.Id, err)
+					}
 				}
-				room.Connections[session.UserId] = conn
+				if spectate, _ := msg.Payload["spectate"].(bool); spectate && room.Users[session.UserId] == nil {
+					if !room.Settings.AllowSpectators {
+						err = sendError(conn, 403, "spectators are not allowed in this room")
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					oldConn, ok := room.Connections[session.UserId]
+					if ok {
+						oldConn.Close()
+					}
+					room.Connections[session.UserId] = conn
+					room.EmptySince = time.Time{}
+					room.Spectators[session.UserId] = true
 
-				if room.CurrentUsers >= handler.MAX_USERS_IN_ROOM {
+					sendMessage(conn, WSMessage{
+						Type: JOINED_ROOM,
+						Payload: map[string]any{
+							"role": SPECTATOR,
+							"user_id": session.UserId,
+						},
+					})
+					sendMessage(conn, chatHistoryMessage(room))
+					continue
+				}
+
+				if room.Users[session.UserId] == nil {
+					allowed, err := canTakeSeat(dbConn, roomId, session.UserId)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Could not check the seat of the user: %v\n", err)
+						err = sendError(conn, 500, "internal server error")
+						if err != nil {
+							return
+						}
+						continue
+					}
+					if !allowed {
+						err = sendError(conn, 403, "the room is reserved for the players of a tournament match")
+						if err != nil {
+							return
+						}
+						continue
+					}
+				}
+
+				if room.Users[session.UserId] == nil && len(room.Users) >= room.Settings.MaxPlayers {
 					err = sendError(conn, 503, "max users reached")
 					if err != nil {
 						return
 					}
+					continue
 				}
 
+				oldConn, ok := room.Connections[session.UserId]
+				if ok {
+					oldConn.Close()
+				}
+				room.Connections[session.UserId] = conn
+				room.EmptySince = time.Time{}
+				delete(room.Spectators, session.UserId)
+
 				user, ok := room.Users[session.UserId]
 				if ok {
 					sendMessage(conn, WSMessage{
@@ -316,6 +602,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 							"user_id": user.Id,
 						},
 					})
+					sendMessage(conn, chatHistoryMessage(room))
 					continue
 				}
 
@@ -330,13 +617,18 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
+				role := PLAYER
+				if session.UserId == room.UserId {
+					role = OWNER
+				}
+
 				room.Users[session.UserId] = &User{
 					RoomId: roomId,
 					Id: session.UserId,
-					Role: PLAYER,
+					Role: role,
 				}
 
-				_, err = database.Execute(dbConn, "UPDATE rooms.room SET current_users = $1", len(room.Users))
+				_, err = database.Execute(dbConn, "UPDATE rooms.room SET current_users = $1, last_activity = NOW() WHERE room_id = $2", len(room.Users), roomId)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Could not update room: %v\n", err)
 					err = sendError(conn, 500, "internal server error")
@@ -351,12 +643,13 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 					Type: JOINED_ROOM,
 					Payload: map[string]any{
 						"user_id": session.UserId,
-						"role": PLAYER,
+						"role": role,
 					},
 				})
 				if err != nil {
 					return
 				}
+				sendMessage(conn, chatHistoryMessage(room))
 
 				rows := database.QueryRows(dbConn, "SELECT u.user_id, u.name FROM rooms.player p JOIN users.\"user\" u ON p.user_id = u.user_id WHERE p.room_id = $1", roomId)
 
@@ -371,6 +664,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
 					user.Role = room.Users[user.Id].Role
 					user.Score = room.Users[user.Id].Score
+					user.Ready = room.Users[user.Id].Ready
 					user.RoomId = roomId
 
 					users = append(users, user)
@@ -383,6 +677,8 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 						},
 					})
 				}
+				updateCountdown(room)
+				sendLobbyState(room)
 			}
 		}
 
@@ -390,38 +686,49 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
 			session := r.Context().Value("session").(*handler.Session)
 
-			room := rooms[roomId]
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
 
-			if room.Users[session.UserId].Role == OWNER {
-				_, err = database.Execute(dbConn, "DELETE FROM rooms.player WHERE room_id = $1", roomId)
+			if room.Spectators[session.UserId] {
+				delete(room.Spectators, session.UserId)
+				delete(room.Connections, session.UserId)
+				sendMessage(conn, WSMessage{ Type: LEFT_ROOM, })
+				continue
+			}
+
+			if room.Users[session.UserId] == nil {
+				err = sendError(conn, 403, "not in the room")
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Could not delete user state: %v\n", err)
-					err = sendError(conn, 500, "internal server error")
-					if err != nil {
-						return
-					}
-					conn.Close()
 					return
 				}
+				continue
+			}
 
-				_, err = database.Execute(dbConn, "DELETE FROM rooms.room WHERE room_id = $1", roomId)
+			// The room is closed when its owner leaves, unless it's the
+			// match of a tournament, which goes on without them.
+			wasOwner := room.Users[session.UserId].Role == OWNER
+			closes := wasOwner
+			if wasOwner {
+				match, err := isTournamentMatch(dbConn, roomId)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Could not delete room: %v\n", err)
+					fmt.Fprintf(os.Stderr, "Could not check the tournament match of room %d: %v\n", roomId, err)
 					err = sendError(conn, 500, "internal server error")
 					if err != nil {
 						return
 					}
-					conn.Close()
-					return
+					continue
 				}
+				closes = !match
+			}
 
-				for _, c := range room.Connections {
-					sendMessage(c, WSMessage{
-						Type: ROOM_DELETED,
-					})
-					c.Close()
-				}
-				delete(rooms, roomId)
+			if closes {
+				closeRoom(dbConn, room, CLOSE_REASON_OWNER_LEFT)
 			} else {
 				_, err = database.Execute(dbConn, "DELETE FROM rooms.player WHERE user_id = $1", session.UserId)
 				if err != nil {
@@ -435,8 +742,9 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 				}
 
 				delete(room.Users, session.UserId)
+				delete(room.Connections, session.UserId)
 
-				_, err = database.Execute(dbConn, "UPDATE rooms.room SET current_users = $1", len(room.Users))
+				_, err = database.Execute(dbConn, "UPDATE rooms.room SET current_users = $1, last_activity = NOW() WHERE room_id = $2", len(room.Users), roomId)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Could not update room: %v\n", err)
 					err = sendError(conn, 500, "internal server error")
@@ -447,6 +755,13 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
+				if wasOwner {
+					err = passOwnership(dbConn, room)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Could not pass the ownership of room %d: %v\n", roomId, err)
+					}
+				}
+
 				sendMessage(conn, WSMessage{ Type: LEFT_ROOM, })
 
 				rows := database.QueryRows(dbConn, "SELECT u.user_id, u.name FROM rooms.player p JOIN users.\"user\" u ON p.user_id = u.user_id WHERE p.room_id = $1", roomId)
@@ -462,6 +777,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
 					user.Role = room.Users[user.Id].Role
 					user.Score = room.Users[user.Id].Score
+					user.Ready = room.Users[user.Id].Ready
 					user.RoomId = roomId
 
 					users = append(users, user)
@@ -475,28 +791,91 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 						},
 					})
 				}
+				updateCountdown(room)
+				sendLobbyState(room)
+			}
+		}
+
+		case SET_READY: {
+			session := r.Context().Value("session").(*handler.Session)
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			user, ok := room.Users[session.UserId]
+			if !ok {
+				err = sendError(conn, 403, "not in the room")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if room.Started {
+				err = sendError(conn, 409, "game already started")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			ready, ok := msg.Payload["ready"].(bool)
+			if !ok {
+				ready = !user.Ready
+			}
+			user.Ready = ready
+
+			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+			users, err := listUsers(dbConn, room)
+			if err != nil {
+				sendError(conn, 500, "could not get users")
+				return
 			}
+
+			broadcast(room, WSMessage{
+				Type: USERS_LIST,
+				Payload: map[string]any{
+					"users": users,
+				},
+			})
+			updateCountdown(room)
+			sendLobbyState(room)
 		}
 
 		case START_GAME: {
 			session := r.Context().Value("session").(*handler.Session)
-			room := rooms[roomId]
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
 
 			if session.UserId != room.UserId {
 				err = sendError(conn, 403, "only owner can start the game")
 				if err != nil {
 					return
 				}
+				continue
 			}
 
-			room.Started = true
-
-			for _, c := range room.Connections {
-				err := sendMessage(c, WSMessage{ Type: GAME_STARTED, })
+			if reason := checkCanStart(room); reason != "" {
+				err = sendError(conn, 409, reason)
 				if err != nil {
 					return
 				}
+				continue
 			}
+
+			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+			startGame(dbConn, room)
 		}
 
 		case GET_USERS: {
@@ -516,6 +895,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
 				user.Role = room.Users[user.Id].Role
 				user.Score = room.Users[user.Id].Score
+				user.Ready = room.Users[user.Id].Ready
 				user.RoomId = roomId
 
 				users = append(users, user)
@@ -533,18 +913,31 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		case GET_GAME_STATE: {
-			room := rooms[roomId]
-			
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
 			state := WSMessage{
 				Type: GAME_STATE,
 				Payload: map[string]any{
 					"started": room.Started,
 					"finished": room.Finished,
+					"settings": room.Settings,
 				},
 			}
 
-			if room.Started && !room.Finished {
-				state.Payload["question"] = room.Pack.Questions[room.Pack.CurrentQuestion - 1]
+			if room.Started && !room.Finished && room.Pack.CurrentQuestion > 0 {
+				question := room.Pack.Questions[room.Pack.CurrentQuestion - 1]
+				state.Payload["question"] = serveQuestion(question)
+				state.Payload["waiting_media"] = room.mediaPending != nil
+				if room.Revealed {
+					state.Payload["reveal"] = revealPayload(question)
+				}
 			}
 
 			err := sendMessage(conn, state)
@@ -554,7 +947,14 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		case NEXT_QUESTION: {
-			room := rooms[roomId]
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
 			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
 			session := r.Context().Value("session").(*handler.Session)
 
@@ -563,10 +963,23 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					return
 				}
+				continue
+			}
+
+			if !room.Started || room.Finished {
+				err := sendError(conn, 409, "the game is not being played")
+				if err != nil {
+					return
+				}
+				continue
 			}
 
+			revealQuestion(room)
+
 			if room.Pack.CurrentQuestion >= len(room.Pack.Questions) {
 				room.Finished = true
+				room.FinishedAt = time.Now()
+				setRoomState(dbConn, roomId, handler.ROOM_FINISHED)
 				for _, c := range room.Connections {
 					err := sendMessage(c, WSMessage{ Type: QUESTIONS_DONE, })
 					if err != nil {
@@ -586,6 +999,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
 					user.Role = room.Users[user.Id].Role
 					user.Score = room.Users[user.Id].Score
+					user.Ready = room.Users[user.Id].Ready
 					user.RoomId = roomId
 
 					users = append(users, user)
@@ -593,6 +1007,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 				sort.Slice(users, func(i, j int) bool {
 					return users[i].Score > users[j].Score
 				})
+				reportTournamentMatch(dbConn, roomId, users)
 
 				winner := users[0]
 				
@@ -605,20 +1020,24 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 				for _, user := range users {
 					database.Execute(dbConn, "UPDATE users.\"user\" SET matches_played = matches_played + 1 WHERE user_id = $1", user.Id)
 				}
+				recordSeasonMatch(dbConn, users, winner.Id)
 
 				continue
 			}
 
 			question := room.Pack.Questions[room.Pack.CurrentQuestion]
 			room.Pack.CurrentQuestion++
+			room.Answered = make(map[int]bool)
+			room.QuestionWon = false
+			room.Revealed = false
+			if questionHasMedia(question) {
+				waitForMedia(room)
+			} else {
+				startQuestionClock(room)
+			}
 
 			for _, c := range room.Connections {
-				err := sendMessage(c, WSMessage{
-					Type: QUESTION,
-					Payload: map[string]any{
-						"question": question,
-					},
-				})
+				err := sendMessage(c, questionMessage(question, room.Settings))
 				if err != nil {
 					return
 				}
@@ -626,32 +1045,80 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		case ANSWER: {
-			room := rooms[roomId]
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
 			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
 			session := r.Context().Value("session").(*handler.Session)
 
+			player, ok := room.Users[session.UserId]
+			if !ok {
+				err := sendError(conn, 403, "only players can answer")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
 			floatAnswer, ok := msg.Payload["answer"].(float64)
 			if !ok {
 				err := sendError(conn, 400, "expected answer to be given.")
 				if err != nil {
 					return
 				}
+				continue
 			}
 			answer := int(floatAnswer)
 
-			if room.Pack.CurrentQuestion == 0 {
+			if room.Pack.CurrentQuestion == 0 || room.Finished {
 				err := sendError(conn, 400, "no question has been successfully played yet.")
 				if err != nil {
 					return
 				}
+				continue
+			}
+
+			if room.Answered[session.UserId] {
+				err := sendError(conn, 409, "already answered this question")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if room.mediaPending != nil {
+				err := sendError(conn, 409, "the question has not started yet")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			elapsed := time.Since(room.QuestionServed)
+			if questionExpired(room.Settings, elapsed) {
+				err := sendError(conn, 409, "time is up")
+				if err != nil {
+					return
+				}
+				continue
 			}
+			room.Answered[session.UserId] = true
 
 			question := room.Pack.Questions[room.Pack.CurrentQuestion - 1]
-			for i, a := range question.Answers {
-				if answer == i && a.Correct {
-					room.Users[session.UserId].Score += question.Value
+			points, correct := scoreAnswer(room.Settings, question, answer, elapsed)
+			// Only the first correct answer scores in the first correct mode.
+			if correct && room.Settings.GameMode == handler.GAME_MODE_FIRST_CORRECT {
+				if room.QuestionWon {
+					points = 0
 				}
+				room.QuestionWon = true
 			}
+			player.Score += points
 
 			rows := database.QueryRows(dbConn, "SELECT u.user_id, u.name FROM rooms.player p JOIN users.\"user\" u ON p.user_id = u.user_id WHERE p.room_id = $1", roomId)
 
@@ -666,6 +1133,7 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
 				user.Role = room.Users[user.Id].Role
 				user.Score = room.Users[user.Id].Score
+				user.Ready = room.Users[user.Id].Ready
 				user.RoomId = roomId
 
 				users = append(users, user)
@@ -679,6 +1147,250 @@ func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 					},
 				})
 			}
+
+			if len(room.Answered) >= len(room.Users) {
+				revealQuestion(room)
+			}
+		}
+
+		case MEDIA_READY: {
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+			session := r.Context().Value("session").(*handler.Session)
+
+			mediaReady(room, session.UserId)
+		}
+
+		case REMATCH: {
+			session := r.Context().Value("session").(*handler.Session)
+			dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if session.UserId != room.UserId {
+				err = sendError(conn, 403, "only owner can offer a rematch")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if !room.Finished || room.rematch != nil {
+				err = sendError(conn, 409, "a rematch can be offered only once the game is finished")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			packId := room.PackId
+			if packIdFloat, ok := msg.Payload["pack_id"].(float64); ok {
+				packId = int(packIdFloat)
+			}
+
+			var pack Pack
+			if packId != room.PackId {
+				var playable bool
+				playable, err = handler.CanPlayPack(dbConn, packId, session.UserId, false)
+				if err == nil && !playable {
+					err = sql.ErrNoRows
+				}
+				if err == nil {
+					pack, err = loadPack(dbConn, packId)
+				}
+				if err != nil {
+					err = sendError(conn, 404, "no pack with this id exists.")
+					if err != nil {
+						return
+					}
+					continue
+				}
+			}
+
+			offerRematch(room, packId, pack)
+		}
+
+		case REMATCH_ACCEPT: {
+			session := r.Context().Value("session").(*handler.Session)
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if room.rematch == nil || room.Users[session.UserId] == nil {
+				err = sendError(conn, 409, "no rematch to accept")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			room.rematch.Accepted[session.UserId] = true
+			if len(room.rematch.Accepted) == len(room.Users) {
+				dbConn := r.Context().Value("db_connection").(*pgx.Conn)
+				startRematch(dbConn, room)
+			} else {
+				broadcast(room, WSMessage{
+					Type: REMATCH_OFFERED,
+					Payload: rematchPayload(room),
+				})
+			}
+		}
+
+		case CHAT_MESSAGE: {
+			session := r.Context().Value("session").(*handler.Session)
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			rawText, _ := msg.Payload["text"].(string)
+			text, reason := checkChatText(rawText)
+			if reason == "" {
+				reason = checkCanChat(room, session.UserId)
+			}
+			if reason != "" {
+				err = sendError(conn, 400, reason)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			postChatMessage(room, session.UserId, text)
+		}
+
+		case REACTION: {
+			session := r.Context().Value("session").(*handler.Session)
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			emoji, _ := msg.Payload["emoji"].(string)
+			reason := ""
+			if !allowedReactions[emoji] {
+				reason = "unknown reaction"
+			} else {
+				reason = checkCanChat(room, session.UserId)
+			}
+			if reason != "" {
+				err = sendError(conn, 400, reason)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			broadcast(room, WSMessage{
+				Type: REACTION,
+				Payload: map[string]any{
+					"user_id": session.UserId,
+					"emoji": emoji,
+				},
+			})
+		}
+
+		case MUTE_USER: {
+			session := r.Context().Value("session").(*handler.Session)
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if session.UserId != room.UserId {
+				err = sendError(conn, 403, "only owner can mute players")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			userIdFloat, ok := msg.Payload["user_id"].(float64)
+			if !ok {
+				err = sendError(conn, 400, "missing user_id")
+				if err != nil {
+					return
+				}
+				continue
+			}
+			userId := int(userIdFloat)
+
+			if _, ok := room.Users[userId]; !ok || userId == room.UserId {
+				err = sendError(conn, 400, "can't mute this user")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			muted, ok := msg.Payload["muted"].(bool)
+			if !ok {
+				muted = !room.Chat.Muted[userId]
+			}
+			room.Chat.Muted[userId] = muted
+
+			sendChatState(room)
+		}
+
+		case SET_CHAT: {
+			session := r.Context().Value("session").(*handler.Session)
+			room, ok := rooms[roomId]
+			if !ok {
+				err = sendError(conn, 404, "no room with this id exists.")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if session.UserId != room.UserId {
+				err = sendError(conn, 403, "only owner can change chat settings")
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			quiet, ok := msg.Payload["quiet_questions"].(bool)
+			if !ok {
+				err = sendError(conn, 400, "missing quiet_questions")
+				if err != nil {
+					return
+				}
+				continue
+			}
+			room.Chat.QuietQuestions = quiet
+
+			sendChatState(room)
 		}
 
 		default: {
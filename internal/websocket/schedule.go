@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/detectivekaktus/JGame/internal/config"
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/detectivekaktus/JGame/internal/notification"
+	"github.com/jackc/pgx/v5"
+)
+
+// Scheduled rooms can't be joined until their scheduled_at time. The
+// scheduler reminds the users that RSVP'd to the room a bit before the
+// time (see config.Config), and opens the lobby once the time comes. If
+// the room starts on schedule, the game begins after a short delay given
+// to the players to join, as long as there are at least min_players of
+// them. The readiness of the players is not required in this case.
+
+const SCHEDULE_INTERVAL = 30 * time.Second
+
+type scheduledRoom struct {
+	Id              int
+	Name            string
+	StartOnSchedule bool
+}
+
+// Notifies every RSVP'd user of the room.
+func notifyRsvps(dbConn *pgx.Conn, room scheduledRoom, title string, body string) {
+	rows := database.QueryRows(dbConn, "SELECT user_id FROM rooms.rsvp WHERE room_id = $1", room.Id)
+	var users []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read RSVPs of room %d: %v\n", room.Id, err)
+			break
+		}
+		users = append(users, id)
+	}
+	rows.Close()
+
+	for _, id := range users {
+		err := notification.Send(notification.Notification{
+			UserId: id,
+			Title: title,
+			Body: body,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not notify user %d: %v\n", id, err)
+		}
+	}
+}
+
+func queryScheduledRooms(dbConn *pgx.Conn, query string, args ...any) []scheduledRoom {
+	rows := database.QueryRows(dbConn, query, args...)
+	defer rows.Close()
+
+	var scheduled []scheduledRoom
+	for rows.Next() {
+		var room scheduledRoom
+		if err := rows.Scan(&room.Id, &room.Name, &room.StartOnSchedule); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read scheduled rooms: %v\n", err)
+			break
+		}
+		scheduled = append(scheduled, room)
+	}
+	return scheduled
+}
+
+// Reminds the RSVP'd users about the rooms that open soon. The RSVPs are
+// marked as reminded before the notifications are sent, so a failing
+// notifier doesn't spam the users on every tick.
+func remindRsvps(dbConn *pgx.Conn, now time.Time) {
+	rows := database.QueryRows(dbConn,
+		"UPDATE rooms.rsvp v SET reminded = TRUE FROM rooms.room r WHERE v.room_id = r.room_id AND NOT v.reminded AND r.state = $1 AND r.scheduled_at <= $2 RETURNING v.user_id, r.name",
+		handler.ROOM_SCHEDULED, now.Add(config.AppConfig.ScheduleReminderLead))
+
+	var reminders []notification.Notification
+	for rows.Next() {
+		var n notification.Notification
+		var name string
+		if err := rows.Scan(&n.UserId, &name); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read RSVPs to remind: %v\n", err)
+			break
+		}
+		n.Title = "Your quiz starts soon"
+		n.Body = fmt.Sprintf("The room %q opens in less than %s.", name, config.AppConfig.ScheduleReminderLead)
+		reminders = append(reminders, n)
+	}
+	rows.Close()
+
+	for _, n := range reminders {
+		if err := notification.Send(n); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not notify user %d: %v\n", n.UserId, err)
+		}
+	}
+}
+
+// Opens the lobby of every room whose time has come.
+func openScheduledRooms(dbConn *pgx.Conn, now time.Time) {
+	due := queryScheduledRooms(dbConn,
+		"UPDATE rooms.room SET state = $1, last_activity = NOW() WHERE state = $2 AND scheduled_at <= $3 RETURNING room_id, name, start_on_schedule",
+		handler.ROOM_LOBBY, handler.ROOM_SCHEDULED, now)
+
+	for _, room := range due {
+		notifyRsvps(dbConn, room, "Your quiz is open",
+			fmt.Sprintf("The room %q is open. Join now!", room.Name))
+
+		if room.StartOnSchedule {
+			id := room.Id
+			time.AfterFunc(config.AppConfig.ScheduleStartDelay, func() {
+				startOnSchedule(id)
+			})
+		}
+	}
+}
+
+// Starts the game in the room opened by the scheduler. Nothing happens if
+// nobody joined the room, the game was started by the owner already or
+// there are not enough players.
+func startOnSchedule(roomId int) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	room, ok := rooms[roomId]
+	if !ok || room.Started || len(room.Users) < room.Settings.MinPlayers {
+		return
+	}
+
+	dbConn := database.GetConnection()
+	defer dbConn.Close(context.Background())
+	startGame(dbConn, room)
+}
+
+// Starts the background scheduler of rooms. It also archives the seasons
+// once they are over.
+func StartScheduler() {
+	go func() {
+		ticker := time.NewTicker(SCHEDULE_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			dbConn := database.GetConnection()
+			now := time.Now()
+			remindRsvps(dbConn, now)
+			openScheduledRooms(dbConn, now)
+			handler.ArchiveEndedSeasons(dbConn)
+			dbConn.Close(context.Background())
+		}
+	}()
+}
@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/jackc/pgx/v5"
+)
+
+// Counts the finished match towards the stats of its players in the
+// current season (see handler.Season), if there's one. `winnerId` is the
+// player who won the match.
+func recordSeasonMatch(dbConn *pgx.Conn, users []User, winnerId int) {
+	seasonId, err := handler.CurrentSeasonId(dbConn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get the current season: %v\n", err)
+		return
+	}
+	if seasonId == 0 {
+		return
+	}
+
+	for _, user := range users {
+		won, points := 0, -handler.SEASON_LOSS_POINTS
+		if user.Id == winnerId {
+			won, points = 1, handler.SEASON_WIN_POINTS
+		}
+
+		_, err = database.Execute(dbConn, "INSERT INTO users.season_stats (season_id, user_id, matches_played, matches_won, rating) VALUES ($1, $2, 1, $3, $4 + $5) ON CONFLICT (season_id, user_id) DO UPDATE SET matches_played = season_stats.matches_played + 1, matches_won = season_stats.matches_won + $3, rating = GREATEST(season_stats.rating + $5, 0)",
+			seasonId, user.Id, won, handler.SEASON_BASE_RATING, points)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not record the season match of user %d: %v\n", user.Id, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/detectivekaktus/JGame/internal/database"
+	"github.com/detectivekaktus/JGame/internal/handler"
+	"github.com/jackc/pgx/v5"
+)
+
+// The rooms of the tournament matches (see handler.Tournament) are played
+// like any other room, except that only the players seeded into the match
+// can take a seat in them. Once the game is over the room reports the
+// ranking of the players back to the tournament.
+
+// Returns whether the room is the match of a tournament. The ids of the
+// closed rooms are reused, so only the matches still being played count.
+func isTournamentMatch(dbConn *pgx.Conn, roomId int) (bool, error) {
+	var match bool
+	err := database.QueryRow(dbConn, "SELECT EXISTS (SELECT * FROM rooms.tournament_match WHERE room_id = $1 AND state = $2)",
+		roomId, handler.MATCH_PLAYING).Scan(&match)
+	return match, err
+}
+
+// Makes another player of the room its owner, so the match of a tournament
+// can still be started after its owner left. Does nothing if nobody is
+// left in the room. Must be called with roomsMu held.
+func passOwnership(dbConn *pgx.Conn, room *Room) error {
+	for id, user := range room.Users {
+		_, err := database.Execute(dbConn, "UPDATE rooms.room SET user_id = $1 WHERE room_id = $2", id, room.Id)
+		if err != nil {
+			return err
+		}
+		user.Role = OWNER
+		user.Ready = false
+		room.UserId = id
+		return nil
+	}
+	return nil
+}
+
+// Returns whether the user can play in the room. Everyone can play in the
+// rooms that are not tournament matches.
+func canTakeSeat(dbConn *pgx.Conn, roomId int, userId int) (bool, error) {
+	var allowed bool
+	err := database.QueryRow(dbConn, "SELECT NOT EXISTS (SELECT * FROM rooms.tournament_match WHERE room_id = $1 AND state = $3) OR EXISTS (SELECT * FROM rooms.tournament_entry e JOIN rooms.tournament_match m ON e.tournament_id = m.tournament_id AND e.round = m.round AND e.slot = m.slot WHERE m.room_id = $1 AND m.state = $3 AND e.user_id = $2)",
+		roomId, userId, handler.MATCH_PLAYING).Scan(&allowed)
+	return allowed, err
+}
+
+// Records the ranking of the finished game if the room is a tournament
+// match. `users` must be sorted by score, the best first. The seeded
+// players who never joined the room don't advance. If the match was the
+// only one in its round, it was the final and the tournament is over.
+func reportTournamentMatch(dbConn *pgx.Conn, roomId int, users []User) {
+	var tournamentId, round, slot, advance, seats, matches int
+	err := database.QueryRow(dbConn, "SELECT m.tournament_id, m.round, m.slot, t.advance, (SELECT COUNT(*) FROM rooms.tournament_entry e WHERE e.tournament_id = m.tournament_id AND e.round = m.round AND e.slot = m.slot), (SELECT COUNT(*) FROM rooms.tournament_match o WHERE o.tournament_id = m.tournament_id AND o.round = m.round) FROM rooms.tournament_match m JOIN rooms.tournament t ON m.tournament_id = t.tournament_id WHERE m.room_id = $1 AND m.state = $2",
+		roomId, handler.MATCH_PLAYING).Scan(&tournamentId, &round, &slot, &advance, &seats, &matches)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Fprintf(os.Stderr, "Could not get the tournament match of room %d: %v\n", roomId, err)
+		}
+		return
+	}
+
+	// Somebody is always knocked out, so the tournament gets to the final
+	// even when the rooms are smaller than room_size.
+	advance = min(advance, seats - 1)
+
+	for i, user := range users {
+		rank := i + 1
+		_, err = database.Execute(dbConn, "UPDATE rooms.tournament_entry SET score = $1, rank = $2, advanced = $3 WHERE tournament_id = $4 AND round = $5 AND slot = $6 AND user_id = $7",
+			user.Score, rank, rank <= advance, tournamentId, round, slot, user.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not record the tournament result of user %d: %v\n", user.Id, err)
+		}
+	}
+
+	_, err = database.Execute(dbConn, "UPDATE rooms.tournament_match SET state = $1 WHERE tournament_id = $2 AND round = $3 AND slot = $4",
+		handler.MATCH_FINISHED, tournamentId, round, slot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not finish the tournament match of room %d: %v\n", roomId, err)
+		return
+	}
+
+	if matches == 1 && len(users) > 0 {
+		_, err = database.Execute(dbConn, "UPDATE rooms.tournament SET state = $1, winner_id = $2 WHERE tournament_id = $3",
+			handler.TOURNAMENT_FINISHED, users[0].Id, tournamentId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not finish tournament %d: %v\n", tournamentId, err)
+		}
+	}
+}
@@ -77,6 +77,7 @@ export function RoomPage() {
     onMessageType(WSActionType.QUESTIONS_DONE, () => setFinished(true));
     onMessageType(WSActionType.LEFT_ROOM, () => navigate(-1));
     onMessageType(WSActionType.ROOM_DELETED, () => navigate(-1));
+    onMessageType(WSActionType.ROOM_CLOSED, () => navigate(-1));
     onMessageType(WSActionType.GAME_STATE, (msg: WSMessage) => {
       const msgStarted = msg.payload["started"];
       setStarted(msgStarted);